@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// isAdmin reports whether username may use the administration endpoints:
+// users with the admin role, and the users listed as admins in the
+// configuration, who are also given the role when the server starts.
+// Disabled users are never administrators.
+func (a *App) isAdmin(username string) (bool, error) {
+	if a.config != nil {
+		for _, admin := range a.config.Admins {
+			if admin == username {
+				disabled, err := a.userDisabled(username)
+				return !disabled, err
+			}
+		}
+	}
+
+	var isAdmin bool
+	err := a.db.QueryRow("SELECT role = $2 AND disabled_at IS NULL FROM users WHERE username = $1", username, roleAdmin).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return isAdmin, err
+}
+
+// requireAdmin is a middleware that only lets administrators through.
+// It must run after the authentication middleware.
+func (a *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isAdmin, err := a.isAdmin(currentUsername(r))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !isAdmin {
+			if !wantsJSON(r) {
+				http.Error(w, "Administrator access required", http.StatusForbidden)
+				return
+			}
+			respondWithError(w, http.StatusForbidden, "administrator access required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// promoteConfiguredAdmins gives the admin role to the users listed as admins
+// in the configuration, so that a new installation has an administrator.
+func (a *App) promoteConfiguredAdmins() error {
+	for _, username := range a.config.Admins {
+		if _, err := a.db.Exec("UPDATE users SET role = $2 WHERE username = $1", username, roleAdmin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiListLockoutsHandler lists the usernames and addresses currently locked out.
+func (a *App) apiListLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := a.listLoginLockouts()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, lockouts)
+}
+
+// apiUnlockLoginHandler lifts the lockout of a username or client address.
+func (a *App) apiUnlockLoginHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := a.unlockLogin(vars["kind"], vars["key"])
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "No failed logins recorded")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles stored in users.role.
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// userActionError is a change to a user that cannot be made, worded for the administrator.
+type userActionError string
+
+func (e userActionError) Error() string { return string(e) }
+
+// AdminUser is a user as shown in the admin console.
+type AdminUser struct {
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	Organization string `json:"organization"`
+	Email        string `json:"email,omitempty"`
+	Disabled     bool   `json:"disabled"`
+	TwoFactor    bool   `json:"two_factor"`
+	Notes        int    `json:"notes"`
+}
+
+// validUsername reports whether name can be used as a username. Usernames
+// appear in URLs, so they may not contain slashes or spaces.
+func validUsername(name string) bool {
+	return name != "" && len(name) <= 50 && !strings.ContainsAny(name, "/ \t\r\n")
+}
+
+// listUsers returns every user with the number of notes they own.
+func (a *App) listUsers() ([]AdminUser, error) {
+	rows, err := a.db.Query(`
+		SELECT u.username, u.role, o.name, COALESCE(u.email, ''), u.disabled_at IS NOT NULL, u.totp_enabled_at IS NOT NULL,
+			(SELECT COUNT(*) FROM notes n WHERE n.owner = u.username)
+		FROM users u
+		INNER JOIN organizations o ON o.id = u.org_id
+		ORDER BY LOWER(o.name), LOWER(u.username)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.Username, &u.Role, &u.Organization, &u.Email, &u.Disabled, &u.TwoFactor, &u.Notes); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// execOne runs a statement that must change exactly one row, returning
+// sql.ErrNoRows otherwise.
+func execOne(tx *sql.Tx, query string, args ...interface{}) error {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// transferNotes gives the notes owned by from to to, who must be in the
+// same organization. Shares and delegations of those notes to the new owner
+// are removed, as owners have full access, and the notes are taken out of
+// the notebooks of the previous owner.
+func transferNotes(tx *sql.Tx, from, to string) (int64, error) {
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u INNER JOIN users f ON f.org_id = u.org_id
+			WHERE u.username = $1 AND f.username = $2
+		)`, to, from).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, userActionError(fmt.Sprintf("User %s does not exist in the organization of %s.", to, from))
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_shares WHERE username = $2 AND note_id IN (SELECT id FROM notes WHERE owner = $1)", from, to); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE notes SET noteDelegation = NULL WHERE owner = $1 AND noteDelegation = $2", from, to); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("UPDATE notes SET owner = $2, notebook_id = NULL WHERE owner = $1", from, to)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// userChange is a change to a user made by an administrator. value is the
+// new role, username, password or organization, or the user receiving the
+// notes, depending on the action.
+type userChange struct {
+	action, value string
+}
+
+// checkUserChange refuses a change that cannot be made before anything is written.
+func checkUserChange(actor, username string, c userChange) error {
+	if username == actor && (c.action == "disable" || c.action == "delete" || (c.action == "role" && c.value != roleAdmin)) {
+		return userActionError("You cannot disable, delete or demote yourself.")
+	}
+
+	switch c.action {
+	case "role":
+		if c.value != roleUser && c.value != roleAdmin {
+			return userActionError(fmt.Sprintf("Unknown role %q.", c.value))
+		}
+	case "rename":
+		if !validUsername(c.value) {
+			return userActionError("Usernames must have 1 to 50 bytes and no spaces or slashes.")
+		}
+	case "transfer", "delete":
+		if c.value == username {
+			return userActionError("Choose another user to receive the notes.")
+		}
+	case "disable", "enable", "organization", "password":
+	default:
+		return userActionError(fmt.Sprintf("Unknown action %q.", c.action))
+	}
+	return nil
+}
+
+// performUserAction makes a change to a user on behalf of the administrator
+// actor and returns a message describing it.
+func (a *App) performUserAction(actor, username, action, value string) (string, error) {
+	change := userChange{action: action, value: value}
+	if err := checkUserChange(actor, username, change); err != nil {
+		return "", err
+	}
+
+	// Setting a password has its own transaction
+	if action == "password" {
+		if err := a.passwordPolicy().check(username, value); err != nil {
+			return "", userActionError(err.Error())
+		}
+		if err := a.changePassword(username, value, ""); err != nil {
+			return "", err
+		}
+		log.Printf("Administrator %s set the password of %s", actor, username)
+		return fmt.Sprintf("The password of %s has been set and their sessions signed out.", username), nil
+	}
+
+	return a.performUserChanges(actor, username, []userChange{change})
+}
+
+// performUserChanges makes all changes to a user in one transaction, so that
+// either all or none of them are made, and returns the messages describing them.
+// Unknown users give sql.ErrNoRows, and changes that cannot be made a userActionError.
+func (a *App) performUserChanges(actor, username string, changes []userChange) (string, error) {
+	for _, c := range changes {
+		if c.action == "password" {
+			return "", userActionError("Passwords are set on their own.")
+		}
+		if err := checkUserChange(actor, username, c); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var messages []string
+	for _, c := range changes {
+		message, err := applyUserChange(tx, username, c)
+		if err != nil {
+			return "", err
+		}
+		messages = append(messages, message)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	for _, message := range messages {
+		log.Printf("Administrator %s: %s", actor, message)
+	}
+	return strings.Join(messages, " "), nil
+}
+
+// applyUserChange makes a checked change to a user within tx.
+func applyUserChange(tx *sql.Tx, username string, c userChange) (string, error) {
+	action, value := c.action, c.value
+
+	var message string
+	switch action {
+	case "role":
+		if err := execOne(tx, "UPDATE users SET role = $2 WHERE username = $1", username, value); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s is now %s.", username, map[string]string{roleUser: "a user", roleAdmin: "an administrator"}[value])
+
+	case "disable":
+		if err := execOne(tx, "UPDATE users SET disabled_at = $2 WHERE username = $1 AND disabled_at IS NULL", username, time.Now().UTC()); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE username = $1", username); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s has been disabled and signed out.", username)
+
+	case "enable":
+		if err := execOne(tx, "UPDATE users SET disabled_at = NULL WHERE username = $1", username); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s has been enabled.", username)
+
+	case "rename":
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", value).Scan(&taken); err != nil {
+			return "", err
+		}
+		if taken {
+			return "", userActionError(fmt.Sprintf("User %s already exists.", value))
+		}
+
+		// Foreign keys follow the new name, except the delegation column
+		// and the sessions, which hold the old name
+		if err := execOne(tx, "UPDATE users SET username = $2 WHERE username = $1", username, value); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("UPDATE notes SET noteDelegation = $2 WHERE noteDelegation = $1", username, value); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE username = $1", value); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s has been renamed to %s.", username, value)
+
+	case "organization":
+		if err := moveToOrganization(tx, username, value); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s has been moved to %s.", username, value)
+
+	case "transfer":
+		if err := tx.QueryRow("SELECT username FROM users WHERE username = $1", username).Scan(new(string)); err != nil {
+			return "", err
+		}
+		n, err := transferNotes(tx, username, value)
+		if err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%d notes of %s now belong to %s.", n, username, value)
+
+	case "delete":
+		// Notes are deleted with their owner unless they are handed over first
+		if value != "" {
+			if _, err := transferNotes(tx, username, value); err != nil {
+				return "", err
+			}
+		}
+		if _, err := tx.Exec("UPDATE notes SET noteDelegation = NULL WHERE noteDelegation = $1", username); err != nil {
+			return "", err
+		}
+		if err := execOne(tx, "DELETE FROM users WHERE username = $1", username); err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("%s has been deleted.", username)
+		if value != "" {
+			message = fmt.Sprintf("%s has been deleted and their notes given to %s.", username, value)
+		}
+
+	default:
+		return "", userActionError(fmt.Sprintf("Unknown action %q.", action))
+	}
+
+	return message, nil
+}
+
+// adminUsersHandler shows the admin console with the list of users.
+func (a *App) adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/admin"})
+	}
+
+	users, err := a.listUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	organizations, err := a.listOrganizations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("tmpl/admin_users.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Username      string
+		Users         []AdminUser
+		Organizations []Organization
+		Message       string
+		CSRFToken     string
+	}{
+		Username:      currentUsername(r),
+		Users:         users,
+		Organizations: organizations,
+		Message:       message,
+		CSRFToken:     csrfToken(r),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// adminUserActionHandler applies a change submitted from the admin console.
+func (a *App) adminUserActionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	message, err := a.performUserAction(currentUsername(r), vars["username"], vars["action"], strings.TrimSpace(r.FormValue("value")))
+	var actionErr userActionError
+	switch {
+	case err == sql.ErrNoRows:
+		message = fmt.Sprintf("User %s was not found, or was already in that state.", vars["username"])
+	case errors.As(err, &actionErr):
+		message = actionErr.Error()
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/admin",
+	})
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// respondToUserAction answers an API request that changed a user.
+func respondToUserAction(w http.ResponseWriter, message string, err error) {
+	var actionErr userActionError
+	switch {
+	case err == sql.ErrNoRows:
+		respondWithError(w, http.StatusNotFound, "User not found, or already in that state")
+	case errors.As(err, &actionErr):
+		respondWithError(w, http.StatusBadRequest, actionErr.Error())
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	default:
+		respondWithJSON(w, http.StatusOK, map[string]string{"message": message})
+	}
+}
+
+// apiListUsersHandler lists all users.
+func (a *App) apiListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := a.listUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+// userPatch is the JSON body accepted when changing a user. Absent fields are left unchanged.
+type userPatch struct {
+	Role         *string `json:"role"`
+	Disabled     *bool   `json:"disabled"`
+	Organization *string `json:"organization"`
+	Username     *string `json:"username"`
+}
+
+// apiUpdateUserHandler changes the role, disabled state, organization or username of a user,
+// all or nothing.
+func (a *App) apiUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var patch userPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var changes []userChange
+	if patch.Role != nil {
+		changes = append(changes, userChange{action: "role", value: *patch.Role})
+	}
+	if patch.Disabled != nil {
+		action := "enable"
+		if *patch.Disabled {
+			action = "disable"
+		}
+		changes = append(changes, userChange{action: action})
+	}
+	if patch.Organization != nil {
+		changes = append(changes, userChange{action: "organization", value: *patch.Organization})
+	}
+	// The new name comes last, as the other changes find the user by the old one
+	if patch.Username != nil {
+		changes = append(changes, userChange{action: "rename", value: *patch.Username})
+	}
+
+	message, err := a.performUserChanges(currentUsername(r), mux.Vars(r)["username"], changes)
+	respondToUserAction(w, message, err)
+}
+
+// apiDeleteUserHandler deletes a user, first giving their notes to the user
+// in the transfer_to parameter when there is one.
+func (a *App) apiDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	message, err := a.performUserAction(currentUsername(r), mux.Vars(r)["username"], "delete", r.URL.Query().Get("transfer_to"))
+	respondToUserAction(w, message, err)
+}
+
+// apiSetUserPasswordHandler sets a new password for a user.
+func (a *App) apiSetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	message, err := a.performUserAction(currentUsername(r), mux.Vars(r)["username"], "password", body.Password)
+	respondToUserAction(w, message, err)
+}
+
+// apiTransferNotesHandler gives all notes of a user to another user.
+func (a *App) apiTransferNotesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		To string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	message, err := a.performUserAction(currentUsername(r), mux.Vars(r)["username"], "transfer", body.To)
+	respondToUserAction(w, message, err)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPerformUserAction_Self(t *testing.T) {
+	a := App{}
+
+	for _, tt := range []struct{ action, value string }{{"disable", ""}, {"delete", ""}, {"role", roleUser}} {
+		_, err := a.performUserAction("mydog7", "mydog7", tt.action, tt.value)
+		var actionErr userActionError
+		if !errors.As(err, &actionErr) {
+			t.Errorf("%s: expected a userActionError, but got %v", tt.action, err)
+		}
+	}
+}
+
+func TestPerformUserAction_DeleteWithTransfer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("mydog7", "BIGCAT").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("DELETE FROM user_shares").WithArgs("BIGCAT", "mydog7").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE notes SET noteDelegation = NULL WHERE owner").WithArgs("BIGCAT", "mydog7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE notes SET owner = \$2, notebook_id = NULL`).WithArgs("BIGCAT", "mydog7").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE notes SET noteDelegation = NULL WHERE noteDelegation").WithArgs("BIGCAT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM users").WithArgs("BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	message, err := a.performUserAction("mydog7", "BIGCAT", "delete", "mydog7")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !strings.Contains(message, "given to mydog7") {
+		t.Errorf("Unexpected message %q", message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPerformUserAction_Rename(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	// The new name is taken
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("mydog7").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+	var actionErr userActionError
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "rename", "mydog7"); !errors.As(err, &actionErr) {
+		t.Errorf("Expected a userActionError, but got %v", err)
+	}
+
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "rename", "big cat"); !errors.As(err, &actionErr) {
+		t.Errorf("Expected a username with a space to be refused, but got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("LITTLECAT").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE users SET username").WithArgs("BIGCAT", "LITTLECAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE notes SET noteDelegation").WithArgs("BIGCAT", "LITTLECAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions").WithArgs("LITTLECAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "rename", "LITTLECAT"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	// Unknown users
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET disabled_at").WithArgs("nobody", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if _, err := a.performUserAction("mydog7", "nobody", "disable", ""); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIListUsers(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// Not an administrator
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery("SELECT role").WithArgs("BIGCAT", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(false))
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/admin/users", nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT role").WithArgs("mydog7", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(true))
+	mock.ExpectQuery("SELECT u.username, u.role").WillReturnRows(
+		sqlmock.NewRows([]string{"username", "role", "organization", "email", "disabled", "two_factor", "notes"}).
+			AddRow("BIGCAT", roleUser, "Default", "", true, false, 2).
+			AddRow("mydog7", roleAdmin, "Default", "mydog7@example.com", false, true, 5))
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/admin/users", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var users []AdminUser
+	if err := json.Unmarshal(rr.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !users[0].Disabled || users[1].Role != roleAdmin || users[1].Notes != 5 {
+		t.Errorf("Unexpected users %+v", users)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIAdmin_SessionOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	a.config = defaultConfig()
+	a.config.Admins = []string{"mydog7"}
+
+	// API tokens of administrators cannot be used for administration
+	token := apiTokenPrefix + "admin"
+	mock.ExpectQuery("SELECT id, username, name, read_only").WithArgs(hashAPIToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "read_only", "created_at", "expires_at", "last_used_at"}).
+			AddRow(1, "mydog7", "ci", false, time.Now(), nil, nil))
+	mock.ExpectExec("UPDATE api_tokens SET last_used_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	req := httptest.NewRequest("GET", "/api/v1/admin/users", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for an API token, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Disabled administrators from the configuration
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(true))
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/admin/users", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for a disabled administrator, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUpdateUser_AllOrNothing(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectAdmin := func() {
+		expectActiveUser(mock, "mydog7")
+		mock.ExpectQuery("SELECT role").WithArgs("mydog7", roleAdmin).
+			WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(true))
+	}
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := loginRequest(httptest.NewRequest("PATCH", "/api/v1/admin/users/BIGCAT", strings.NewReader(body)), "mydog7")
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Invalid fields are refused before anything is changed
+	expectAdmin()
+	if rr := patch(`{"role": "admin", "username": "big cat"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// A later field failing rolls back the earlier ones
+	expectAdmin()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET role").WithArgs("BIGCAT", roleAdmin).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("mydog7").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+	if rr := patch(`{"role": "admin", "username": "mydog7"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// All fields are changed together
+	expectAdmin()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET role").WithArgs("BIGCAT", roleAdmin).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET disabled_at = NULL").WithArgs("BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rr := patch(`{"role": "admin", "disabled": false}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "an administrator. BIGCAT has been enabled.") {
+		t.Errorf("Expected both changes, but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
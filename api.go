@@ -0,0 +1,718 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxNoteFieldLength is the longest title accepted for a note.
+const maxNoteFieldLength = 256
+
+// noteInput is the JSON body accepted when creating or patching a note.
+// Fields left out of a PATCH request keep their current value.
+type noteInput struct {
+	Title              *string   `json:"title"`
+	NoteType           *string   `json:"note_type"`
+	Description        *string   `json:"description"`
+	TaskCompletionTime *string   `json:"task_completion_time"`
+	TaskCompletionDate *string   `json:"task_completion_date"`
+	NoteStatus         *string   `json:"note_status"`
+	NoteDelegation     *string   `json:"note_delegation"`
+	Tags               *[]string `json:"tags"`
+	NotebookID         *int      `json:"notebook_id"`
+}
+
+// shareInput is the JSON body accepted when sharing a note or changing privileges.
+type shareInput struct {
+	Username   string `json:"username"`
+	Privileges string `json:"privileges"`
+}
+
+// delegationInput is the JSON body accepted when delegating a note.
+type delegationInput struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+// delegationResponse describes who a note is delegated to.
+type delegationResponse struct {
+	NoteID   int    `json:"note_id"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+// noteResponse is the JSON representation of a note. Fields without a value
+// are left out.
+type noteResponse struct {
+	ID                 int             `json:"id"`
+	Title              string          `json:"title"`
+	NoteType           string          `json:"note_type"`
+	Description        string          `json:"description"`
+	DescriptionHTML    template.HTML   `json:"description_html,omitempty"`
+	NoteCreated        time.Time       `json:"note_created"`
+	TaskCompletionTime *string         `json:"task_completion_time,omitempty"`
+	TaskCompletionDate *string         `json:"task_completion_date,omitempty"`
+	NoteStatus         *string         `json:"note_status,omitempty"`
+	NoteDelegation     *string         `json:"note_delegation,omitempty"`
+	Owner              string          `json:"owner"`
+	Privileges         string          `json:"privileges,omitempty"`
+	SharedUsers        []shareResponse `json:"shared_users,omitempty"`
+	Tags               []string        `json:"tags,omitempty"`
+	NotebookID         int             `json:"notebook_id,omitempty"`
+}
+
+// shareResponse describes a user a note is shared with.
+type shareResponse struct {
+	NoteID     int    `json:"note_id,omitempty"`
+	Username   string `json:"username"`
+	Privileges string `json:"privileges"`
+}
+
+// nullableString returns nil for a NULL or empty value.
+func nullableString(s sql.NullString) *string {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	return &s.String
+}
+
+// newNoteResponse converts a note for the API.
+func newNoteResponse(note Note) noteResponse {
+	resp := noteResponse{
+		ID:                 note.ID,
+		Title:              note.Title,
+		NoteType:           note.NoteType,
+		Description:        note.Description,
+		DescriptionHTML:    note.DescriptionHTML,
+		NoteCreated:        note.NoteCreated,
+		TaskCompletionTime: nullableString(note.TaskCompletionTime),
+		TaskCompletionDate: nullableString(note.TaskCompletionDate),
+		NoteStatus:         nullableString(note.NoteStatus),
+		NoteDelegation:     nullableString(note.NoteDelegation),
+		Owner:              note.Owner,
+		Privileges:         note.Privileges,
+		Tags:               note.Tags,
+		NotebookID:         note.NotebookID,
+	}
+	for _, share := range note.SharedUsers {
+		resp.SharedUsers = append(resp.SharedUsers, newShareResponse(share))
+	}
+	return resp
+}
+
+// newNoteResponses converts a list of notes for the API.
+func newNoteResponses(notes []Note) []noteResponse {
+	resp := make([]noteResponse, 0, len(notes))
+	for _, note := range notes {
+		resp = append(resp, newNoteResponse(note))
+	}
+	return resp
+}
+
+// newShareResponse converts a share for the API.
+func newShareResponse(share UserShare) shareResponse {
+	return shareResponse{NoteID: share.NoteID, Username: share.Username.String, Privileges: share.Privileges.String}
+}
+
+// apply copies the fields present in the input onto the note.
+func (in noteInput) apply(note *Note) {
+	if in.Title != nil {
+		note.Title = *in.Title
+	}
+	if in.NoteType != nil {
+		note.NoteType = *in.NoteType
+	}
+	if in.Description != nil {
+		note.Description = *in.Description
+	}
+	if in.TaskCompletionTime != nil {
+		note.TaskCompletionTime = sql.NullString{String: *in.TaskCompletionTime, Valid: true}
+	}
+	if in.TaskCompletionDate != nil {
+		note.TaskCompletionDate = sql.NullString{String: *in.TaskCompletionDate, Valid: true}
+	}
+	if in.NoteStatus != nil {
+		note.NoteStatus = sql.NullString{String: *in.NoteStatus, Valid: true}
+	}
+	if in.NoteDelegation != nil {
+		note.NoteDelegation = sql.NullString{String: *in.NoteDelegation, Valid: true}
+	}
+}
+
+// tags returns the normalized tags of the input, or nil when they are left out.
+func (in noteInput) tags() ([]string, error) {
+	if in.Tags == nil {
+		return nil, nil
+	}
+	return normalizeTags(*in.Tags)
+}
+
+// validateNote checks the fields of a note before it is written to the database.
+func validateNote(note Note) error {
+	if strings.TrimSpace(note.Title) == "" {
+		return errors.New("title is required")
+	}
+	if note.NoteType == "" {
+		return errors.New("note_type is required")
+	}
+	if len(note.Title) > maxNoteFieldLength {
+		return fmt.Errorf("note title exceeds %d characters", maxNoteFieldLength)
+	}
+	if len(note.Description) > maxDescriptionLength {
+		return fmt.Errorf("note description exceeds %d characters", maxDescriptionLength)
+	}
+
+	return nil
+}
+
+// isValidPrivilege reports whether privileges is a value accepted in user_shares.
+func isValidPrivilege(privileges string) bool {
+	switch privileges {
+	case privilegeEditor, privilegeViewer, privilegeWrite, privilegeRead:
+		return true
+	}
+	return false
+}
+
+// decodeJSON decodes the request body into v, rejecting unknown fields.
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// noteIDFromVars parses the {noteID} route variable.
+func noteIDFromVars(r *http.Request) (int, error) {
+	noteID, err := strconv.Atoi(mux.Vars(r)["noteID"])
+	if err != nil {
+		return 0, errors.New("invalid noteID")
+	}
+	return noteID, nil
+}
+
+// checkAPIDelegate checks that a note of username can be delegated to
+// delegate. On failure it writes the JSON error response and returns false.
+func (a *App) checkAPIDelegate(w http.ResponseWriter, username, delegate string) bool {
+	err := a.checkDelegate(username, delegate)
+	if err == errDelegateNotFound {
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	return true
+}
+
+// authorizeAPINote parses the note ID from the URL and checks access to it.
+// On failure it writes the JSON error response and returns false.
+func (a *App) authorizeAPINote(w http.ResponseWriter, r *http.Request, action noteAction) (int, bool) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return 0, false
+	}
+
+	if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, action); err != nil {
+		respondWithError(w, noteAuthStatus(err), err.Error())
+		return 0, false
+	}
+
+	return noteID, true
+}
+
+// apiListNotesHandler returns the notes visible to the user.
+// Supported query parameters: scope (owned, shared, delegated or all),
+// type, status, owner, q (case-insensitive match on title and description),
+// tags (comma separated), match (all or any of the tags) and notebook
+// (the notes in a notebook and the notebooks inside it).
+func (a *App) apiListNotesHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+	query := r.URL.Query()
+
+	filter, err := parseTagFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var notebookID int
+	if value := query.Get("notebook"); value != "" {
+		if notebookID, err = strconv.Atoi(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "notebook must be a notebook ID")
+			return
+		}
+		if err := a.authorizeNotebook(username, notebookID, false); err != nil {
+			respondWithNotebookError(w, err)
+			return
+		}
+	}
+
+	scope := query.Get("scope")
+	if scope == "" {
+		scope = "all"
+	}
+	if scope != "owned" && scope != "shared" && scope != "delegated" && scope != "all" {
+		respondWithError(w, http.StatusBadRequest, "scope must be one of owned, shared, delegated or all")
+		return
+	}
+
+	var notes []Note
+	if scope == "owned" || scope == "all" {
+		owned, err := a.retrieveNotes(username)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		notes = append(notes, owned...)
+	}
+	if scope == "shared" || scope == "all" {
+		shared, err := a.retrieveSharedNotesWithPrivileges(username)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		notes = append(notes, shared...)
+	}
+	if scope == "delegated" || scope == "all" {
+		delegated, err := a.retrieveDelegatedNotes(username)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		notes = append(notes, delegated...)
+	}
+
+	noteType := query.Get("type")
+	status := query.Get("status")
+	owner := query.Get("owner")
+	text := strings.ToLower(query.Get("q"))
+
+	// A note that is both delegated to and shared with the user is only listed once
+	seen := make(map[int]bool)
+	result := []Note{}
+	for _, note := range notes {
+		if seen[note.ID] {
+			continue
+		}
+		if noteType != "" && note.NoteType != noteType {
+			continue
+		}
+		if status != "" && note.NoteStatus.String != status {
+			continue
+		}
+		if owner != "" && note.Owner != owner {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(note.Title), text) && !strings.Contains(strings.ToLower(markdownText(note.Description)), text) {
+			continue
+		}
+		seen[note.ID] = true
+		result = append(result, note)
+	}
+
+	if err := a.loadTags(result); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result, err = a.scopeToNotebook(filter.apply(result), notebookID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	renderDescriptions(result)
+	respondWithJSON(w, http.StatusOK, newNoteResponses(result))
+}
+
+// apiGetNoteHandler returns a single note together with its shares.
+func (a *App) apiGetNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note.SharedUsers, err = a.getSharedUsersForNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := a.loadNoteTags(note); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.DescriptionHTML = renderMarkdown(note.Description)
+
+	respondWithJSON(w, http.StatusOK, newNoteResponse(*note))
+}
+
+// apiCreateNoteHandler creates a note owned by the user.
+func (a *App) apiCreateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var in noteInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note := Note{Owner: currentUsername(r)}
+	in.apply(&note)
+	if err := validateNote(note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tags, err := in.tags()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.checkAPIDelegate(w, note.Owner, note.NoteDelegation.String) {
+		return
+	}
+	if in.NotebookID != nil && *in.NotebookID != 0 {
+		if err := a.authorizeNotebook(note.Owner, *in.NotebookID, true); err != nil {
+			respondWithNotebookError(w, err)
+			return
+		}
+	}
+
+	id, err := a.insertNoteIntoDatabase(note)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(tags) > 0 {
+		if err := a.setNoteTags(id, tags); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if in.NotebookID != nil && *in.NotebookID != 0 {
+		if err := a.moveNote(id, *in.NotebookID); err != nil {
+			respondWithNotebookError(w, err)
+			return
+		}
+	}
+
+	created, err := a.getNoteByID(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := a.loadNoteTags(created); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	created.DescriptionHTML = renderMarkdown(created.Description)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/notes/%d", id))
+	respondWithJSON(w, http.StatusCreated, newNoteResponse(*created))
+}
+
+// apiPatchNoteHandler updates the fields present in the request body.
+func (a *App) apiPatchNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionUpdate)
+	if !ok {
+		return
+	}
+
+	var in noteInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Editors cannot hand the note to someone else
+	if in.NoteDelegation != nil && *in.NoteDelegation != note.NoteDelegation.String {
+		if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, delegationAction(*in.NoteDelegation)); err != nil {
+			respondWithError(w, noteAuthStatus(err), err.Error())
+			return
+		}
+	}
+
+	in.apply(note)
+	if err := validateNote(*note); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tags, err := in.tags()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.NoteDelegation != nil && !a.checkAPIDelegate(w, currentUsername(r), *in.NoteDelegation) {
+		return
+	}
+	// Only the owner can move a note to another notebook
+	if in.NotebookID != nil && *in.NotebookID != note.NotebookID {
+		if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionMove); err != nil {
+			respondWithError(w, noteAuthStatus(err), err.Error())
+			return
+		}
+		if *in.NotebookID != 0 {
+			if err := a.authorizeNotebook(currentUsername(r), *in.NotebookID, true); err != nil {
+				respondWithNotebookError(w, err)
+				return
+			}
+		}
+	}
+
+	if err := a.updateNoteInDatabase(*note, currentUsername(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if in.Tags != nil {
+		if err := a.setNoteTags(noteID, tags); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if in.NotebookID != nil && *in.NotebookID != note.NotebookID {
+		if err := a.moveNote(noteID, *in.NotebookID); err != nil {
+			respondWithNotebookError(w, err)
+			return
+		}
+		note.NotebookID = *in.NotebookID
+	}
+	if err := a.loadNoteTags(note); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.DescriptionHTML = renderMarkdown(note.Description)
+
+	respondWithJSON(w, http.StatusOK, newNoteResponse(*note))
+}
+
+// apiDeleteNoteHandler deletes a note owned by the user.
+func (a *App) apiDeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionDelete)
+	if !ok {
+		return
+	}
+
+	if err := a.deleteNoteFromDatabase(noteID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditDelete, NoteID: noteID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListSharesHandler returns the users a note is shared with.
+func (a *App) apiListSharesHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	sharedUsers, err := a.getSharedUsersForNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	shares := []shareResponse{}
+	for _, share := range sharedUsers {
+		share.NoteID = noteID
+		shares = append(shares, newShareResponse(share))
+	}
+
+	respondWithJSON(w, http.StatusOK, shares)
+}
+
+// apiCreateShareHandler shares a note with another user.
+func (a *App) apiCreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionShare)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithError(w, http.StatusBadRequest, "privileges must be editor or viewer")
+		return
+	}
+	if in.Username == currentUsername(r) {
+		respondWithError(w, http.StatusBadRequest, "a note cannot be shared with its owner")
+		return
+	}
+
+	err := a.shareNoteWithUser(noteID, in.Username, in.Privileges)
+	switch {
+	case err == sql.ErrNoRows:
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return
+	case errors.Is(err, errAlreadyShared):
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditShare, NoteID: noteID, Target: in.Username, Details: in.Privileges})
+
+	share := shareResponse{NoteID: noteID, Username: in.Username, Privileges: in.Privileges}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/notes/%d/shares/%s", noteID, in.Username))
+	respondWithJSON(w, http.StatusCreated, share)
+}
+
+// apiUpdateShareHandler changes the privileges of an existing share.
+func (a *App) apiUpdateShareHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionShare)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithError(w, http.StatusBadRequest, "privileges must be editor or viewer")
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if err := a.updateUserPrivileges(username, in.Privileges, strconv.Itoa(noteID)); err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "note is not shared with this user")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUpdatePrivileges, NoteID: noteID, Target: username, Details: in.Privileges})
+
+	respondWithJSON(w, http.StatusOK, shareResponse{NoteID: noteID, Username: username, Privileges: in.Privileges})
+}
+
+// apiDeleteShareHandler stops sharing a note with a user.
+// Users may also remove a share that was made with themselves.
+func (a *App) apiDeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	action := noteActionShare
+	if username == currentUsername(r) {
+		action = noteActionRead
+	}
+	noteID, ok := a.authorizeAPINote(w, r, action)
+	if !ok {
+		return
+	}
+
+	if err := a.removeSharedNoteFromUser(username, strconv.Itoa(noteID)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUnshare, NoteID: noteID, Target: username})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetDelegationHandler returns who a note is delegated to.
+func (a *App) apiGetDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, delegationResponse{
+		NoteID:   noteID,
+		Username: note.NoteDelegation.String,
+		Status:   note.NoteStatus.String,
+	})
+}
+
+// apiPutDelegationHandler delegates a note to a user.
+// As in the web interface, only the owner may delegate.
+func (a *App) apiPutDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionDelegate)
+	if !ok {
+		return
+	}
+
+	var in delegationInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.Status == "" {
+		in.Status = "Delegated"
+	}
+
+	if in.Username == "" {
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if !a.checkAPIDelegate(w, currentUsername(r), in.Username) {
+		return
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	note.NoteDelegation = sql.NullString{String: in.Username, Valid: true}
+	note.NoteStatus = sql.NullString{String: in.Status, Valid: true}
+	if err := a.updateNoteInDatabase(*note, currentUsername(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, delegationResponse{NoteID: noteID, Username: in.Username, Status: in.Status})
+}
+
+// apiDeleteDelegationHandler removes the delegation from a note.
+func (a *App) apiDeleteDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRemoveDelegation)
+	if !ok {
+		return
+	}
+
+	if err := a.RemoveDelegation(noteID, currentUsername(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditRemoveDelegation, NoteID: noteID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newAPITestApp returns an App with routes backed by a mock database.
+func newAPITestApp(t *testing.T) (*App, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error occurred while opening a stub database connection: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	a := &App{db: db}
+	a.initializeRoutes()
+
+	return a, mock
+}
+
+func TestAPIGetNote_Forbidden(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "stranger")
+
+	mock.ExpectQuery(noteAccessQuery).
+		WithArgs(1, "stranger").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).
+			AddRow("owner", nil, nil))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/notes/1", nil), "stranger")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected a JSON response, but got %q", contentType)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIGetNote(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "mydog7")
+
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(1, "Shopping", "Milk", "Task", nil, "2023-11-02", "In progress", nil, "mydog7", time.Now(), 0))
+	mock.ExpectPrepare("SELECT username, privileges FROM user_shares").ExpectQuery().WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "privileges"}).AddRow("BIGCAT", "viewer"))
+	mock.ExpectQuery(tagsQuery).WillReturnRows(sqlmock.NewRows([]string{"note_id", "name"}))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/notes/1", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var note map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &note); err != nil {
+		t.Fatal(err)
+	}
+	// Values are plain strings and NULL values are left out
+	if note["note_status"] != "In progress" || note["task_completion_date"] != "2023-11-02" {
+		t.Errorf("Expected plain string values, but got %v", note)
+	}
+	for _, field := range []string{"task_completion_time", "note_delegation", "fts_text"} {
+		if _, ok := note[field]; ok {
+			t.Errorf("Expected no %s, but got %v", field, note)
+		}
+	}
+	shares, _ := note["shared_users"].([]interface{})
+	if len(shares) != 1 {
+		t.Fatalf("Expected 1 share, but got %v", note["shared_users"])
+	}
+	if share, _ := shares[0].(map[string]interface{}); share["username"] != "BIGCAT" || share["privileges"] != "viewer" {
+		t.Errorf("Unexpected share %v", shares[0])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPICreateNote(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "mydog7")
+
+	noteCreatedTime := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	mock.ExpectPrepare("INSERT INTO notes").ExpectQuery().
+		WithArgs("API Note", "Note", "Created from a script", "", "", "", "", "mydog7", "Created from a script").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(7, "mydog7").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT id, title, description, noteType").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(7, "API Note", "Created from a script", "Note", nil, nil, nil, nil, "mydog7", noteCreatedTime, 0))
+	mock.ExpectQuery("SELECT nt.note_id, t.name FROM note_tags").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"note_id", "name"}))
+
+	body := `{"title": "API Note", "note_type": "Note", "description": "Created from a script"}`
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notes", strings.NewReader(body)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v (%s)", status, http.StatusCreated, rr.Body.String())
+	}
+	if location := rr.Header().Get("Location"); location != "/api/v1/notes/7" {
+		t.Errorf("Expected Location /api/v1/notes/7, but got %q", location)
+	}
+
+	var note noteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &note); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if note.ID != 7 || note.Title != "API Note" || note.Owner != "mydog7" {
+		t.Errorf("Unexpected note: got %v", note)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPICreateNote_Invalid(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"malformed JSON", `{"title": `},
+		{"unknown field", `{"title": "x", "note_type": "Note", "colour": "red"}`},
+		{"missing title", `{"note_type": "Note"}`},
+		{"title too long", `{"title": "` + strings.Repeat("a", maxNoteFieldLength+1) + `", "note_type": "Note"}`},
+		{"description too long", `{"title": "x", "note_type": "Note", "description": "` + strings.Repeat("a", maxDescriptionLength+1) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectActiveUser(mock, "mydog7")
+			req := loginRequest(httptest.NewRequest("POST", "/api/v1/notes", strings.NewReader(tt.body)), "mydog7")
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// Invalid input must never reach the notes
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPICreateShare_Conflict(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "mydog7")
+
+	mock.ExpectQuery(noteAccessQuery).
+		WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).
+			AddRow("mydog7", nil, nil))
+	mock.ExpectQuery("SELECT username").
+		WithArgs("BIGCAT", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("BIGCAT"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT note_id").
+		WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"note_id"}).AddRow(1))
+
+	body := `{"username": "BIGCAT", "privileges": "viewer"}`
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/shares", strings.NewReader(body)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUpdateShare_NotShared(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "mydog7")
+
+	// No share row is changed, so nothing is audited either
+	mock.ExpectQuery(noteAccessQuery).
+		WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).
+			AddRow("mydog7", nil, nil))
+	mock.ExpectPrepare("UPDATE user_shares SET privileges").ExpectExec().
+		WithArgs(privilegeEditor, "BIGCAT", "1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	body := `{"privileges": "editor"}`
+	req := loginRequest(httptest.NewRequest("PATCH", "/api/v1/notes/1/shares/BIGCAT", strings.NewReader(body)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIDelegation_OwnerOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	noteColumns := []string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}
+	expectAccess := func(username string, privileges interface{}) {
+		expectActiveUser(mock, username)
+		mock.ExpectQuery(noteAccessQuery).WithArgs(1, username).
+			WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("owner", "delegate", privileges))
+	}
+	expectNote := func() {
+		mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(noteColumns).AddRow(1, "Groceries", "", "Note", nil, nil, "Delegated", "delegate", "owner", time.Now(), 0))
+	}
+
+	// Editors cannot delegate the note
+	expectAccess("writer", privilegeEditor)
+	req := loginRequest(httptest.NewRequest("PUT", "/api/v1/notes/1/delegation", strings.NewReader(`{"username": "writer"}`)), "writer")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("PUT delegation by an editor: expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// and the delegate cannot hand the note on
+	expectAccess("delegate", nil)
+	expectNote()
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "delegate").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("owner", "delegate", nil))
+	req = loginRequest(httptest.NewRequest("PATCH", "/api/v1/notes/1", strings.NewReader(`{"note_delegation": "friend"}`)), "delegate")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("PATCH delegation by the delegate: expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
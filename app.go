@@ -5,11 +5,14 @@ import (
 	"context"
 
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/icza/session"
 	_ "github.com/jackc/pgx/v5/stdlib" //use pgx in database/sql mode
 )
 
@@ -17,82 +20,177 @@ import (
 
 func (a *App) Initialize() {
     // Initialize sets up the application by:
+	// - Loading the configuration, unless main already did
 	// - Creating the database connection
-	// - Checking data import status and importing demo data if needed
+	// - Applying pending schema migrations
+	// - Importing demo data if requested
+	// - Loading the password policy
 	// - Setting up authentication
 	// - Initializing the application's routes
-    db, err := setupDatabase()
+	if a.config == nil {
+		cfg, _, err := loadConfig(nil, os.LookupEnv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.config = cfg
+	}
+
+    db, err := setupDatabase(a.config.Database)
     if err != nil {
         log.Fatal(err)
     }
     a.db = db
 
-	
-	// Check data import status
-	_, err = os.Stat("./imported")
-	if os.IsNotExist(err) {
+	// Bring the schema up to date
+	if err := a.migrateUp(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// Demo data is only imported on request, and never over existing users
+	if a.config.SeedDemo {
 		log.Println("--- Importing demo data")
-		a.importData()
+		if err := a.seedDemoData(); err != nil {
+			log.Println("Demo data not imported:", err)
+		}
+	}
+
+	// The administrators listed in the configuration get the admin role
+	if err := a.promoteConfiguredAdmins(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the password rules and breached password list
+	a.passwords, err = newPasswordPolicy(a.config.Password)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Setup the mail sender used for password resets
+	a.mailer, err = newMailer(a.config.Mail)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Single sign-on, when configured. The provider is discovered on first use.
+	if a.config.OIDC.Enabled() {
+		a.oidc = &oidcClient{cfg: a.config.OIDC}
+	}
+
+	// Check passwords against LDAP, when configured
+	if a.config.LDAP.Enabled() {
+		var auth Authenticator = newLDAPAuthenticator(a.config.LDAP, a.db)
+		if a.config.LDAP.LocalFallback {
+			auth = authenticatorChain{auth, &localAuthenticator{db: a.db}}
+		}
+		a.authenticator = auth
 	}
-	
+
 	// Setup authentication (if applicable)
 	a.setupAuth()
     
 	// Initialize the application's routes
     a.initializeRoutes()
-	
-
-	// Set the default bind port
-    a.bindport = "8080" 
-
-    // Check if a different bind port was passed from the CLI via the PORT environment variable
-    tempport := os.Getenv("PORT")
-    if tempport != "" {
-        a.bindport = tempport
-    }
 }
 
-// Run starts the HTTP server on the specified address or the default if not provided.
+// Run starts the HTTP server on the specified listen address, or the configured one if not provided.
 // It handles graceful shutdown on interrupt signal.
 func (a *App) Run(addr string) {
+	listen := a.config.Server.Listen
 	if addr != "" {
-		a.bindport = addr
+		listen = addr
 	}
 
-	// Get the local IP that has Internet connectivity
-	ip := GetOutboundIP()
+	listeners, err := a.listen(listen, a.config.Server.Port)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Log the server's starting message
-	log.Printf("Starting HTTP service on http://%s:%s", ip, a.bindport)
 	// setup HTTP on gorilla mux for a gracefull shutdown
 	srv := &http.Server{
-		//Addr: "0.0.0.0:" + a.bindport,
-		Addr: ip + ":" + a.bindport,
-
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      a.Router,
 	}
 
-	// HTTP listener is in a goroutine as its blocking
-	go func() {
-		if err = srv.ListenAndServe(); err != nil {
-			log.Println(err)
+	// Serve HTTPS when a certificate is configured
+	tlsCfg := a.config.Server.TLS
+	scheme := "http"
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	if tlsCfg.Enabled() {
+		certs, err := newCertReloader(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig, err = buildTLSConfig(tlsCfg, certs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.watch(reloadCtx)
+		scheme = "https"
+	}
+
+	// Notes are purged from the trash in the background
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go a.purgeTrash(jobsCtx)
+
+	// HTTP listeners are in goroutines as they are blocking
+	for _, ln := range listeners {
+		logListener(scheme, ln)
+		go func(ln net.Listener) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}(ln)
+	}
+
+	// Plain HTTP requests are redirected to HTTPS
+	var redirectSrv *http.Server
+	if tlsCfg.RedirectListen != "" {
+		redirectListeners, err := a.listen(tlsCfg.RedirectListen, "80")
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		redirectSrv = &http.Server{
+			ReadTimeout:  time.Second * 15,
+			WriteTimeout: time.Second * 15,
+			Handler:      httpsRedirectHandler(listenerPort(listeners[0])),
+		}
+		for _, ln := range redirectListeners {
+			log.Printf("Redirecting HTTP on %s to HTTPS", ln.Addr())
+			go func(ln net.Listener) {
+				if err := redirectSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Println(err)
+				}
+			}(ln)
+		}
+	}
 
 	// setup a ctrl-c trap to ensure a graceful shutdown
 	// this would also allow shutting down other pipes/connections. eg DB
+	// SIGTERM is how systemd stops the service
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
 
 	// Log the shutdown process
 	log.Println("shutting HTTP service down")
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(ctx)
+	}
 	srv.Shutdown(ctx)
+	stopJobs()
+	session.Global.Close()
 	log.Println("closing database connections")
 	a.db.Close()
 	log.Println("shutting down")
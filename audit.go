@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditLogin                    = "login"
+	auditShare                    = "share"
+	auditUpdatePrivileges         = "update_privileges"
+	auditUnshare                  = "unshare"
+	auditShareGroup               = "share_group"
+	auditUpdateGroupPrivileges    = "update_group_privileges"
+	auditUnshareGroup             = "unshare_group"
+	auditShareNotebook            = "share_notebook"
+	auditUpdateNotebookPrivileges = "update_notebook_privileges"
+	auditUnshareNotebook          = "unshare_notebook"
+	auditRemoveDelegation         = "remove_delegation"
+	auditDelete                   = "delete"
+	auditRestore                  = "restore"
+	auditPurge                    = "purge"
+)
+
+// Limits on the number of events returned by one query.
+const (
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 100000
+)
+
+// AuditEvent is an entry of the audit log. Target is the user or group
+// affected, Details holds values such as the granted privileges.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	NoteID     int       `json:"note_id,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Details    string    `json:"details,omitempty"`
+	IPAddress  string    `json:"ip_address,omitempty"`
+}
+
+// auditFilter selects events from the audit log. Zero values match everything.
+type auditFilter struct {
+	Actor  string
+	Action string
+	NoteID int
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// nullIfEmpty stores empty strings as NULL.
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// recordAudit appends an event to the audit log. Times are stored in UTC.
+func (a *App) recordAudit(e AuditEvent) error {
+	noteID := sql.NullInt64{Int64: int64(e.NoteID), Valid: e.NoteID != 0}
+	_, err := a.db.Exec(`
+		INSERT INTO audit_events (occurred_at, actor, action, note_id, target, details, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		time.Now().UTC(), e.Actor, e.Action, noteID, nullIfEmpty(e.Target), nullIfEmpty(e.Details), nullIfEmpty(e.IPAddress))
+	return err
+}
+
+// audit records an event of a request. The actor defaults to the logged in
+// user. The action has already happened, so a failure to record it is only logged.
+func (a *App) audit(r *http.Request, e AuditEvent) {
+	if e.Actor == "" {
+		e.Actor = currentUsername(r)
+	}
+	e.IPAddress = clientIP(r)
+	if err := a.recordAudit(e); err != nil {
+		log.Printf("Audit event %s by %s not recorded: %v", e.Action, e.Actor, err)
+	}
+}
+
+// queryAudit returns the events matching the filter, newest first.
+func (a *App) queryAudit(f auditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if f.Actor != "" {
+		add("actor = $%d", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.NoteID != 0 {
+		add("note_id = $%d", f.NoteID)
+	}
+	if !f.From.IsZero() {
+		add("occurred_at >= $%d", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("occurred_at < $%d", f.To.UTC())
+	}
+
+	query := `SELECT id, occurred_at, actor, action, COALESCE(note_id, 0), COALESCE(target, ''), COALESCE(details, ''), COALESCE(ip_address, '')
+		FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY occurred_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Actor, &e.Action, &e.NoteID, &e.Target, &e.Details, &e.IPAddress); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// parseAuditTime accepts an RFC 3339 time or a date, which stands for the
+// start of that day in UTC.
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseAuditFilter reads the filter from the query parameters actor, action,
+// note, from, to and limit.
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	query := r.URL.Query()
+	f := auditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Limit:  defaultAuditLimit,
+	}
+
+	var err error
+	if value := query.Get("note"); value != "" {
+		if f.NoteID, err = strconv.Atoi(value); err != nil || f.NoteID < 1 {
+			return f, fmt.Errorf("note must be a note ID")
+		}
+	}
+	if value := query.Get("from"); value != "" {
+		if f.From, err = parseAuditTime(value); err != nil {
+			return f, fmt.Errorf("from must be an RFC 3339 time or a date")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if f.To, err = parseAuditTime(value); err != nil {
+			return f, fmt.Errorf("to must be an RFC 3339 time or a date")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if f.Limit, err = strconv.Atoi(value); err != nil || f.Limit < 1 || f.Limit > maxAuditLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxAuditLimit)
+		}
+	}
+
+	return f, nil
+}
+
+// writeAuditCSV writes events as CSV with a header row.
+func writeAuditCSV(w http.ResponseWriter, events []AuditEvent) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-events.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "occurred_at", "actor", "action", "note_id", "target", "details", "ip_address"})
+	for _, e := range events {
+		noteID := ""
+		if e.NoteID != 0 {
+			noteID = strconv.Itoa(e.NoteID)
+		}
+		out.Write([]string{
+			strconv.FormatInt(e.ID, 10), e.OccurredAt.UTC().Format(time.RFC3339), e.Actor, e.Action,
+			noteID, e.Target, e.Details, e.IPAddress,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// apiListAuditEventsHandler returns the audit events matching the query
+// parameters, as JSON or with format=csv as a CSV download.
+func (a *App) apiListAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondWithError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	events, err := a.queryAudit(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if format == "csv" {
+		if err := writeAuditCSV(w, events); err != nil {
+			log.Println("Writing audit CSV:", err)
+		}
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-events.json"`)
+	}
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectAudit expects an audit event to be recorded.
+func expectAudit(mock sqlmock.Sqlmock, actor, action string, noteID int, target, details string) {
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), actor, action, sql.NullInt64{Int64: int64(noteID), Valid: noteID != 0},
+			nullIfEmpty(target), nullIfEmpty(details), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+var auditColumns = []string{"id", "occurred_at", "actor", "action", "note_id", "target", "details", "ip_address"}
+
+func TestAPIShare_RecordsAuditEvent(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	expectActiveUser(mock, "mydog7")
+
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	mock.ExpectPrepare("UPDATE user_shares SET privileges").ExpectExec().
+		WithArgs(privilegeViewer, "BIGCAT", "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "mydog7", auditUpdatePrivileges, sql.NullInt64{Int64: 1, Valid: true},
+			nullIfEmpty("BIGCAT"), nullIfEmpty(privilegeViewer), nullIfEmpty("192.0.2.1")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req := loginRequest(httptest.NewRequest("PATCH", "/api/v1/notes/1/shares/BIGCAT", strings.NewReader(`{"privileges": "viewer"}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIListAuditEvents(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	occurredAt := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	expectAdmin := func() {
+		expectActiveUser(mock, "mydog7")
+		mock.ExpectQuery("SELECT role").WithArgs("mydog7", roleAdmin).
+			WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(true))
+	}
+
+	// Filters become conditions, and CSV is offered as a download
+	expectAdmin()
+	mock.ExpectQuery("FROM audit_events WHERE actor = \\$1 AND note_id = \\$2 AND occurred_at >= \\$3 ORDER BY occurred_at DESC, id DESC LIMIT \\$4").
+		WithArgs("BIGCAT", 7, from, defaultAuditLimit).
+		WillReturnRows(sqlmock.NewRows(auditColumns).
+			AddRow(12, occurredAt, "BIGCAT", auditShare, 7, "mydog7", "editor", "192.0.2.1").
+			AddRow(11, occurredAt, "BIGCAT", auditLogin, 0, "", "password, sso", ""))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/admin/audit?actor=BIGCAT&note=7&from=2024-03-01&format=csv", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if disposition := rr.Header().Get("Content-Disposition"); !strings.Contains(disposition, "audit-events.csv") {
+		t.Errorf("Expected a CSV download, but got %q", disposition)
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][1] != "2024-03-01T09:30:00Z" || records[1][4] != "7" || records[2][4] != "" || records[2][6] != "password, sso" {
+		t.Errorf("Unexpected CSV %q", records)
+	}
+
+	// Invalid filters are refused before querying
+	expectAdmin()
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/admin/audit?to=yesterday", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// Only administrators can read the audit log
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery("SELECT role").WithArgs("BIGCAT", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(false))
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/admin/audit", nil), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
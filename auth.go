@@ -3,10 +3,13 @@ package main
 
 import (
 	// Import statements
+	"context"
 	"database/sql"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/icza/session"
 	"golang.org/x/crypto/bcrypt"
@@ -24,6 +27,16 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
     // Grab user info
     username := r.FormValue("username")
     password := r.FormValue("password")
+    email, err := normalizeEmail(r.FormValue("email"))
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "message",
+            Value: err.Error(),
+            Path:  "/", // Set the path as needed
+        })
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
 
     // Prepare the SELECT statement to check if the user already exists
 	selectStmt, err := a.db.Prepare("SELECT username FROM users WHERE username = $1")
@@ -64,11 +77,39 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+    // Enforce the password rules
+    if err := a.passwordPolicy().check(username, password); err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "message",
+            Value: err.Error(),
+            Path:  "/", // Set the path as needed
+        })
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+
+    // Email addresses are used to reset passwords, so they must be unique
+    if email != "" {
+        if taken, err := a.emailTaken(email, username); err != nil || taken {
+            message := "This email address is already used by another account."
+            if err != nil {
+                message = "Error checking email address: " + err.Error()
+            }
+            http.SetCookie(w, &http.Cookie{
+                Name:  "message",
+                Value: message,
+                Path:  "/", // Set the path as needed
+            })
+            http.Redirect(w, r, "/login", http.StatusSeeOther)
+            return
+        }
+    }
+
     // User doesn't exist, proceed with registration
     hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     checkInternalServerError(err, w)
     // Prepare the Insert stmt to Insert the user into the database
-	InsertStmt, err := a.db.Prepare(`INSERT INTO users(username, password) VALUES($1, $2)`)
+	InsertStmt, err := a.db.Prepare(`INSERT INTO users(username, password, email) VALUES($1, $2, $3)`)
     if err != nil {
         // Registration failed, set a cookie with the error message
         http.SetCookie(w, &http.Cookie{
@@ -81,7 +122,7 @@ func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
     }
 
 	// Insert user, with username and password into db
-	_, err = InsertStmt.Exec(username, hashedPassword)
+	_, err = InsertStmt.Exec(username, hashedPassword, sql.NullString{String: email, Valid: email != ""})
 	if err != nil {
         // Registration failed, set a cookie with the error message
         http.SetCookie(w, &http.Cookie{
@@ -132,10 +173,14 @@ func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 
         // Define a data structure to hold template variables
         data := struct {
-            Message string
+            Message  string
+            SSOLabel string
         }{
             Message: message,
         }
+        if a.oidc != nil {
+            data.SSOLabel = a.oidc.cfg.ButtonLabel
+        }
 
         // Execute the template and pass the data
         err = tmpl.Execute(w, data)
@@ -150,16 +195,20 @@ func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
     username := r.FormValue("usrname")
     password := r.FormValue("psw")
 
-    // query database to get matching username
-    var user User
-    err = a.db.QueryRow("SELECT username, password FROM users WHERE username=$1", username).Scan(&user.Username, &user.Password)
+    // check the password, refusing attempts while the username or address is locked out
+    user, err := a.authenticateUser(username, password, clientIP(r))
     if err != nil {
-        if err == sql.ErrNoRows {
-            // Handle the case where no user with that username was found.
+        if err == errLoginLocked || err == sql.ErrNoRows || err == errAccountDisabled {
             // Set an error message
+            message := msgInvalidLogin
+            if err == errLoginLocked {
+                message = msgLockedOut
+            } else if err == errAccountDisabled {
+                message = msgDisabled
+            }
             http.SetCookie(w, &http.Cookie{
                 Name:  "message",
-                Value: "User not found.",
+                Value: message,
                 Path:  "/", // Set the path as needed
             })
             http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -170,25 +219,26 @@ func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // password is encrypted
-    err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+    // Users with two-factor authentication give their code on a second page
+    twoFactor, err := a.totpEnabled(user.Username)
     if err != nil {
-        // Password does not match
-        // Set an error message
-        http.SetCookie(w, &http.Cookie{
-            Name:  "message",
-            Value: "Invalid username or password.",
-            Path:  "/", // Set the path as needed
-        })
-        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        checkInternalServerError(err, w)
+        return
+    }
+    if twoFactor {
+        token, err := a.createLoginChallenge(user.Username)
+        if err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+        a.setLoginChallengeCookie(w, token)
+        http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
         return
     }
 
     // Successful login. New session with initial constant and variable attributes
-    sess := session.NewSessionOptions(&session.SessOptions{
-        CAttrs: map[string]interface{}{"username": user.Username, "userid" : user.Id},
-        Attrs:  map[string]interface{}{"count": 1},
-    })
+    sess := a.newLoginSession(r, user.Username)
+    a.audit(r, AuditEvent{Actor: user.Username, Action: auditLogin, Details: "password"})
     session.Add(sess, w)
     http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
@@ -196,45 +246,127 @@ func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the current session variables, log out the user, and redirect to login
 	s := session.Get(r)
-	username := s.CAttr("username").(string)
-	log.Printf("User %s has been logged out", username)
+	if s != nil {
+		if username, ok := sessionUsername(s); ok {
+			log.Printf("User %s has been logged out", username)
+		}
 
-	// Remove the session
-	session.Remove(s, w)
-	s = nil
+		// Remove the session
+		session.Remove(s, w)
+	}
 
-	// Redirect the user to the login page with a temporary (302) redirect
-	http.Redirect(w, r, "/login", 301)
+	// Redirect the user to the login page
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (a *App) isAuthenticated(w http.ResponseWriter, r *http.Request) {
-	// Check if the user is authenticated based on session attributes
-    // Redirect to login page if not authenticated
-	authenticated := false
+// contextKey is the type of values stored in a request context by this package.
+type contextKey string
 
-	sess := session.Get(r)
+// usernameKey holds the authenticated username in the request context.
+const usernameKey contextKey = "username"
 
-	if sess != nil {
-		u := sess.CAttr("username").(string)
-		c := sess.Attr("count").(int)
+// sessionUsername returns the username of an authenticated session.
+func sessionUsername(sess session.Session) (string, bool) {
+	username, _ := sess.CAttr("username").(string)
+	count, _ := sess.Attr("count").(int)
 
-		//just a simple authentication check for the current user
-		if c > 0 && len(u) > 0 {
-			authenticated = true
-		}
+	//just a simple authentication check for the current user
+	if count > 0 && len(username) > 0 {
+		return username, true
 	}
 
-	if !authenticated {
-		http.Redirect(w, r, "/login", 301)
-	}
+	return "", false
 }
 
+// wantsJSON reports whether the request comes from an API or AJAX client
+// rather than a browser navigating to a page.
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		r.Header.Get("X-Requested-With") == "XMLHttpRequest"
+}
+
+// requireAuth is a middleware that rejects unauthenticated requests and stores
+// the username of the session in the request context.
+// Sessions of users that were disabled, renamed or deleted are signed out.
+// Browsers are redirected to the login page, API clients get a 401 JSON error.
+func (a *App) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var username string
+		authenticated := false
+
+		if sess := session.Get(r); sess != nil {
+			username, authenticated = sessionUsername(sess)
+			if authenticated {
+				active, err := a.userActive(username)
+				if err != nil {
+					if wantsJSON(r) {
+						respondWithError(w, http.StatusInternalServerError, err.Error())
+					} else {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
+					return
+				}
+				if !active {
+					session.Remove(sess, w)
+					authenticated = false
+				}
+			}
+		}
+
+		// Authentication can be switched off for local testing
+		if !authenticated && os.Getenv("DISABLE_AUTH") == "1" {
+			username, authenticated = "[guest]", true
+		}
+
+		if !authenticated {
+			if wantsJSON(r) {
+				respondWithError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), usernameKey, username)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// userActive reports whether username exists and is not disabled.
+func (a *App) userActive(username string) (bool, error) {
+	var active bool
+	err := a.db.QueryRow("SELECT disabled_at IS NULL FROM users WHERE username = $1", username).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
 
 func (a *App) setupAuth() {
 	// Initialize the session manager with global settings
-	// For testing purposes, we want cookies to be sent over HTTP too (not just HTTPS)
+	// Without TLS, for testing purposes, we want cookies to be sent over HTTP too (not just HTTPS)
 	// refer to the auth.go for the authentication handlers using the sessions
+	// Sessions are kept in the database unless the in-memory store is configured
+	allowHTTP := a.config == nil || !a.config.Server.TLS.Enabled()
+	var store session.Store
+	if a.config != nil && a.config.Session.Store == "postgres" {
+		store = newPGSessionStore(a.db, a.config.Session.SweepInterval)
+	} else {
+		store = session.NewInMemStore()
+	}
 	session.Global.Close()
-	session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	session.Global = session.NewCookieManagerOptions(store, &session.CookieMngrOptions{AllowHTTP: allowHTTP})
+
+}
+
+// currentUsername returns the username that requireAuth stored in the request
+// context, or "[guest]" when there is none.
+func currentUsername(r *http.Request) string {
+	username, ok := r.Context().Value(usernameKey).(string)
+	if !ok {
+		return "[guest]"
+	}
 
+	return username
 }
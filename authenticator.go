@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errBadCredentials is returned by an Authenticator for an unknown username or a wrong password.
+var errBadCredentials = errors.New("invalid username or password")
+
+// Authenticator checks the username and password given on the login page.
+// It returns the username of the user, which may differ from the one typed,
+// for example in case, and the user must exist in the users table afterwards.
+type Authenticator interface {
+	Authenticate(username, password string) (string, error)
+}
+
+// localAuthenticator checks passwords against the bcrypt hashes in the users table.
+type localAuthenticator struct {
+	db *sql.DB
+}
+
+func (l *localAuthenticator) Authenticate(username, password string) (string, error) {
+	var user User
+	err := l.db.QueryRow("SELECT username, password FROM users WHERE username=$1", username).Scan(&user.Username, &user.Password)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	// Unknown users are compared against a dummy hash, so that the
+	// response takes as long as for a wrong password
+	found := err == nil
+	hash := dummyPasswordHash
+	if found {
+		hash = []byte(user.Password)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !found {
+		return "", errBadCredentials
+	}
+
+	return user.Username, nil
+}
+
+// authenticatorChain tries each authenticator in turn until one knows the
+// username and password. An authenticator that fails, such as a directory
+// that cannot be reached, does not stop the later ones from being tried, so
+// that local users can still log in during an outage. Its error is returned
+// if no other authenticator accepts the login.
+type authenticatorChain []Authenticator
+
+func (c authenticatorChain) Authenticate(username, password string) (string, error) {
+	var failure error
+	for _, auth := range c {
+		name, err := auth.Authenticate(username, password)
+		switch {
+		case err == nil:
+			return name, nil
+		case err != errBadCredentials:
+			log.Printf("Authenticating %s failed, trying the next authenticator: %v", username, err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if failure != nil {
+		return "", failure
+	}
+	return "", errBadCredentials
+}
+
+// getAuthenticator returns the configured authenticator, or the local one.
+func (a *App) getAuthenticator() Authenticator {
+	if a.authenticator != nil {
+		return a.authenticator
+	}
+	return &localAuthenticator{db: a.db}
+}
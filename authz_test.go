@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const noteAccessQuery = "SELECT n.owner, n.noteDelegation, us.privileges FROM notes n INNER JOIN users o"
+
+func TestAuthorizeNote(t *testing.T) {
+	// Every role is checked against every action on note 1, which is owned by
+	// "owner", delegated to "delegate" and shared with "reader" and "writer".
+	roles := []struct {
+		username   string
+		privileges interface{}
+		allowed    map[noteAction]bool
+	}{
+		{"owner", nil, map[noteAction]bool{
+			noteActionRead: true, noteActionUpdate: true, noteActionDelete: true, noteActionShare: true, noteActionRemoveDelegation: true, noteActionDelegate: true,
+		}},
+		{"reader", privilegeViewer, map[noteAction]bool{
+			noteActionRead: true,
+		}},
+		{"writer", privilegeEditor, map[noteAction]bool{
+			noteActionRead: true, noteActionUpdate: true,
+		}},
+		{"delegate", nil, map[noteAction]bool{
+			noteActionRead: true, noteActionUpdate: true, noteActionRemoveDelegation: true,
+		}},
+		{"stranger", nil, map[noteAction]bool{}},
+	}
+	actions := []noteAction{noteActionRead, noteActionUpdate, noteActionDelete, noteActionShare, noteActionRemoveDelegation, noteActionDelegate}
+
+	for _, role := range roles {
+		for _, action := range actions {
+			t.Run(role.username+"/"+string(action), func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+
+				a := App{db: db}
+
+				mock.ExpectQuery(noteAccessQuery).
+					WithArgs(1, role.username).
+					WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).
+						AddRow("owner", "delegate", role.privileges))
+
+				err = a.authorizeNote(context.Background(), role.username, 1, action)
+				if role.allowed[action] && err != nil {
+					t.Errorf("Expected %s to be allowed to %s, but got %v", role.username, action, err)
+				}
+				if !role.allowed[action] && err != errNoteForbidden {
+					t.Errorf("Expected %s to be forbidden to %s, but got %v", role.username, action, err)
+				}
+
+				if err := mock.ExpectationsWereMet(); err != nil {
+					t.Errorf("Unfulfilled expectations: %s", err)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthorizeNote_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := App{db: db}
+
+	mock.ExpectQuery(noteAccessQuery).
+		WithArgs(42, "owner").
+		WillReturnError(sql.ErrNoRows)
+
+	err = a.authorizeNote(context.Background(), "owner", 42, noteActionRead)
+	if err != errNoteNotFound {
+		t.Errorf("Expected errNoteNotFound, but got %v", err)
+	}
+	if status := noteAuthStatus(err); status != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestDeleteHandler_Forbidden(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := App{db: db}
+
+	// A user with write privileges is still not allowed to delete the note
+	mock.ExpectQuery(noteAccessQuery).
+		WithArgs(1, "writer").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).
+			AddRow("owner", nil, privilegeEditor))
+
+	form := url.Values{"Id": {"1"}}
+	req := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = loginRequest(req, "writer")
+
+	rr := httptest.NewRecorder()
+	a.deleteHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusForbidden)
+	}
+
+	// No DELETE statement may have been issued
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateHandler_DelegationOwnerOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// Editors can edit the note, but not hand it to someone else
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "writer").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("owner", "delegate", privilegeEditor))
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(1, "Groceries", "", "Note", nil, nil, "Delegated", "delegate", "owner", time.Now(), 0))
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "writer").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("owner", "delegate", privilegeEditor))
+
+	form := url.Values{"Id": {"1"}, "Title": {"Groceries"}, "NoteType": {"Note"}, "NoteDelegation": {"writer"}}
+	req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = loginRequest(req, "writer")
+	rr := httptest.NewRecorder()
+	a.updateHandler(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// No UPDATE statement may have been issued
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
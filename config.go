@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the runtime configuration of the application.
+//
+// Values are resolved with the following precedence, highest first:
+// command-line flags, environment variables, the YAML config file, defaults.
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	Session  SessionConfig  `yaml:"session"`
+	Login    LoginConfig    `yaml:"login"`
+	Password PasswordConfig `yaml:"password"`
+	Mail     MailConfig     `yaml:"mail"`
+	OIDC     OIDCConfig     `yaml:"oidc"`
+	LDAP     LDAPConfig     `yaml:"ldap"`
+	Trash    TrashConfig    `yaml:"trash"`
+
+	// Admins are the usernames allowed to use the administration endpoints.
+	Admins []string `yaml:"admins"`
+
+	// SeedDemo imports the demo users and notes into an empty database on startup.
+	SeedDemo bool `yaml:"seed_demo"`
+}
+
+// ServerConfig configures the HTTP server.
+// Listen is a host:port, a bare host, a Unix socket (unix:/path or an
+// absolute path) or "systemd" for socket activation. When empty the server
+// listens on Port on all interfaces, or on the sockets passed by systemd.
+type ServerConfig struct {
+	Port   string    `yaml:"port"`
+	Listen string    `yaml:"listen"`
+	TLS    TLSConfig `yaml:"tls"`
+
+	// PublicURL is the address users reach the server on, used for links in emails.
+	PublicURL string `yaml:"public_url"`
+}
+
+// TLSConfig enables HTTPS when a certificate and key are set.
+// The certificate is reloaded on SIGHUP and when the files change.
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+
+	// ClientCAFile and ClientAuth enable client certificates (mTLS).
+	// ClientAuth is "none", "request" (verified when given) or "require".
+	ClientCAFile string `yaml:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth"`
+
+	// RedirectListen is an extra plain HTTP listen address that redirects to HTTPS.
+	RedirectListen string `yaml:"redirect_listen"`
+}
+
+// Enabled reports whether the server is configured to serve HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// SessionConfig configures login sessions. The "postgres" store keeps them in
+// the database, so they survive restarts and are shared between instances;
+// "memory" keeps them in the process.
+type SessionConfig struct {
+	Store         string        `yaml:"store"`
+	Timeout       time.Duration `yaml:"timeout"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+// LoginConfig configures the protection against password guessing. After
+// MaxFailures failed logins for a username, or MaxIPFailures from one client
+// address, further attempts are refused for LockoutBase, doubling with every
+// further failure up to LockoutMax. Failures older than FailureWindow are forgotten.
+type LoginConfig struct {
+	MaxFailures   int           `yaml:"max_failures"`
+	MaxIPFailures int           `yaml:"max_ip_failures"`
+	LockoutBase   time.Duration `yaml:"lockout_base"`
+	LockoutMax    time.Duration `yaml:"lockout_max"`
+	FailureWindow time.Duration `yaml:"failure_window"`
+}
+
+// PasswordConfig sets the rules for new passwords. BreachedListFile names a
+// local file of known breached passwords, one per line, either in plain text
+// or as SHA-1 hashes in the "HASH" or "HASH:count" format of breach corpora.
+type PasswordConfig struct {
+	MinLength        int    `yaml:"min_length"`
+	MaxLength        int    `yaml:"max_length"`
+	BreachedListFile string `yaml:"breached_list_file"`
+}
+
+// MailConfig configures how emails such as password reset links are sent.
+// The "smtp" driver sends them through an SMTP server, "file" writes each
+// message to a file in Dir and "log" writes them to the log.
+type MailConfig struct {
+	Driver       string `yaml:"driver"`
+	From         string `yaml:"from"`
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     int    `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	Dir          string `yaml:"dir"`
+
+	// ResetTokenTTL is how long a password reset link can be used.
+	ResetTokenTTL time.Duration `yaml:"reset_token_ttl"`
+}
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider,
+// which is turned on by setting Issuer. RedirectURL defaults to the public
+// URL followed by /login/oidc/callback. New users get the username from
+// UsernameClaim when AutoCreate is set, and with LinkByEmail a verified email
+// address signs in to the existing user with that address and no password.
+type OIDCConfig struct {
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	RedirectURL   string   `yaml:"redirect_url"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+	AutoCreate    bool     `yaml:"auto_create"`
+	LinkByEmail   bool     `yaml:"link_by_email"`
+
+	// ButtonLabel is shown on the login page.
+	ButtonLabel string `yaml:"button_label"`
+}
+
+// Enabled reports whether single sign-on is configured.
+func (o OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// LDAPConfig configures checking passwords against an LDAP directory such
+// as Active Directory, which is turned on by setting URL. The user entry is
+// found below BaseDN with UserFilter, where {username} is replaced by the
+// escaped username, searching as BindDN or anonymously. When GroupFilter is
+// set, it must find an entry below GroupBaseDN, with {dn} replaced by the
+// escaped DN of the user. LocalFallback also accepts passwords of users
+// stored in the database, such as a bootstrap administrator.
+type LDAPConfig struct {
+	URL               string        `yaml:"url"`
+	StartTLS          bool          `yaml:"start_tls"`
+	BindDN            string        `yaml:"bind_dn"`
+	BindPassword      string        `yaml:"bind_password"`
+	BaseDN            string        `yaml:"base_dn"`
+	UserFilter        string        `yaml:"user_filter"`
+	UsernameAttribute string        `yaml:"username_attribute"`
+	EmailAttribute    string        `yaml:"email_attribute"`
+	GroupBaseDN       string        `yaml:"group_base_dn"`
+	GroupFilter       string        `yaml:"group_filter"`
+	LocalFallback     bool          `yaml:"local_fallback"`
+	Timeout           time.Duration `yaml:"timeout"`
+}
+
+// Enabled reports whether passwords are checked against LDAP.
+func (l LDAPConfig) Enabled() bool {
+	return l.URL != ""
+}
+
+// TrashConfig configures the trash. Deleted notes are purged for good once
+// they have been in the trash for Retention, checked every PurgeInterval.
+type TrashConfig struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// DatabaseConfig configures the PostgreSQL connection.
+// When URL is set it is used as is and the individual fields are ignored.
+type DatabaseConfig struct {
+	URL      string `yaml:"url"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// redacted is shown in place of secrets in logs.
+const redacted = "*****"
+
+// defaultConfig returns the configuration used when nothing else is set.
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: "8080",
+			TLS: TLSConfig{
+				MinVersion: "1.2",
+				ClientAuth: "none",
+			},
+		},
+		Database: DatabaseConfig{
+			Host:    "localhost", //127.0.0.1
+			Port:    5432,
+			User:    "postgres",
+			Name:    "postgres",
+			SSLMode: "disable",
+		},
+		Session: SessionConfig{
+			Store:         "postgres",
+			Timeout:       30 * time.Minute,
+			SweepInterval: 10 * time.Minute,
+		},
+		Login: LoginConfig{
+			MaxFailures:   5,
+			MaxIPFailures: 20,
+			LockoutBase:   time.Minute,
+			LockoutMax:    time.Hour,
+			FailureWindow: time.Hour,
+		},
+		Password: PasswordConfig{
+			MinLength: 8,
+			MaxLength: 72,
+		},
+		Mail: MailConfig{
+			Driver:        "log",
+			From:          "notes@localhost",
+			SMTPPort:      587,
+			ResetTokenTTL: time.Hour,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			AutoCreate:    true,
+			ButtonLabel:   "Sign in with SSO",
+		},
+		LDAP: LDAPConfig{
+			UserFilter:        "(&(objectClass=person)(uid={username}))",
+			UsernameAttribute: "uid",
+			EmailAttribute:    "mail",
+			Timeout:           10 * time.Second,
+		},
+		Trash: TrashConfig{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+	}
+}
+
+// loadConfig builds the configuration from the config file, environment and
+// command-line arguments. It returns the arguments left after the flags,
+// which name the subcommand to run.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("notes", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a YAML config file (env NOTES_CONFIG)")
+	port := fs.String("port", "", "HTTP port to listen on (env NOTES_PORT or PORT)")
+	listen := fs.String("listen", "", "listen address: host:port, unix:/path or systemd (env NOTES_LISTEN)")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, enables HTTPS (env NOTES_TLS_CERT)")
+	tlsKey := fs.String("tls-key", "", "TLS private key file (env NOTES_TLS_KEY)")
+	tlsRedirect := fs.String("tls-redirect-listen", "", "plain HTTP address redirecting to HTTPS (env NOTES_TLS_REDIRECT_LISTEN)")
+	databaseURL := fs.String("database-url", "", "PostgreSQL connection URL (env DATABASE_URL)")
+	dbHost := fs.String("db-host", "", "database host (env NOTES_DB_HOST)")
+	dbPort := fs.Int("db-port", 0, "database port (env NOTES_DB_PORT)")
+	dbUser := fs.String("db-user", "", "database user (env NOTES_DB_USER)")
+	dbName := fs.String("db-name", "", "database name (env NOTES_DB_NAME)")
+	dbSSLMode := fs.String("db-sslmode", "", "database sslmode (env NOTES_DB_SSLMODE)")
+	seedDemo := fs.Bool("seed-demo", false, "import demo data into an empty database (env NOTES_SEED_DEMO)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// The config file may come from a flag or the environment
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("NOTES_CONFIG")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, nil, err
+	}
+
+	// Only flags given on the command line override the other sources.
+	// There is deliberately no password flag, as arguments are visible to other users.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "listen":
+			cfg.Server.Listen = *listen
+		case "tls-cert":
+			cfg.Server.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.Server.TLS.KeyFile = *tlsKey
+		case "tls-redirect-listen":
+			cfg.Server.TLS.RedirectListen = *tlsRedirect
+		case "database-url":
+			cfg.Database.URL = *databaseURL
+		case "db-host":
+			cfg.Database.Host = *dbHost
+		case "db-port":
+			cfg.Database.Port = *dbPort
+		case "db-user":
+			cfg.Database.User = *dbUser
+		case "db-name":
+			cfg.Database.Name = *dbName
+		case "db-sslmode":
+			cfg.Database.SSLMode = *dbSSLMode
+		case "seed-demo":
+			cfg.SeedDemo = *seedDemo
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile merges the YAML file at path into the configuration.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides the configuration with NOTES_* variables, DATABASE_URL and PORT.
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	setString := func(dst *string, names ...string) {
+		for _, name := range names {
+			if v, ok := lookupEnv(name); ok && v != "" {
+				*dst = v
+				return
+			}
+		}
+	}
+
+	setString(&c.Server.Port, "NOTES_PORT", "PORT")
+	setString(&c.Server.Listen, "NOTES_LISTEN")
+	setString(&c.Server.TLS.CertFile, "NOTES_TLS_CERT")
+	setString(&c.Server.TLS.KeyFile, "NOTES_TLS_KEY")
+	setString(&c.Server.TLS.MinVersion, "NOTES_TLS_MIN_VERSION")
+	setString(&c.Server.TLS.ClientCAFile, "NOTES_TLS_CLIENT_CA")
+	setString(&c.Server.TLS.ClientAuth, "NOTES_TLS_CLIENT_AUTH")
+	setString(&c.Server.TLS.RedirectListen, "NOTES_TLS_REDIRECT_LISTEN")
+	setString(&c.Database.URL, "DATABASE_URL")
+	setString(&c.Database.Host, "NOTES_DB_HOST")
+	setString(&c.Database.User, "NOTES_DB_USER")
+	setString(&c.Database.Password, "NOTES_DB_PASSWORD")
+	setString(&c.Database.Name, "NOTES_DB_NAME")
+	setString(&c.Database.SSLMode, "NOTES_DB_SSLMODE")
+
+	setString(&c.Session.Store, "NOTES_SESSION_STORE")
+	setString(&c.Password.BreachedListFile, "NOTES_PASSWORD_BREACHED_LIST")
+	setString(&c.Server.PublicURL, "NOTES_PUBLIC_URL")
+	setString(&c.Mail.Driver, "NOTES_MAIL_DRIVER")
+	setString(&c.Mail.From, "NOTES_MAIL_FROM")
+	setString(&c.Mail.Dir, "NOTES_MAIL_DIR")
+	setString(&c.Mail.SMTPHost, "NOTES_SMTP_HOST")
+	setString(&c.Mail.SMTPUsername, "NOTES_SMTP_USERNAME")
+	setString(&c.Mail.SMTPPassword, "NOTES_SMTP_PASSWORD")
+	setString(&c.OIDC.Issuer, "NOTES_OIDC_ISSUER")
+	setString(&c.OIDC.ClientID, "NOTES_OIDC_CLIENT_ID")
+	setString(&c.OIDC.ClientSecret, "NOTES_OIDC_CLIENT_SECRET")
+	setString(&c.OIDC.RedirectURL, "NOTES_OIDC_REDIRECT_URL")
+	setString(&c.OIDC.UsernameClaim, "NOTES_OIDC_USERNAME_CLAIM")
+	setString(&c.OIDC.ButtonLabel, "NOTES_OIDC_BUTTON_LABEL")
+	setString(&c.LDAP.URL, "NOTES_LDAP_URL")
+	setString(&c.LDAP.BindDN, "NOTES_LDAP_BIND_DN")
+	setString(&c.LDAP.BindPassword, "NOTES_LDAP_BIND_PASSWORD")
+	setString(&c.LDAP.BaseDN, "NOTES_LDAP_BASE_DN")
+	setString(&c.LDAP.UserFilter, "NOTES_LDAP_USER_FILTER")
+	setString(&c.LDAP.UsernameAttribute, "NOTES_LDAP_USERNAME_ATTRIBUTE")
+	setString(&c.LDAP.EmailAttribute, "NOTES_LDAP_EMAIL_ATTRIBUTE")
+	setString(&c.LDAP.GroupBaseDN, "NOTES_LDAP_GROUP_BASE_DN")
+	setString(&c.LDAP.GroupFilter, "NOTES_LDAP_GROUP_FILTER")
+	for name, dst := range map[string]*time.Duration{
+		"NOTES_SESSION_TIMEOUT":        &c.Session.Timeout,
+		"NOTES_SESSION_SWEEP_INTERVAL": &c.Session.SweepInterval,
+		"NOTES_LOGIN_LOCKOUT_BASE":     &c.Login.LockoutBase,
+		"NOTES_LOGIN_LOCKOUT_MAX":      &c.Login.LockoutMax,
+		"NOTES_LOGIN_FAILURE_WINDOW":   &c.Login.FailureWindow,
+		"NOTES_RESET_TOKEN_TTL":        &c.Mail.ResetTokenTTL,
+		"NOTES_LDAP_TIMEOUT":           &c.LDAP.Timeout,
+		"NOTES_TRASH_RETENTION":        &c.Trash.Retention,
+		"NOTES_TRASH_PURGE_INTERVAL":   &c.Trash.PurgeInterval,
+	} {
+		if v, ok := lookupEnv(name); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*dst = d
+		}
+	}
+
+	for name, dst := range map[string]*int{
+		"NOTES_DB_PORT":               &c.Database.Port,
+		"NOTES_LOGIN_MAX_FAILURES":    &c.Login.MaxFailures,
+		"NOTES_LOGIN_MAX_IP_FAILURES": &c.Login.MaxIPFailures,
+		"NOTES_PASSWORD_MIN_LENGTH":   &c.Password.MinLength,
+		"NOTES_SMTP_PORT":             &c.Mail.SMTPPort,
+	} {
+		if v, ok := lookupEnv(name); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*dst = n
+		}
+	}
+
+	if v, ok := lookupEnv("NOTES_ADMINS"); ok && v != "" {
+		c.Admins = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Admins = append(c.Admins, name)
+			}
+		}
+	}
+
+	if v, ok := lookupEnv("NOTES_OIDC_SCOPES"); ok && v != "" {
+		c.OIDC.Scopes = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	}
+
+	for name, dst := range map[string]*bool{
+		"NOTES_SEED_DEMO":           &c.SeedDemo,
+		"NOTES_OIDC_AUTO_CREATE":    &c.OIDC.AutoCreate,
+		"NOTES_OIDC_LINK_BY_EMAIL":  &c.OIDC.LinkByEmail,
+		"NOTES_LDAP_START_TLS":      &c.LDAP.StartTLS,
+		"NOTES_LDAP_LOCAL_FALLBACK": &c.LDAP.LocalFallback,
+	} {
+		if v, ok := lookupEnv(name); ok && v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*dst = b
+		}
+	}
+
+	return nil
+}
+
+// validate checks the configuration for values the application cannot start with.
+func (c *Config) validate() error {
+	var problems []string
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("server port %q must be a number between 1 and 65535", c.Server.Port))
+	} else if _, err := parseListenAddr(c.Server.Listen, c.Server.Port); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	problems = append(problems, c.Server.TLS.validate()...)
+
+	switch c.Session.Store {
+	case "postgres", "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("session store %q must be postgres or memory", c.Session.Store))
+	}
+	if c.Session.Timeout < time.Minute {
+		problems = append(problems, "session timeout must be at least 1m")
+	}
+	if c.Session.SweepInterval <= 0 {
+		problems = append(problems, "session sweep_interval must be positive")
+	}
+
+	if c.Login.MaxFailures < 1 || c.Login.MaxIPFailures < 1 {
+		problems = append(problems, "login max_failures and max_ip_failures must be at least 1")
+	}
+	if c.Login.LockoutBase <= 0 || c.Login.LockoutMax < c.Login.LockoutBase {
+		problems = append(problems, "login lockout_base must be positive and not above lockout_max")
+	}
+	if c.Login.FailureWindow <= 0 {
+		problems = append(problems, "login failure_window must be positive")
+	}
+
+	if c.Server.PublicURL != "" {
+		u, err := url.Parse(c.Server.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "server public_url must be an absolute http or https URL")
+		}
+	}
+
+	switch c.Mail.Driver {
+	case "log":
+	case "file":
+		if c.Mail.Dir == "" {
+			problems = append(problems, "mail driver file needs a dir")
+		}
+	case "smtp":
+		if c.Mail.SMTPHost == "" || c.Mail.SMTPPort < 1 || c.Mail.SMTPPort > 65535 {
+			problems = append(problems, "mail driver smtp needs an smtp_host and a valid smtp_port")
+		}
+		if c.Server.PublicURL == "" {
+			problems = append(problems, "mail driver smtp needs the server public_url for the links in emails")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mail driver %q must be smtp, file or log", c.Mail.Driver))
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		problems = append(problems, fmt.Sprintf("mail from %q is not a valid address", c.Mail.From))
+	}
+	if c.Mail.ResetTokenTTL < time.Minute {
+		problems = append(problems, "mail reset_token_ttl must be at least 1m")
+	}
+
+	if c.OIDC.Enabled() {
+		if u, err := url.Parse(c.OIDC.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "oidc issuer must be an absolute http or https URL")
+		}
+		if c.OIDC.ClientID == "" {
+			problems = append(problems, "oidc needs a client_id")
+		}
+		if c.OIDC.RedirectURL == "" && c.Server.PublicURL == "" {
+			problems = append(problems, "oidc needs a redirect_url or the server public_url")
+		}
+		if c.OIDC.UsernameClaim == "" {
+			problems = append(problems, "oidc username_claim must not be empty")
+		}
+	}
+
+	if c.LDAP.Enabled() {
+		if u, err := url.Parse(c.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			problems = append(problems, "ldap url must be an ldap:// or ldaps:// URL")
+		} else if u.Scheme == "ldaps" && c.LDAP.StartTLS {
+			problems = append(problems, "ldap start_tls cannot be used with an ldaps:// URL")
+		}
+		if c.LDAP.BaseDN == "" {
+			problems = append(problems, "ldap needs a base_dn")
+		}
+		if !strings.Contains(c.LDAP.UserFilter, "{username}") {
+			problems = append(problems, "ldap user_filter must contain {username}")
+		}
+		if c.LDAP.UsernameAttribute == "" {
+			problems = append(problems, "ldap username_attribute must not be empty")
+		}
+		if c.LDAP.GroupFilter != "" && c.LDAP.GroupBaseDN == "" {
+			problems = append(problems, "ldap group_filter needs a group_base_dn")
+		}
+		if c.LDAP.Timeout <= 0 {
+			problems = append(problems, "ldap timeout must be positive")
+		}
+	}
+
+	if c.Trash.Retention <= 0 || c.Trash.PurgeInterval <= 0 {
+		problems = append(problems, "trash retention and purge_interval must be positive")
+	}
+
+	// bcrypt only uses the first 72 bytes of a password
+	if c.Password.MinLength < 1 || c.Password.MaxLength < c.Password.MinLength || c.Password.MaxLength > 72 {
+		problems = append(problems, "password min_length must be at least 1 and max_length between min_length and 72")
+	}
+
+	if c.Database.URL != "" {
+		u, err := url.Parse(c.Database.URL)
+		if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			problems = append(problems, "database url must be a postgres:// or postgresql:// URL")
+		}
+	} else {
+		if c.Database.Host == "" {
+			problems = append(problems, "database host is required")
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("database port %d must be between 1 and 65535", c.Database.Port))
+		}
+		if c.Database.User == "" {
+			problems = append(problems, "database user is required")
+		}
+		if c.Database.Name == "" {
+			problems = append(problems, "database name is required")
+		}
+		switch c.Database.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			problems = append(problems, fmt.Sprintf("database sslmode %q is not supported", c.Database.SSLMode))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// validate returns the problems with the TLS settings.
+func (t TLSConfig) validate() []string {
+	var problems []string
+
+	if t.Enabled() && (t.CertFile == "" || t.KeyFile == "") {
+		problems = append(problems, "tls needs both a certificate and a key file")
+	}
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		problems = append(problems, fmt.Sprintf("tls min_version %q must be 1.2 or 1.3", t.MinVersion))
+	}
+
+	switch t.ClientAuth {
+	case "", "none":
+	case "request", "require":
+		if t.ClientCAFile == "" {
+			problems = append(problems, "tls client_auth needs a client_ca_file")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tls client_auth %q must be none, request or require", t.ClientAuth))
+	}
+
+	if t.RedirectListen != "" {
+		if !t.Enabled() {
+			problems = append(problems, "tls redirect_listen needs a certificate and key")
+		}
+		if _, err := parseListenAddr(t.RedirectListen, "80"); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
+
+// DSN returns the connection string passed to the PostgreSQL driver.
+func (d DatabaseConfig) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteDSNValue(d.Host), d.Port, quoteDSNValue(d.User), quoteDSNValue(d.Password), quoteDSNValue(d.Name), d.SSLMode)
+}
+
+// dsnPassword matches the password in a keyword/value connection string.
+var dsnPassword = regexp.MustCompile(`password=('(\\.|[^'])*'|\S*)`)
+
+// RedactedDSN returns the connection string with the password hidden, for logging.
+func (d DatabaseConfig) RedactedDSN() string {
+	if d.URL != "" {
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return redacted
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+
+	return dsnPassword.ReplaceAllString(d.DSN(), "password="+redacted)
+}
+
+// quoteDSNValue quotes a keyword/value connection string value when needed.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
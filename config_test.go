@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envMap returns a lookup function over a fixed set of environment variables.
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+// writeConfigFile writes a config file into a temporary directory.
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "notes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	cfg, args, err := loadConfig(nil, envMap(nil))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if cfg.Server.Port != "8080" || cfg.Database.Host != "localhost" || cfg.Database.Port != 5432 {
+		t.Errorf("Unexpected defaults: %+v", cfg)
+	}
+	if len(args) != 0 {
+		t.Errorf("Expected no remaining arguments, but got %v", args)
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: "7000"
+database:
+  host: file-host
+  user: file-user
+  name: file-db
+  password: file-secret
+session:
+  timeout: 45m
+`)
+
+	env := envMap(map[string]string{
+		"NOTES_CONFIG":  path,
+		"NOTES_DB_HOST": "env-host",
+		"NOTES_DB_USER": "env-user",
+		"PORT":          "7100",
+	})
+
+	cfg, args, err := loadConfig([]string{"-db-host", "flag-host", "migrate", "status"}, env)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"flag beats env and file", cfg.Database.Host, "flag-host"},
+		{"env beats file", cfg.Database.User, "env-user"},
+		{"legacy PORT beats file", cfg.Server.Port, "7100"},
+		{"file beats default", cfg.Database.Name, "file-db"},
+		{"file password", cfg.Database.Password, "file-secret"},
+		{"default kept", cfg.Database.Port, 5432},
+		{"file duration", cfg.Session.Timeout, 45 * time.Minute},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if strings.Join(args, " ") != "migrate status" {
+		t.Errorf("Expected the subcommand to remain, but got %v", args)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+	}{
+		{name: "port not a number", env: map[string]string{"PORT": "http"}},
+		{name: "port out of range", args: []string{"-port", "70000"}},
+		{name: "unsupported sslmode", args: []string{"-db-sslmode", "sometimes"}},
+		{name: "bad database url", env: map[string]string{"DATABASE_URL": "mysql://localhost/notes"}},
+		{name: "bad db port env", env: map[string]string{"NOTES_DB_PORT": "five"}},
+		{name: "unknown file key", file: "server:\n  prot: \"8080\"\n"},
+		{name: "smtp without host", env: map[string]string{"NOTES_MAIL_DRIVER": "smtp"}},
+		{name: "smtp without public url", env: map[string]string{"NOTES_MAIL_DRIVER": "smtp", "NOTES_SMTP_HOST": "mail.example.com"}},
+		{name: "relative public url", env: map[string]string{"NOTES_PUBLIC_URL": "notes.example.com"}},
+		{name: "oidc without client id", env: map[string]string{"NOTES_OIDC_ISSUER": "https://idp.example.com", "NOTES_PUBLIC_URL": "https://notes.example.com"}},
+		{name: "bad oidc bool", env: map[string]string{"NOTES_OIDC_AUTO_CREATE": "maybe"}},
+		{name: "ldap without base dn", env: map[string]string{"NOTES_LDAP_URL": "ldap://directory.example.com"}},
+		{name: "negative trash retention", env: map[string]string{"NOTES_TRASH_RETENTION": "-1h"}},
+		{name: "ldap filter without username", env: map[string]string{"NOTES_LDAP_URL": "ldaps://directory.example.com", "NOTES_LDAP_BASE_DN": "dc=example", "NOTES_LDAP_USER_FILTER": "(uid=admin)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			if tt.file != "" {
+				env = map[string]string{"NOTES_CONFIG": writeConfigFile(t, tt.file)}
+			}
+
+			if _, _, err := loadConfig(tt.args, envMap(env)); err == nil {
+				t.Errorf("Expected an error, but got none")
+			}
+		})
+	}
+}
+
+func TestRedactedDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		db   DatabaseConfig
+		want string
+	}{
+		{
+			name: "keyword values",
+			db:   DatabaseConfig{Host: "localhost", Port: 5432, User: "postgres", Password: "s3cret", Name: "notes", SSLMode: "disable"},
+			want: "host=localhost port=5432 user=postgres password=***** dbname=notes sslmode=disable",
+		},
+		{
+			name: "quoted password",
+			db:   DatabaseConfig{Host: "localhost", Port: 5432, User: "postgres", Password: "it's secret", Name: "notes", SSLMode: "disable"},
+			want: "host=localhost port=5432 user=postgres password=***** dbname=notes sslmode=disable",
+		},
+		{
+			name: "url",
+			db:   DatabaseConfig{URL: "postgres://notes:s3cret@db:5432/notes?sslmode=require"},
+			want: "postgres://notes:%2A%2A%2A%2A%2A@db:5432/notes?sslmode=require",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.db.RedactedDSN()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, "secret") || strings.Contains(got, "s3cret") {
+				t.Errorf("Password leaked in %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/icza/session"
+)
+
+// CSRF tokens follow the synchronizer token pattern: every session holds a
+// random token, which pages embed in their forms and scripts send in a header.
+const (
+	csrfTokenAttr  = "csrfToken"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// generateCSRFToken returns a new random token.
+func generateCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sessionCSRFToken returns the CSRF token of a session, creating one for
+// sessions that started without it.
+func sessionCSRFToken(sess session.Session) string {
+	if token, ok := sess.Attr(csrfTokenAttr).(string); ok && token != "" {
+		return token
+	}
+
+	token := generateCSRFToken()
+	sess.SetAttr(csrfTokenAttr, token)
+	return token
+}
+
+// csrfToken returns the CSRF token to embed in the page for this request,
+// or "" when the request has no session.
+func csrfToken(r *http.Request) string {
+	sess := session.Get(r)
+	if sess == nil {
+		return ""
+	}
+	return sessionCSRFToken(sess)
+}
+
+// csrfProtect is a middleware that rejects state-changing requests without
+// the CSRF token of the session, from either the form field or the header.
+// Requests without a session carry no credentials and are let through.
+func (a *App) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess := session.Get(r)
+		if sess == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented := r.Header.Get(csrfHeaderName)
+		if presented == "" {
+			presented = r.PostFormValue(csrfFieldName)
+		}
+
+		expected := sessionCSRFToken(sess)
+		if presented == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) != 1 {
+			if wantsJSON(r) {
+				respondWithError(w, http.StatusForbidden, "invalid or missing CSRF token")
+				return
+			}
+			http.Error(w, "Forbidden: invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
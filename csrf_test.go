@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/icza/session"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	a := App{}
+	handler := a.csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	formBody := func(token string) string {
+		return url.Values{"Id": {"1"}, csrfFieldName: {token}}.Encode()
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header string
+		ajax   bool
+		want   int
+	}{
+		{name: "GET needs no token", method: "GET", want: http.StatusNoContent},
+		{name: "form token", method: "POST", body: formBody(testCSRFToken), want: http.StatusNoContent},
+		{name: "header token", method: "POST", header: testCSRFToken, want: http.StatusNoContent},
+		{name: "missing token", method: "POST", body: formBody(""), want: http.StatusForbidden},
+		{name: "wrong token", method: "POST", body: formBody("forged"), want: http.StatusForbidden},
+		{name: "wrong header token", method: "DELETE", header: "forged", ajax: true, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := loginRequest(httptest.NewRequest(tt.method, "/delete", strings.NewReader(tt.body)), "mydog7")
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Del(csrfHeaderName)
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.ajax {
+				req.Header.Set("X-Requested-With", "XMLHttpRequest")
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("Expected status %d, but got %d", tt.want, rr.Code)
+			}
+			if tt.ajax && rr.Code == http.StatusForbidden && !strings.Contains(rr.Body.String(), "CSRF") {
+				t.Errorf("Expected a JSON CSRF error, but got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestCSRFToken_CreatedForOldSessions(t *testing.T) {
+	// A session created without a token gets one, which is then kept
+	sess := session.NewSessionOptions(&session.SessOptions{
+		CAttrs: map[string]interface{}{"username": "mydog7"},
+		Attrs:  map[string]interface{}{"count": 1},
+	})
+
+	token := sessionCSRFToken(sess)
+	if token == "" || sessionCSRFToken(sess) != token {
+		t.Errorf("Expected a stable token, but got %q", token)
+	}
+}
+
+func TestMutatingRoutes_RejectCrossSiteRequests(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	routes := []string{"/create", "/update", "/delete", "/share", "/update-privileges", "/remove-shared-note", "/remove-delegation/1"}
+	for _, route := range routes {
+		// A cross-site form carries the session cookie, but not the token
+		expectActiveUser(mock, "mydog7")
+		req := loginRequest(httptest.NewRequest("POST", route, strings.NewReader("Id=1")), "mydog7")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Del(csrfHeaderName)
+
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("POST %s: expected status %d, but got %d", route, http.StatusForbidden, rr.Code)
+		}
+	}
+
+	// Mutating routes no longer accept GET
+	for _, route := range []string{"/create", "/update", "/delete", "/share"} {
+		req := loginRequest(httptest.NewRequest("GET", route, nil), "mydog7")
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: expected status %d, but got %d", route, http.StatusMethodNotAllowed, rr.Code)
+		}
+	}
+}
+
+func TestAPICSRF_SessionOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// API clients using the session cookie need the header token
+	expectActiveUser(mock, "mydog7")
+	req := loginRequest(httptest.NewRequest("DELETE", "/api/v1/notes/1", nil), "mydog7")
+	req.Header.Del(csrfHeaderName)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -19,7 +20,7 @@ func (a *App) retrieveNotes(username string) ([]Note, error) {
 		LEFT JOIN
 			users u ON us.username = u.username
 		WHERE
-			n.owner = $1
+			n.owner = $1 AND n.deleted_at IS NULL
 	`
 
 	stmt, err := a.db.Prepare(query)
@@ -75,7 +76,7 @@ func (a *App) retrieveDelegatedNotes(username string) ([]Note, error) {
         FROM
             notes n
         WHERE
-            n.noteDelegation = $1
+            n.noteDelegation = $1 AND n.deleted_at IS NULL
     `
 
     stmt, err := a.db.Prepare(query)
@@ -117,13 +118,15 @@ func (a *App) retrieveDelegatedNotes(username string) ([]Note, error) {
 }
 
 // retrieveSharedNotesWithPrivileges fetches shared notes for a given username with privileges.
+// Notes shared with a group the user belongs to are included with the strongest privileges.
 func (a *App) retrieveSharedNotesWithPrivileges(username string) ([]Note, error) {
 	// Prepare the SQL statement for fetching shared notes with privileges
 	query := `
-		SELECT n.*, us.privileges
+		SELECT n.id, n.title, n.noteType, n.description, n.noteCreated, n.taskCompletionTime, n.taskCompletionDate,
+			n.noteStatus, n.noteDelegation, n.owner, n.fts_text, us.privileges
 		FROM notes n
-		INNER JOIN user_shares us ON n.id = us.note_id
-		WHERE us.username = $1
+		INNER JOIN effective_shares us ON n.id = us.note_id
+		WHERE us.username = $1 AND n.owner != $1 AND n.deleted_at IS NULL
 	`
 
 	stmt, err := a.db.Prepare(query)
@@ -165,10 +168,10 @@ func (a *App) retrieveSharedNotesWithPrivileges(username string) ([]Note, error)
 	return sharedNotes, nil
 }
 
-// getAllUsers fetches all users except the owner.
+// getAllUsers fetches all users of the owner's organization except the owner.
 func (a *App) getAllUsers(ownerUsername string) ([]User, error) {
 	// Prepare the SQL statement for fetching all users except the owner
-	query := "SELECT username FROM users WHERE username != $1"
+	query := "SELECT username FROM users WHERE username != $1 AND org_id = (SELECT org_id FROM users WHERE username = $1)"
 
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
@@ -245,8 +248,9 @@ func (a *App) getSharedUsersForNote(noteID int) ([]UserShare, error) {
     return sharedUsers, nil
 }
 
-// updateNoteInDatabase updates note fields in the database.
-func (a *App) updateNoteInDatabase(note Note) error {
+// updateNoteInDatabase updates note fields in the database and records the
+// result as a new revision edited by editor.
+func (a *App) updateNoteInDatabase(note Note, editor string) error {
 	// Prepare the SQL statement for updating note fields
 	updateQuery := `
         UPDATE notes
@@ -275,10 +279,11 @@ func (a *App) updateNoteInDatabase(note Note) error {
 		return err
 	}
 
-	// Prepare the SQL statement for recalculating the fts_text field
+	// Prepare the SQL statement for recalculating the fts_text field from
+	// the plain text of the markdown description
 	recalculateQuery := `
         UPDATE notes
-        SET fts_text = to_tsvector('english', title || ' ' || noteType || ' ' || description || ' ' || taskcompletiontime || ' ' || taskcompletiondate || ' ' || notestatus || ' ' || notedelegation)
+        SET fts_text = to_tsvector('english', title || ' ' || noteType || ' ' || $2::text || ' ' || taskcompletiontime || ' ' || taskcompletiondate || ' ' || notestatus || ' ' || notedelegation)
         WHERE id = $1
     `
 
@@ -288,32 +293,35 @@ func (a *App) updateNoteInDatabase(note Note) error {
 	}
 	defer recalculateStmt.Close()
 
-	_, err = recalculateStmt.Exec(note.ID)
+	_, err = recalculateStmt.Exec(note.ID, markdownText(note.Description))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return a.recordRevision(note.ID, editor)
 }
 
-// insertNoteIntoDatabase inserts a new note into the database.
-func (a *App) insertNoteIntoDatabase(note Note) error {
-	// Prepare the SQL statement for inserting a new note
+// insertNoteIntoDatabase inserts a new note into the database and returns its ID.
+func (a *App) insertNoteIntoDatabase(note Note) (int, error) {
+	// Prepare the SQL statement for inserting a new note, indexing the plain
+	// text of the markdown description
 	insertQuery := `
         INSERT INTO notes (title, noteType, description, TaskCompletionDate, TaskCompletionTime, NoteStatus, NoteDelegation, owner, fts_text)
 		VALUES (
 			$1::text, $2::text, $3::text, $4::text, $5::text, $6::text, $7::text, $8::text,
-			to_tsvector('english', $1::text || ' ' || $2::text || ' ' || $3::text || ' ' || $4::text || ' ' || $5::text || ' ' || $6::text || ' ' || $7::text)
+			to_tsvector('english', $1::text || ' ' || $2::text || ' ' || $9::text || ' ' || $4::text || ' ' || $5::text || ' ' || $6::text || ' ' || $7::text)
 		)
+		RETURNING id
 		`
 
 	insertStmt, err := a.db.Prepare(insertQuery)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer insertStmt.Close()
 
-	_, err = insertStmt.Exec(
+	var id int
+	err = insertStmt.QueryRow(
 		note.Title,
 		note.NoteType,
 		note.Description,
@@ -322,12 +330,17 @@ func (a *App) insertNoteIntoDatabase(note Note) error {
 		note.NoteStatus.String,
 		note.NoteDelegation.String,
 		note.Owner,
-	)
+		markdownText(note.Description),
+	).Scan(&id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	if err := a.recordRevision(id, note.Owner); err != nil {
+		return 0, err
+	}
+
+	return id, nil
 }
 
 // searchNotesInDatabase searches notes in the database based on a search query.
@@ -340,7 +353,8 @@ func (a *App) searchNotesInDatabase(searchQuery string, username string) ([]Note
 	
 	// Prepare the SQL statement for searching notes
 
-	// Can only search for "My Notes/Tasks" and "Notes/Tasks delegated to me" cant search for notes in "Notes/Tasks shared with me"
+	// Searches "My Notes/Tasks", "Notes/Tasks delegated to me" and the notes shared with the user directly or through a group,
+	// by their text or by the name of a user they are shared with
 
     query := `
         SELECT notes.id, notes.title, notes.noteType, notes.description, notes.noteCreated,
@@ -348,8 +362,11 @@ func (a *App) searchNotesInDatabase(searchQuery string, username string) ([]Note
                user_shares.username AS shared_username
         FROM notes
         LEFT JOIN user_shares ON notes.id = user_shares.note_id
-        WHERE (notes.fts_text @@ plainto_tsquery('english', $1) AND (notes.owner = $2 OR notes.noteDelegation = $2))
-        OR (user_shares.username ILIKE $1)
+        WHERE (notes.fts_text @@ plainto_tsquery('english', $1) OR user_shares.username ILIKE $1)
+        AND (notes.owner = $2 OR notes.noteDelegation = $2
+            OR notes.id IN (SELECT note_id FROM effective_shares WHERE username = $2))
+        AND notes.owner IN (SELECT username FROM users WHERE org_id = (SELECT org_id FROM users WHERE username = $2))
+        AND notes.deleted_at IS NULL
     `
 
     stmt, err := a.db.Prepare(query)
@@ -420,8 +437,9 @@ func isValidSearchQuery(textPattern string) bool {
 }
 */
 
-// RemoveDelegation removes delegation from a note in the database.
-func (a *App) RemoveDelegation(noteID int) error {
+// RemoveDelegation removes delegation from a note in the database and
+// records the change as a revision edited by editor.
+func (a *App) RemoveDelegation(noteID int, editor string) error {
 	// Prepare the SQL statement for removing delegation
 	query := "UPDATE notes SET noteDelegation = NULL, noteStatus = NULL WHERE id = $1"
 
@@ -436,10 +454,10 @@ func (a *App) RemoveDelegation(noteID int) error {
 		return fmt.Errorf("Failed to remove delegation: %v", err)
 	}
 
-	return nil
+	return a.recordRevision(noteID, editor)
 }
 
-// getUnsharedUsersForNote retrieves unshared users for a given noteID and username.
+// getUnsharedUsersForNote retrieves unshared users of the user's organization for a given noteID and username.
 func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, error) {
 	// Initialize a slice to store unshared users
 	var unsharedUsers []User
@@ -448,6 +466,7 @@ func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, erro
 	query := `
         SELECT username FROM users
         WHERE username NOT IN (SELECT username FROM user_shares WHERE note_id = $1) AND username != $2
+            AND org_id = (SELECT org_id FROM users WHERE username = $2)
     `
 
 	stmt, err := a.db.Prepare(query)
@@ -486,10 +505,11 @@ func (a *App) getUnsharedUsersForNote(noteID int, username string) ([]User, erro
 	return unsharedUsers, nil
 }
 
-// deleteNoteFromDatabase deletes a note from the database by ID.
+// deleteNoteFromDatabase moves a note to the trash by ID. Its shares are kept
+// until it is purged, so restoring it brings them back.
 func (a *App) deleteNoteFromDatabase(noteID int) error {
-    // Prepare the SQL statement for deleting a note by ID
-    query := "DELETE FROM notes WHERE id = $1"
+    // Prepare the SQL statement for moving a note to the trash by ID
+    query := "UPDATE notes SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL"
     
     stmt, err := a.db.Prepare(query)
     if err != nil {
@@ -505,10 +525,16 @@ func (a *App) deleteNoteFromDatabase(noteID int) error {
     return nil
 }
 
+// errAlreadyShared is returned by shareNoteWithUser when the user already has a share for the note.
+var errAlreadyShared = errors.New("Note is already shared with this user")
+
 // shareNoteWithUser shares a note with a user in the database.
 func (a *App) shareNoteWithUser(noteID int, sharedUsername string, privileges string) error {
-    // Prepare the SQL statement for checking if the shared user exists
-    checkUserQuery := "SELECT username FROM users WHERE username = $1"
+    // Prepare the SQL statement for checking if the shared user exists in the organization of the note's owner
+    checkUserQuery := `
+        SELECT username FROM users
+        WHERE username = $1 AND org_id = (SELECT u.org_id FROM notes n INNER JOIN users u ON u.username = n.owner WHERE n.id = $2)
+    `
 
     // Prepare the SQL statement for checking if the note exists
     checkNoteQuery := "SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1)"
@@ -524,7 +550,7 @@ func (a *App) shareNoteWithUser(noteID int, sharedUsername string, privileges st
 
     // Check if the shared user exists
     var sharedUserID string
-    err := a.db.QueryRow(checkUserQuery, sharedUsername).Scan(&sharedUserID)
+    err := a.db.QueryRow(checkUserQuery, sharedUsername, noteID).Scan(&sharedUserID)
     if err != nil {
         // Handle the case where the shared user does not exist
         return err
@@ -545,7 +571,7 @@ func (a *App) shareNoteWithUser(noteID int, sharedUsername string, privileges st
     var existingShareID int
     err = a.db.QueryRow(checkExistingShareQuery, noteID, sharedUsername).Scan(&existingShareID)
     if err == nil {
-        return fmt.Errorf("Note is already shared with this user")
+        return errAlreadyShared
     } else if err != sql.ErrNoRows {
         return err
     }
@@ -585,11 +611,18 @@ func (a *App) updateUserPrivileges(selectedUsername, updatedPrivileges, noteID s
     }
     defer stmt.Close()
 
-    _, err = stmt.Exec(updatedPrivileges, selectedUsername, noteID)
+    result, err := stmt.Exec(updatedPrivileges, selectedUsername, noteID)
     if err != nil {
         return err
     }
 
+    // The note is not shared with the user
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return sql.ErrNoRows
+    }
+
     return nil
 }
 
@@ -612,7 +645,7 @@ func (a *App) findTextInNote(noteID int, searchPattern string) ([]SearchResult,
 
         // Count occurrences in the title and description
         titleOccurrences := countOccurrences(note.Title, searchPattern)
-        descriptionOccurrences := countOccurrences(note.Description, searchPattern)
+        descriptionOccurrences := countOccurrences(markdownText(note.Description), searchPattern)
 
         if titleOccurrences > 0 {
             results = append(results, SearchResult{
@@ -641,16 +674,14 @@ func countOccurrences(text, searchPattern string) int {
 
 // getNoteByID retrieves a note from the database by ID.
 func (a *App) getNoteByID(noteID int) (*Note, error) {
-    query := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner FROM notes WHERE id = $1"
+    query := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, noteCreated, COALESCE(notebook_id, 0) FROM notes WHERE id = $1"
     row := a.db.QueryRow(query, noteID)
 
     var note Note
-    err := row.Scan(&note.ID, &note.Title, &note.Description, &note.NoteType, &note.TaskCompletionTime, &note.TaskCompletionDate, &note.NoteStatus, &note.NoteDelegation, &note.Owner)
+    err := row.Scan(&note.ID, &note.Title, &note.Description, &note.NoteType, &note.TaskCompletionTime, &note.TaskCompletionDate, &note.NoteStatus, &note.NoteDelegation, &note.Owner, &note.NoteCreated, &note.NotebookID)
     if err != nil {
         return nil, err
     }
 
     return &note, nil
 }
-
-
@@ -136,7 +136,7 @@ func TestRetrieveSharedNotesWithPrivileges_Success(t *testing.T) {
     )
 
     // Expect the query with a specific username
-    mock.ExpectPrepare("SELECT n.*, us.privileges FROM notes n INNER JOIN user_shares us .*").ExpectQuery().
+    mock.ExpectPrepare("SELECT n.*, us.privileges FROM notes n INNER JOIN effective_shares us .*").ExpectQuery().
         WithArgs("user1").
         WillReturnRows(rows)
 
@@ -252,7 +252,7 @@ func TestShareNoteWithUser(t *testing.T) {
 
     // Define the expected SQL queries and their results using sqlmock
     mock.ExpectQuery("SELECT username").
-        WithArgs(sharedUsername).
+        WithArgs(sharedUsername, noteID).
         WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(sharedUsername))
 
     mock.ExpectQuery("SELECT EXISTS").
@@ -329,8 +329,11 @@ func TestRemoveDelegation(t *testing.T) {
     mock.ExpectPrepare(expectedQuery).ExpectExec().
         WithArgs(noteID).
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
+    mock.ExpectExec("INSERT INTO note_revisions").
+        WithArgs(noteID, "mydog7").
+        WillReturnResult(sqlmock.NewResult(0, 1))
 
-    err = app.RemoveDelegation(noteID)
+    err = app.RemoveDelegation(noteID, "mydog7")
 
     // Check if there are any expectations that were not met
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -399,7 +402,7 @@ func TestDeleteNoteFromDatabase(t *testing.T) {
     noteID := 123 // Replace with the appropriate noteID
 
     // Define the expected SQL query and result using sqlmock
-    expectedQuery := "DELETE FROM notes"
+    expectedQuery := "UPDATE notes SET deleted_at = CURRENT_TIMESTAMP WHERE id = \\$1 AND deleted_at IS NULL"
     mock.ExpectPrepare(expectedQuery).ExpectExec().
         WithArgs(noteID).
         WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
@@ -461,12 +464,13 @@ func TestGetNoteByID(t *testing.T) {
     app := &App{db: db}
 
     // Define the expected SQL query and result using sqlmock
-    expectedQuery := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner FROM notes WHERE id = ?"
+    expectedQuery := "SELECT id, title, description, noteType, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, noteCreated, COALESCE\\(notebook_id, 0\\) FROM notes WHERE id = ?"
     expectedNoteID := 123 // Replace with the appropriate noteID
+    noteCreatedTime := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
     mock.ExpectQuery(expectedQuery).
         WithArgs(expectedNoteID).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner"}).
-            AddRow(123, "Sample Title", "Sample Description", "Type", "2023-11-01", "2023-11-02", "Status", "Delegation", "Owner"),
+        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+            AddRow(123, "Sample Title", "Sample Description", "Type", "2023-11-01", "2023-11-02", "Status", "Delegation", "Owner", noteCreatedTime, 0),
         )
 
     // Call the getNoteByID function
@@ -486,7 +490,7 @@ func TestGetNoteByID(t *testing.T) {
     if retrievedNote == nil {
         t.Errorf("Expected a non-nil note, but got nil")
     }
-    if retrievedNote.ID != 123 || retrievedNote.Title != "Sample Title" || retrievedNote.Description != "Sample Description" {
+    if retrievedNote.ID != 123 || retrievedNote.Title != "Sample Title" || retrievedNote.Description != "Sample Description" || !retrievedNote.NoteCreated.Equal(noteCreatedTime) {
         t.Errorf("Unexpected note: got %v", retrievedNote)
     }
 }
@@ -512,3 +516,34 @@ func TestCountOccurrences(t *testing.T) {
     }
 }
 
+
+func TestSearchNotesInDatabase_ShareNamesNeedAccess(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+
+    app := &App{db: db}
+
+    // Searching for the name of a sharee only finds notes the searching user can access,
+    // so a user who is not shared a note gets nothing back
+    mock.ExpectPrepare(`WHERE \(notes.fts_text @@ plainto_tsquery\('english', \$1\) OR user_shares.username ILIKE \$1\) ` +
+        `AND \(notes.owner = \$2 OR notes.noteDelegation = \$2 OR notes.id IN \(SELECT note_id FROM effective_shares WHERE username = \$2\)\)`).
+        ExpectQuery().
+        WithArgs("BIGCAT", "stranger").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "title", "noteType", "description", "noteCreated",
+            "taskCompletionDate", "taskCompletionTime", "noteStatus", "noteDelegation", "owner", "shared_username"}))
+
+    notes, err := app.searchNotesInDatabase("BIGCAT", "stranger")
+    if err != nil {
+        t.Fatalf("Expected no error, but got %v", err)
+    }
+    if len(notes) != 0 {
+        t.Errorf("Expected no notes, but got %v", notes)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("there were unfulfilled expectations: %s", err)
+    }
+}
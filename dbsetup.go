@@ -2,22 +2,12 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// PostgreSQl configuration if not passed as env variables
-const (
-	host     = "localhost" //127.0.0.1
-	port     = 5432
-	user     = "postgres"
-	password = ""
-	dbname   = "postgres"
-)
-
 var (
 	err  error
 	wait time.Duration
@@ -26,17 +16,20 @@ var (
 type App struct {
 	Router        *mux.Router
 	db            *sql.DB
-	bindport      string
+	config        *Config
+	passwords     *passwordPolicy
+	mailer        Mailer
+	oidc          *oidcClient
+	authenticator Authenticator
 	username      string
 }
 
-func setupDatabase() (*sql.DB, error) {
-    psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
+func setupDatabase(cfg DatabaseConfig) (*sql.DB, error) {
     log.Println("Connecting to PostgreSQL")
-    log.Println(psqlInfo)
-    db, err := sql.Open("pgx", psqlInfo)
+    log.Println(cfg.RedactedDSN())
+    db, err := sql.Open("pgx", cfg.DSN())
     if err != nil {
-        log.Println("Invalid DB arguments, or github.com/lib/pq not installed")
+        log.Println("Invalid DB arguments, or github.com/jackc/pgx not installed")
         return nil, err
     }
 
@@ -48,4 +41,4 @@ func setupDatabase() (*sql.DB, error) {
 
     log.Println("Database connected successfully")
     return db, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxGroupNameLength is the longest group name accepted.
+const maxGroupNameLength = 100
+
+var (
+	errGroupNotFound    = errors.New("group not found")
+	errGroupForbidden   = errors.New("only the owner of the group or an administrator can change it")
+	errGroupNameTaken   = errors.New("a group with this name already exists")
+	errInvalidGroupName = fmt.Errorf("group names must have 1 to %d characters", maxGroupNameLength)
+)
+
+// Group is a named set of users that notes can be shared with.
+type Group struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+}
+
+// GroupShare is the share of a note with a group.
+type GroupShare struct {
+	NoteID     int    `json:"note_id"`
+	GroupID    int    `json:"group_id"`
+	GroupName  string `json:"group_name"`
+	Privileges string `json:"privileges"`
+}
+
+// groupInput is the JSON body accepted when creating or renaming a group.
+type groupInput struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// groupShareInput is the JSON body accepted when sharing a note with a group.
+type groupShareInput struct {
+	GroupID    int    `json:"group_id"`
+	Privileges string `json:"privileges"`
+}
+
+// queryGroups runs a query selecting group id, name, owner and one member
+// per row, and collects the groups in the order of the rows.
+func (a *App) queryGroups(query string, args ...interface{}) ([]Group, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var g Group
+		var member sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &g.Owner, &member); err != nil {
+			return nil, err
+		}
+
+		i, ok := index[g.ID]
+		if !ok {
+			g.Members = []string{}
+			groups = append(groups, g)
+			i = len(groups) - 1
+			index[g.ID] = i
+		}
+		if member.Valid {
+			groups[i].Members = append(groups[i].Members, member.String)
+		}
+	}
+
+	return groups, rows.Err()
+}
+
+// listGroups returns the groups username owns or belongs to.
+func (a *App) listGroups(username string) ([]Group, error) {
+	return a.queryGroups(`
+		SELECT g.id, g.name, g.owner, m.username
+		FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id
+		WHERE g.owner = $1 OR g.id IN (SELECT group_id FROM group_members WHERE username = $1)
+		ORDER BY LOWER(g.name), g.id, m.username`, username)
+}
+
+// getGroup returns a group with its members, or errGroupNotFound.
+func (a *App) getGroup(groupID int) (*Group, error) {
+	groups, err := a.queryGroups(`
+		SELECT g.id, g.name, g.owner, m.username
+		FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id
+		WHERE g.id = $1
+		ORDER BY m.username`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, errGroupNotFound
+	}
+	return &groups[0], nil
+}
+
+// authorizeGroup checks that username may see the group, or change it when
+// manage is set. Members can see a group; only its owner and administrators
+// can change it. It returns errGroupNotFound for groups the user cannot see.
+func (a *App) authorizeGroup(username string, groupID int, manage bool) error {
+	var owner string
+	var member bool
+	err := a.db.QueryRow(`
+		SELECT owner, EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND username = $2)
+		FROM groups WHERE id = $1`, groupID, username).Scan(&owner, &member)
+	if err == sql.ErrNoRows {
+		return errGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if owner == username {
+		return nil
+	}
+	if admin, err := a.isAdmin(username); err != nil {
+		return err
+	} else if admin {
+		return nil
+	}
+
+	switch {
+	case !member:
+		return errGroupNotFound
+	case manage:
+		return errGroupForbidden
+	}
+	return nil
+}
+
+// validGroupName trims name and checks its length.
+func validGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxGroupNameLength {
+		return "", errInvalidGroupName
+	}
+	return name, nil
+}
+
+// groupNameTaken reports whether another group than groupID in the
+// organization orgID uses name, ignoring case.
+func groupNameTaken(tx *sql.Tx, name string, groupID, orgID int) (bool, error) {
+	var taken bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE LOWER(name) = LOWER($1) AND id != $2 AND org_id = $3)", name, groupID, orgID).Scan(&taken)
+	return taken, err
+}
+
+// addMember adds username to a group, doing nothing if they already are a
+// member. It returns sql.ErrNoRows if the user does not exist in the
+// organization of the group.
+func addMember(tx *sql.Tx, groupID int, username string) error {
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u INNER JOIN groups g ON g.org_id = u.org_id
+			WHERE u.username = $1 AND g.id = $2
+		)`, username, groupID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("INSERT INTO group_members (group_id, username) VALUES ($1, $2) ON CONFLICT DO NOTHING", groupID, username)
+	return err
+}
+
+// createGroup creates a group owned by owner, who becomes its first member
+// together with members, and returns its ID.
+func (a *App) createGroup(name, owner string, members []string) (int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var orgID int
+	if err := tx.QueryRow("SELECT org_id FROM users WHERE username = $1", owner).Scan(&orgID); err != nil {
+		return 0, err
+	}
+	if taken, err := groupNameTaken(tx, name, 0, orgID); err != nil {
+		return 0, err
+	} else if taken {
+		return 0, errGroupNameTaken
+	}
+
+	var id int
+	if err := tx.QueryRow("INSERT INTO groups (name, owner, org_id) VALUES ($1, $2, $3) RETURNING id", name, owner, orgID).Scan(&id); err != nil {
+		return 0, err
+	}
+	for _, username := range append([]string{owner}, members...) {
+		if err := addMember(tx, id, username); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// renameGroup gives a group a new name.
+func (a *App) renameGroup(groupID int, name string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orgID int
+	if err := tx.QueryRow("SELECT org_id FROM groups WHERE id = $1", groupID).Scan(&orgID); err != nil {
+		return err
+	}
+	if taken, err := groupNameTaken(tx, name, groupID, orgID); err != nil {
+		return err
+	} else if taken {
+		return errGroupNameTaken
+	}
+	if _, err := tx.Exec("UPDATE groups SET name = $2 WHERE id = $1", groupID, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteGroup deletes a group. Its members lose access to the notes shared with it.
+func (a *App) deleteGroup(groupID int) error {
+	_, err := a.db.Exec("DELETE FROM groups WHERE id = $1", groupID)
+	return err
+}
+
+// addGroupMember adds a user to a group.
+func (a *App) addGroupMember(groupID int, username string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addMember(tx, groupID, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeGroupMember removes a user from a group.
+func (a *App) removeGroupMember(groupID int, username string) error {
+	_, err := a.db.Exec("DELETE FROM group_members WHERE group_id = $1 AND username = $2", groupID, username)
+	return err
+}
+
+// getGroupSharesForNote returns the groups a note is shared with.
+func (a *App) getGroupSharesForNote(noteID int) ([]GroupShare, error) {
+	rows, err := a.db.Query(`
+		SELECT gs.note_id, gs.group_id, g.name, gs.privileges
+		FROM group_shares gs
+		INNER JOIN groups g ON g.id = gs.group_id
+		WHERE gs.note_id = $1
+		ORDER BY LOWER(g.name)`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []GroupShare{}
+	for rows.Next() {
+		var share GroupShare
+		if err := rows.Scan(&share.NoteID, &share.GroupID, &share.GroupName, &share.Privileges); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+// shareNoteWithGroup shares a note with every member of a group, now and in
+// the future. The group must be in the organization of the note's owner.
+func (a *App) shareNoteWithGroup(noteID, groupID int, privileges string) error {
+	var exists bool
+	err := a.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM groups g
+			WHERE g.id = $1 AND g.org_id = (SELECT u.org_id FROM notes n INNER JOIN users u ON u.username = n.owner WHERE n.id = $2)
+		)`, groupID, noteID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errGroupNotFound
+	}
+
+	result, err := a.db.Exec(`
+		INSERT INTO group_shares (note_id, group_id, privileges)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, noteID, groupID, privileges)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAlreadyShared
+	}
+	return nil
+}
+
+// updateGroupSharePrivileges changes the privileges of a group share, returning
+// sql.ErrNoRows if the note is not shared with the group.
+func (a *App) updateGroupSharePrivileges(noteID, groupID int, privileges string) error {
+	result, err := a.db.Exec("UPDATE group_shares SET privileges = $3 WHERE note_id = $1 AND group_id = $2", noteID, groupID, privileges)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// removeGroupShare stops sharing a note with a group.
+func (a *App) removeGroupShare(noteID, groupID int) error {
+	_, err := a.db.Exec("DELETE FROM group_shares WHERE note_id = $1 AND group_id = $2", noteID, groupID)
+	return err
+}
+
+// groupErrorStatus maps an error from the group functions to an HTTP status code.
+func groupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errGroupNotFound), err == sql.ErrNoRows:
+		return http.StatusNotFound
+	case errors.Is(err, errGroupForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errGroupNameTaken), errors.Is(err, errAlreadyShared):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidGroupName):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respondWithGroupError writes the JSON error response for a group function error.
+func respondWithGroupError(w http.ResponseWriter, err error) {
+	message := err.Error()
+	if err == sql.ErrNoRows {
+		message = "user not found"
+	}
+	respondWithError(w, groupErrorStatus(err), message)
+}
+
+// authorizeAPIGroup parses the group ID from the URL and checks access to it.
+// On failure it writes the JSON error response and returns false.
+func (a *App) authorizeAPIGroup(w http.ResponseWriter, r *http.Request, manage bool) (int, bool) {
+	groupID, err := strconv.Atoi(mux.Vars(r)["groupID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid groupID")
+		return 0, false
+	}
+
+	if err := a.authorizeGroup(currentUsername(r), groupID, manage); err != nil {
+		respondWithGroupError(w, err)
+		return 0, false
+	}
+
+	return groupID, true
+}
+
+// apiListGroupsHandler returns the groups the user owns or belongs to.
+func (a *App) apiListGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := a.listGroups(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+// apiCreateGroupHandler creates a group owned by the user.
+func (a *App) apiCreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var in groupInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := validGroupName(in.Name)
+	if err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+
+	id, err := a.createGroup(name, currentUsername(r), in.Members)
+	if err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+
+	group, err := a.getGroup(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/groups/%d", id))
+	respondWithJSON(w, http.StatusCreated, group)
+}
+
+// apiGetGroupHandler returns a group with its members.
+func (a *App) apiGetGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := a.authorizeAPIGroup(w, r, false)
+	if !ok {
+		return
+	}
+
+	group, err := a.getGroup(groupID)
+	if err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, group)
+}
+
+// apiRenameGroupHandler changes the name of a group.
+func (a *App) apiRenameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := a.authorizeAPIGroup(w, r, true)
+	if !ok {
+		return
+	}
+
+	var in groupInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := validGroupName(in.Name)
+	if err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+	if err := a.renameGroup(groupID, name); err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+
+	group, err := a.getGroup(groupID)
+	if err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, group)
+}
+
+// apiDeleteGroupHandler deletes a group.
+func (a *App) apiDeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := a.authorizeAPIGroup(w, r, true)
+	if !ok {
+		return
+	}
+
+	if err := a.deleteGroup(groupID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAddGroupMemberHandler adds a user to a group.
+func (a *App) apiAddGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := a.authorizeAPIGroup(w, r, true)
+	if !ok {
+		return
+	}
+
+	if err := a.addGroupMember(groupID, mux.Vars(r)["username"]); err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRemoveGroupMemberHandler removes a user from a group.
+// Members may also leave a group themselves.
+func (a *App) apiRemoveGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	groupID, ok := a.authorizeAPIGroup(w, r, username != currentUsername(r))
+	if !ok {
+		return
+	}
+
+	if err := a.removeGroupMember(groupID, username); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListGroupSharesHandler returns the groups a note is shared with.
+func (a *App) apiListGroupSharesHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	shares, err := a.getGroupSharesForNote(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, shares)
+}
+
+// apiCreateGroupShareHandler shares a note with a group.
+func (a *App) apiCreateGroupShareHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionShare)
+	if !ok {
+		return
+	}
+
+	var in groupShareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithError(w, http.StatusBadRequest, "privileges must be editor or viewer")
+		return
+	}
+
+	if err := a.shareNoteWithGroup(noteID, in.GroupID, in.Privileges); err != nil {
+		respondWithGroupError(w, err)
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditShareGroup, NoteID: noteID, Target: strconv.Itoa(in.GroupID), Details: in.Privileges})
+
+	share := GroupShare{NoteID: noteID, GroupID: in.GroupID, Privileges: in.Privileges}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/notes/%d/group-shares/%d", noteID, in.GroupID))
+	respondWithJSON(w, http.StatusCreated, share)
+}
+
+// apiUpdateGroupShareHandler changes the privileges of a group share.
+func (a *App) apiUpdateGroupShareHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionShare)
+	if !ok {
+		return
+	}
+	groupID, err := strconv.Atoi(mux.Vars(r)["groupID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid groupID")
+		return
+	}
+
+	var in groupShareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithError(w, http.StatusBadRequest, "privileges must be editor or viewer")
+		return
+	}
+
+	if err := a.updateGroupSharePrivileges(noteID, groupID, in.Privileges); err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "note is not shared with this group")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUpdateGroupPrivileges, NoteID: noteID, Target: strconv.Itoa(groupID), Details: in.Privileges})
+
+	respondWithJSON(w, http.StatusOK, GroupShare{NoteID: noteID, GroupID: groupID, Privileges: in.Privileges})
+}
+
+// apiDeleteGroupShareHandler stops sharing a note with a group.
+func (a *App) apiDeleteGroupShareHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionShare)
+	if !ok {
+		return
+	}
+	groupID, err := strconv.Atoi(mux.Vars(r)["groupID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid groupID")
+		return
+	}
+
+	if err := a.removeGroupShare(noteID, groupID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUnshareGroup, NoteID: noteID, Target: strconv.Itoa(groupID)})
+	w.WriteHeader(http.StatusNoContent)
+}
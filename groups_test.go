@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// groupAuthQuery is the query authorizeGroup uses to load the owner and membership.
+const groupAuthQuery = "SELECT owner, EXISTS \\(SELECT 1 FROM group_members"
+
+func TestAuthorizeGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		member  bool
+		admin   bool
+		manage  bool
+		wantErr error
+	}{
+		{name: "owner manages", user: "mydog7", manage: true},
+		{name: "member views", user: "BIGCAT", member: true},
+		{name: "member cannot manage", user: "BIGCAT", member: true, manage: true, wantErr: errGroupForbidden},
+		{name: "stranger cannot see", user: "stranger", wantErr: errGroupNotFound},
+		{name: "admin manages", user: "root", admin: true, manage: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			a := App{db: db}
+
+			mock.ExpectQuery(groupAuthQuery).WithArgs(1, tt.user).
+				WillReturnRows(sqlmock.NewRows([]string{"owner", "member"}).AddRow("mydog7", tt.member))
+			if tt.user != "mydog7" {
+				mock.ExpectQuery("SELECT role").WithArgs(tt.user, roleAdmin).
+					WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(tt.admin))
+			}
+
+			if err := a.authorizeGroup(tt.user, 1, tt.manage); err != tt.wantErr {
+				t.Errorf("Expected %v, but got %v", tt.wantErr, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPICreateGroup(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT org_id FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"org_id"}).AddRow(defaultOrganizationID))
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM groups").WithArgs("Team", 0, defaultOrganizationID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("INSERT INTO groups").WithArgs("Team", "mydog7", defaultOrganizationID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	for _, username := range []string{"mydog7", "BIGCAT"} {
+		mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM users u").WithArgs(username, 3).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectExec("INSERT INTO group_members").WithArgs(3, username).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT g.id, g.name, g.owner, m.username").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "owner", "username"}).
+			AddRow(3, "Team", "mydog7", "BIGCAT").
+			AddRow(3, "Team", "mydog7", "mydog7"))
+
+	body := strings.NewReader(`{"name": " Team ", "members": ["BIGCAT"]}`)
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/groups", body), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var group Group
+	if err := json.Unmarshal(rr.Body.Bytes(), &group); err != nil {
+		t.Fatal(err)
+	}
+	if group.ID != 3 || group.Name != "Team" || len(group.Members) != 2 {
+		t.Errorf("Unexpected group %+v", group)
+	}
+
+	// Names are unique regardless of case
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT org_id FROM users").WithArgs("BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"org_id"}).AddRow(defaultOrganizationID))
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM groups").WithArgs("team", 0, defaultOrganizationID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/groups", strings.NewReader(`{"name": "team"}`)), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIRemoveGroupMember_Self(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// Members can leave a group they cannot manage
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(groupAuthQuery).WithArgs(3, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "member"}).AddRow("mydog7", true))
+	mock.ExpectQuery("SELECT role").WithArgs("BIGCAT", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(false))
+	mock.ExpectExec("DELETE FROM group_members").WithArgs(3, "BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := loginRequest(httptest.NewRequest("DELETE", "/api/v1/groups/3/members/BIGCAT", nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	// but not remove other members
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(groupAuthQuery).WithArgs(3, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "member"}).AddRow("mydog7", true))
+	mock.ExpectQuery("SELECT role").WithArgs("BIGCAT", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(false))
+
+	req = loginRequest(httptest.NewRequest("DELETE", "/api/v1/groups/3/members/mydog7", nil), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPICreateGroupShare(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectOwner := func() {
+		mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+			WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	}
+
+	expectActiveUser(mock, "mydog7")
+	expectOwner()
+	mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM groups g").WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO group_shares").WithArgs(1, 3, privilegeEditor).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, "mydog7", auditShareGroup, 1, "3", privilegeEditor)
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/group-shares", strings.NewReader(`{"group_id": 3, "privileges": "editor"}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	// Sharing twice
+	expectActiveUser(mock, "mydog7")
+	expectOwner()
+	mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM groups g").WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO group_shares").WithArgs(1, 3, privilegeViewer).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/group-shares", strings.NewReader(`{"group_id": 3, "privileges": "viewer"}`)), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	// Only the owner of the note can share it
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeEditor))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/group-shares", strings.NewReader(`{"group_id": 3, "privileges": "editor"}`)), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -2,33 +2,22 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
 	"sort"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/icza/session"
 )
 
 
 
 func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
-    sess := session.Get(r)
-    username := "[guest]"
-
-    if sess != nil {
-        username = sess.CAttr("username").(string)
-    }
+    username := currentUsername(r)
 
     // Check for a message cookie
     cookie, err := r.Cookie("errorMessage")
@@ -84,6 +73,55 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         return delegatedNotes[i].NoteCreated.After(delegatedNotes[j].NoteCreated)
     })
 
+    // Narrow the notes down to the selected tags
+    filter, err := parseTagFilter(r)
+    if err != nil {
+        message = "Filter Error: " + err.Error() + "."
+        filter = tagFilter{}
+    }
+    for _, list := range []*[]Note{&notes, &sharedNotes, &delegatedNotes} {
+        if err := a.loadTags(*list); err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+        *list = filter.apply(*list)
+    }
+
+    tagCloud, err := a.tagCloud(username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+
+    // Show only the notes of the selected notebook and the notebooks inside it
+    notebooks, err := a.listNotebooks(username)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    notebook, err := a.selectedNotebook(r, notebooks)
+    if err != nil {
+        message = "Notebook Error: " + err.Error() + "."
+    }
+    var notebookID int
+    var notebookShares []NotebookShare
+    if notebook != nil {
+        notebookID = notebook.ID
+        if notebook.Owner == username {
+            if notebookShares, err = a.listNotebookShares(notebook.ID); err != nil {
+                checkInternalServerError(err, w)
+                return
+            }
+        }
+    }
+    for _, list := range []*[]Note{&notes, &sharedNotes, &delegatedNotes} {
+        if *list, err = a.scopeToNotebook(*list, notebookID); err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+        renderDescriptions(*list)
+    }
+
     // Get the list of all users
     allUsers, err := a.getAllUsers(username)
     if err != nil {
@@ -110,7 +148,12 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         AllUsers      []User
         SharedNotes   []Note
         Message string
-        
+        TagCloud      []TagCount
+        TagFilter     tagFilter
+        Notebooks     []Notebook
+        Notebook      *Notebook
+        NotebookShares []NotebookShare
+        CSRFToken     string
     }{
         Username:      username,
         Notes:         notes,
@@ -118,7 +161,12 @@ func (a *App) listHandler(w http.ResponseWriter, r *http.Request) {
         AllUsers:      allUsers,
         SharedNotes:   sharedNotes,
         Message: message,
-        
+        TagCloud:      tagCloud,
+        TagFilter:     filter,
+        Notebooks:     notebooks,
+        Notebook:      notebook,
+        NotebookShares: notebookShares,
+        CSRFToken:     csrfToken(r),
     }
 
     t, err := template.New("list.html").Funcs(template.FuncMap{
@@ -160,6 +208,11 @@ func (a *App) getSharedUsersForNoteHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
+    // Only users who can see the note may see who it is shared with
+    if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionRead); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
 
     // Fetch the shared users for the given noteID
     sharedUsers, err := a.getSharedUsersForNote(noteID)
@@ -201,11 +254,12 @@ func (a *App) getUnsharedUsersForNoteHandler(w http.ResponseWriter, r *http.Requ
     }
 
 	// Get the current username from the session
-    sess := session.Get(r)
-    username := "[guest]"
+    username := currentUsername(r)
 
-    if sess != nil {
-        username = sess.CAttr("username").(string)
+    // Only the owner may look up users to share the note with
+    if err := a.authorizeNote(r.Context(), username, noteID, noteActionShare); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
     }
 
     // Fetch the unshared users for the given noteID
@@ -234,17 +288,7 @@ func (a *App) getUnsharedUsersForNoteHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
-	sess := session.Get(r)
-    username := "[guest]"
-
-    if sess != nil {
-        username = sess.CAttr("username").(string)
-    }
+	username := currentUsername(r)
 
 	// Get the list of all users
     allUsers, err := a.getAllUsers(username)
@@ -272,6 +316,17 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    filter, err := parseTagFilter(r)
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Search Error: " + err.Error() + ".",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+
     // Query your database using FTS to search for notes based on searchQuery
     results, err := a.searchNotesInDatabase(searchQuery, username)
     if err != nil {
@@ -279,6 +334,39 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Keep the results with the selected tags
+    if err := a.loadTags(results); err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    results = filter.apply(results)
+
+    // and in the selected notebook
+    notebooks, err := a.listNotebooks(username)
+    if err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    notebook, err := a.selectedNotebook(r, notebooks)
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Search Error: " + err.Error() + ".",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+    var notebookID int
+    if notebook != nil {
+        notebookID = notebook.ID
+    }
+    if results, err = a.scopeToNotebook(results, notebookID); err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    renderDescriptions(results)
+
     // Retrieve shared users for each note in the search results
     for i, note := range results {
         sharedUsers, err := a.getSharedUsersForNote(note.ID)
@@ -294,12 +382,18 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
 		Username string
         SearchResults []Note
 		SearchQuery string
+		TagFilter     tagFilter
+		Notebook      *Notebook
 		AllUsers      []User
+		CSRFToken     string
     }{
 		Username: username,
         SearchResults: results,
 		SearchQuery: searchQuery,
+		TagFilter:     filter,
+		Notebook:      notebook,
 		AllUsers:      allUsers, 
+		CSRFToken:     csrfToken(r),
     }
 
 	var funcMap = template.FuncMap{
@@ -326,19 +420,7 @@ func (a *App) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) createHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-    }
-
-    sess := session.Get(r)
-    if sess == nil {
-        // Handle the case when session is not found or authenticated
-        http.Error(w, "Unauthorized", http.StatusSeeOther)
-        return
-    }
-
-    username := sess.CAttr("username").(string)
+    username := currentUsername(r)
 
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -362,35 +444,83 @@ func (a *App) createHandler(w http.ResponseWriter, r *http.Request) {
 	
 
     // Validate the length of title and description
-    if len(note.Title) > MaxNoteLength || len(note.Description) > MaxNoteLength {
+    if len(note.Title) > MaxNoteLength || len(note.Description) > maxDescriptionLength {
         
         
         http.SetCookie(w, &http.Cookie{
             Name:  "errorMessage",
-            Value: "Create Error: Note title or description exceeds 256 characters.", // Set your error message
+            Value: fmt.Sprintf("Create Error: Note title exceeds %d characters or description exceeds %d characters.", MaxNoteLength, maxDescriptionLength), // Set your error message
             Path:  "/list", // Set the path as needed
         })
         http.Redirect(w, r, "/list", http.StatusSeeOther)
         return
     }
 
+    tags, err := parseTags(r.FormValue("Tags"))
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Create Error: " + err.Error() + ".",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+
+    // New notes can go straight into one of the user's notebooks
+    notebookID, _ := strconv.Atoi(r.FormValue("NotebookID"))
+    if notebookID != 0 {
+        if err := a.authorizeNotebook(username, notebookID, true); err != nil {
+            http.SetCookie(w, &http.Cookie{
+                Name:  "errorMessage",
+                Value: "Create Error: " + err.Error() + ".",
+                Path:  "/list",
+            })
+            http.Redirect(w, r, "/list", http.StatusSeeOther)
+            return
+        }
+    }
+
+    // Notes can only be delegated within the organization
+    if err := a.checkDelegate(username, note.NoteDelegation.String); err == errDelegateNotFound {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Create Error: Delegated user not found.",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    } else if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+
     // Insert the new note into the database
-    err := a.insertNoteIntoDatabase(note)
+    id, err := a.insertNoteIntoDatabase(note)
     if err != nil {
         checkInternalServerError(err, w)
         return
     }
+    if len(tags) > 0 {
+        if err := a.setNoteTags(id, tags); err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+    }
+    if notebookID != 0 {
+        if err := a.moveNote(id, notebookID); err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+        http.Redirect(w, r, fmt.Sprintf("/list?notebook=%d", notebookID), http.StatusSeeOther)
+        return
+    }
 
     http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
 
 func (a *App) updateHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
         return
@@ -409,26 +539,77 @@ func (a *App) updateHandler(w http.ResponseWriter, r *http.Request) {
     note.NoteDelegation.String = r.FormValue("NoteDelegation")
 	note.TaskCompletionTime.String = convertTo12HourFormat(r.FormValue("TaskCompletionTime"))
 
+    // Only the owner, the delegate or users with write privileges may edit the note
+    if err := a.authorizeNote(r.Context(), currentUsername(r), note.ID, noteActionUpdate); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
+
+    // but only the owner may hand it to someone else
+    current, err := a.getNoteByID(note.ID)
+    if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+    if note.NoteDelegation.String != current.NoteDelegation.String {
+        if err := a.authorizeNote(r.Context(), currentUsername(r), note.ID, delegationAction(note.NoteDelegation.String)); err != nil {
+            respondWithNoteAuthError(w, err)
+            return
+        }
+    }
 
 	// Validate the length of title and description
-    if len(note.Title) > MaxNoteLength || len(note.Description) > MaxNoteLength {
+    if len(note.Title) > MaxNoteLength || len(note.Description) > maxDescriptionLength {
         
         
         http.SetCookie(w, &http.Cookie{
             Name:  "errorMessage",
-            Value: "Update Error: Note title or description exceeds 256 characters.", // Set your error message
+            Value: fmt.Sprintf("Update Error: Note title exceeds %d characters or description exceeds %d characters.", MaxNoteLength, maxDescriptionLength), // Set your error message
             Path:  "/list", // Set the path as needed
         })
         http.Redirect(w, r, "/list", http.StatusSeeOther)
         return
     }
 
+    // Forms without a Tags field leave the tags as they are
+    _, hasTags := r.Form["Tags"]
+    tags, err := parseTags(r.FormValue("Tags"))
+    if err != nil {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Update Error: " + err.Error() + ".",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    }
+
+    // Notes can only be delegated within the organization
+    if err := a.checkDelegate(currentUsername(r), note.NoteDelegation.String); err == errDelegateNotFound {
+        http.SetCookie(w, &http.Cookie{
+            Name:  "errorMessage",
+            Value: "Update Error: Delegated user not found.",
+            Path:  "/list",
+        })
+        http.Redirect(w, r, "/list", http.StatusSeeOther)
+        return
+    } else if err != nil {
+        checkInternalServerError(err, w)
+        return
+    }
+
     // Update the note in the database
-    err := a.updateNoteInDatabase(note)
+    err = a.updateNoteInDatabase(note, currentUsername(r))
     if err != nil {
         checkInternalServerError(err, w)
         return
     }
+    if hasTags {
+        if err := a.setNoteTags(note.ID, tags); err != nil {
+            checkInternalServerError(err, w)
+            return
+        }
+    }
 
     // Redirect back to the list page or another appropriate page
     http.Redirect(w, r, "/list", http.StatusSeeOther)
@@ -458,11 +639,6 @@ func convertTo12HourFormat(time24hr string) string {
 }
 
 func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Redirect(w, r, "/", http.StatusSeeOther)
         return
@@ -470,23 +646,25 @@ func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
 
     noteID, _ := strconv.Atoi(r.FormValue("Id"))
 
+    // Only the owner may delete a note
+    if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionDelete); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
+
     // Delete the note from the database
     err := a.deleteNoteFromDatabase(noteID)
     if err != nil {
         checkInternalServerError(err, w)
         return
     }
+    a.audit(r, AuditEvent{Action: auditDelete, NoteID: noteID})
 
     http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
 
 func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -497,12 +675,19 @@ func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
     privileges := r.FormValue("Privileges")
     noteID, _ := strconv.Atoi(r.FormValue("Id"))
 
+    // Only the owner may share a note
+    if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionShare); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
+
     // Share the note with the user in the database
     err := a.shareNoteWithUser(noteID, sharedUsername, privileges)
     if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+    a.audit(r, AuditEvent{Action: auditShare, NoteID: noteID, Target: sharedUsername, Details: privileges})
 
     // Provide feedback to the user (e.g., "Note shared successfully")
 
@@ -512,11 +697,6 @@ func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (a *App) removeSharedNoteHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
-
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -526,24 +706,37 @@ func (a *App) removeSharedNoteHandler(w http.ResponseWriter, r *http.Request) {
     noteID := r.FormValue("noteID")
 	username := r.FormValue("username")
 
+    id, err := strconv.Atoi(noteID)
+    if err != nil {
+        http.Error(w, "Invalid noteID", http.StatusBadRequest)
+        return
+    }
+
+    // Users may remove a note shared with themselves, otherwise only the owner may stop sharing
+    currentUser := currentUsername(r)
+    action := noteActionShare
+    if username == currentUser {
+        action = noteActionRead
+    }
+    if err := a.authorizeNote(r.Context(), currentUser, id, action); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
+
     // Implement the logic to remove the shared note from the user_shares table
-    err := a.removeSharedNoteFromUser(username, noteID)
+    err = a.removeSharedNoteFromUser(username, noteID)
     if err != nil {
         // Handle the error appropriately (e.g., log it or show an error page)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
+    a.audit(r, AuditEvent{Action: auditUnshare, NoteID: id, Target: username})
 
     // Redirect the user to a success page or back to the list of shared notes
     http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
 func (a *App) removeDelegationHandler(w http.ResponseWriter, r *http.Request) {
-    if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-    }
-
 	vars := mux.Vars(r)
     noteIDStr, ok := vars["noteID"]
     if !ok {
@@ -557,34 +750,54 @@ func (a *App) removeDelegationHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Only the owner or the delegated user may remove a delegation
+    if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionRemoveDelegation); err != nil {
+        respondWithError(w, noteAuthStatus(err), err.Error())
+        return
+    }
+
     // Call the database function to remove delegation
-    if err := a.RemoveDelegation(noteID); // Replace with your actual DB function
+    if err := a.RemoveDelegation(noteID, currentUsername(r)); // Replace with your actual DB function
     err != nil {
         respondWithError(w, http.StatusInternalServerError, err.Error())
         return
     }
+    a.audit(r, AuditEvent{Action: auditRemoveDelegation, NoteID: noteID})
 
     respondWithJSON(w, http.StatusOK, map[string]string{"message": "Delegation removed successfully"})
 }
 
 
 func (a *App) updatePrivilegesHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
     // Parse the POST data to retrieve the selected username and updated privileges
     r.ParseForm()
     selectedUsername := r.Form.Get("username")
     updatedPrivileges := r.Form.Get("privileges")
     noteID := r.Form.Get("noteID")
 
+    id, err := strconv.Atoi(noteID)
+    if err != nil {
+        http.Error(w, "Invalid noteID", http.StatusBadRequest)
+        return
+    }
+
+    // Only the owner may change the privileges of a shared note
+    if err := a.authorizeNote(r.Context(), currentUsername(r), id, noteActionShare); err != nil {
+        respondWithNoteAuthError(w, err)
+        return
+    }
+
     // Perform the database update to change privileges for the selected user and noteID
-    err := a.updateUserPrivileges(selectedUsername, updatedPrivileges, noteID)
+    err = a.updateUserPrivileges(selectedUsername, updatedPrivileges, noteID)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Note is not shared with this user", http.StatusNotFound)
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to update privileges: "+err.Error(), http.StatusInternalServerError)
         return
     }
+    a.audit(r, AuditEvent{Action: auditUpdatePrivileges, NoteID: id, Target: selectedUsername, Details: updatedPrivileges})
 
     // Redirect back to the list page after successfully updating privileges
 	// Somehow add user feedback
@@ -592,10 +805,6 @@ func (a *App) updatePrivilegesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
     vars := mux.Vars(r)
     noteIDStr, ok := vars["noteID"]
     if !ok {
@@ -609,6 +818,12 @@ func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+	// Only users who can see the note may search in it
+	if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionRead); err != nil {
+		respondWithNoteAuthError(w, err)
+		return
+	}
+
 	searchPattern := r.FormValue("searchInput")
 
 
@@ -639,10 +854,6 @@ func (a *App) findInNoteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_AUTH") != "1" {
-        // Perform authentication checks only if the environment variable is not set
-        a.isAuthenticated(w, r)
-	}
 	http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
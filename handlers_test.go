@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 
 	"net/http"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/mux"
+	"github.com/icza/session"
 	"github.com/stretchr/testify/mock"
 	// Import other necessary packages for your tests
 )
@@ -28,6 +30,105 @@ func (m *MockSession) Get(key string) interface{} {
     return args.Get(0)
 }
 
+// testCSRFToken is the CSRF token of the sessions created by loginRequest.
+const testCSRFToken = "test-csrf-token"
+
+// loginRequest attaches a session cookie for username and its CSRF token to
+// the request and stores the username in its context, as requireAuth would.
+func loginRequest(req *http.Request, username string) *http.Request {
+	if session.Global == nil {
+		session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	}
+
+	sess := session.NewSessionOptions(&session.SessOptions{
+		CAttrs: map[string]interface{}{"username": username},
+		Attrs:  map[string]interface{}{"count": 1, csrfTokenAttr: testCSRFToken},
+	})
+	rr := httptest.NewRecorder()
+	session.Add(sess, rr)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	req.Header.Set(csrfHeaderName, testCSRFToken)
+
+	return req.WithContext(context.WithValue(req.Context(), usernameKey, username))
+}
+
+// expectActiveUser expects the check of requireAuth that the user of the
+// session still exists and is not disabled.
+func expectActiveUser(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectQuery("SELECT disabled_at IS NULL FROM users").WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+}
+
+func TestRequireAuth(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	// The wrapped handler echoes the username found in the request context
+	handler := a.requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(currentUsername(r)))
+	}))
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		username     string
+		account      string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{name: "browser without session", path: "/list", wantStatus: http.StatusSeeOther, wantLocation: "/login"},
+		{name: "ajax without session", path: "/find/1", accept: "application/json", wantStatus: http.StatusUnauthorized},
+		{name: "api without session", path: "/api/v1/notes", wantStatus: http.StatusUnauthorized},
+		{name: "authenticated", path: "/list", username: "mydog7", account: "active", wantStatus: http.StatusOK, wantBody: "mydog7"},
+		{name: "disabled user", path: "/list", username: "BIGCAT", account: "disabled", wantStatus: http.StatusSeeOther, wantLocation: "/login"},
+		{name: "deleted user", path: "/api/v1/notes", username: "gone", account: "deleted", wantStatus: http.StatusUnauthorized},
+	}
+
+	os.Unsetenv("DISABLE_AUTH")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.username != "" {
+				// Only the session cookie is kept, the middleware must fill the context itself
+				loginRequest(req, tt.username)
+
+				rows := sqlmock.NewRows([]string{"active"})
+				if tt.account != "deleted" {
+					rows.AddRow(tt.account == "active")
+				}
+				mock.ExpectQuery("SELECT disabled_at IS NULL FROM users").WithArgs(tt.username).WillReturnRows(rows)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, tt.wantStatus)
+			}
+			if location := rr.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Expected redirect to %q, but got %q", tt.wantLocation, location)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %q, but got %q", tt.wantBody, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
 
 func TestListHandler(t *testing.T) {
     // Create a new instance of your application
@@ -244,6 +345,8 @@ func TestUpdateHandler(t *testing.T) {
 
     req := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
     req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    // Note 1 of the demo data is owned by mydog7
+    req = loginRequest(req, "mydog7")
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -274,6 +377,8 @@ func TestDeleteHandler(t *testing.T) {
 
 	req := httptest.NewRequest("POST", "/delete", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Note 1 of the demo data is owned by mydog7
+	req = loginRequest(req, "mydog7")
 
 	// Create a ResponseRecorder to capture the response
 	rr := httptest.NewRecorder()
@@ -307,6 +412,8 @@ func TestUpdatePrivilegesHandler(t *testing.T) {
     body := strings.NewReader(form.Encode())
     req := httptest.NewRequest("POST", "/update-privileges", body)
     req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    // Note 1 of the demo data is owned by mydog7
+    req = loginRequest(req, "mydog7")
 
     // Create a ResponseRecorder to capture the response
     rr := httptest.NewRecorder()
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapConn is the part of *ldap.Conn used to authenticate, so that tests
+// can use a directory stand-in.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ldapAuthenticator checks passwords by binding as the user's entry in an
+// LDAP directory, and creates users the first time they log in.
+type ldapAuthenticator struct {
+	cfg  LDAPConfig
+	db   *sql.DB
+	dial func() (ldapConn, error)
+}
+
+// newLDAPAuthenticator creates an authenticator for the configured directory.
+func newLDAPAuthenticator(cfg LDAPConfig, db *sql.DB) *ldapAuthenticator {
+	l := &ldapAuthenticator{cfg: cfg, db: db}
+	l.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: cfg.Timeout}))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(cfg.Timeout)
+
+		if cfg.StartTLS {
+			u, _ := url.Parse(cfg.URL)
+			if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return l
+}
+
+func (l *ldapAuthenticator) Authenticate(username, password string) (string, error) {
+	// An empty password would be an unauthenticated bind, which many servers accept
+	if username == "" || password == "" {
+		return "", errBadCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return "", fmt.Errorf("connecting to LDAP: %v", err)
+	}
+	defer conn.Close()
+
+	if l.cfg.BindDN != "" {
+		if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			return "", fmt.Errorf("LDAP service bind: %v", err)
+		}
+	}
+
+	attributes := []string{"dn", l.cfg.UsernameAttribute}
+	if l.cfg.EmailAttribute != "" {
+		attributes = append(attributes, l.cfg.EmailAttribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.ReplaceAll(l.cfg.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		attributes, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf("LDAP user search: %v", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return "", errBadCredentials
+	}
+	entry := result.Entries[0]
+
+	// Group membership is checked with the service account, as users may
+	// not be allowed to search groups
+	if l.cfg.GroupFilter != "" {
+		filter := strings.NewReplacer(
+			"{dn}", ldap.EscapeFilter(entry.DN),
+			"{username}", ldap.EscapeFilter(username),
+		).Replace(l.cfg.GroupFilter)
+		groups, err := conn.Search(ldap.NewSearchRequest(
+			l.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 0, false,
+			filter, []string{"dn"}, nil))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return "", fmt.Errorf("LDAP group search: %v", err)
+		}
+		if groups == nil || len(groups.Entries) == 0 {
+			log.Printf("LDAP user %s is not in the required group", username)
+			return "", errBadCredentials
+		}
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", errBadCredentials
+		}
+		return "", fmt.Errorf("LDAP user bind: %v", err)
+	}
+
+	name := entry.GetAttributeValue(l.cfg.UsernameAttribute)
+	if name == "" {
+		name = username
+	}
+	if len(name) > 50 {
+		return "", fmt.Errorf("LDAP username %q is longer than 50 bytes", name)
+	}
+
+	var email string
+	if l.cfg.EmailAttribute != "" {
+		email, _ = normalizeEmail(entry.GetAttributeValue(l.cfg.EmailAttribute))
+	}
+	if err := provisionUser(l.db, name, email); err == errLocalUser {
+		log.Printf("LDAP user %s not logged in: %v", name, err)
+		return "", errBadCredentials
+	} else if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// errLocalUser is returned by provisionUser when a user with a local
+// password already has the username.
+var errLocalUser = errors.New("the username belongs to a user with a local password")
+
+// provisionUser creates a user without a password, for users whose password
+// is checked elsewhere, unless the username exists already. A directory
+// entry never takes over a user with a local password, which returns
+// errLocalUser. The email address is only kept when no other user has it.
+func provisionUser(db *sql.DB, username, email string) error {
+	var password string
+	err := db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&password)
+	if err == nil {
+		if password != "" {
+			return errLocalUser
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if email != "" {
+		var taken bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))", email).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			email = ""
+		}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO users (username, password, email) VALUES ($1, '', $2)
+		ON CONFLICT (username) DO NOTHING`, username, sql.NullString{String: email, Valid: email != ""})
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 1 {
+		log.Printf("Created user %s from LDAP", username)
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeDirectory is an in-process LDAP stand-in. Its search understands
+// filters made of equality assertions, all of which must match.
+type fakeDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+	bound     string
+}
+
+var filterAssertion = regexp.MustCompile(`\(([A-Za-z]+)=([^()]*)\)`)
+
+func (d *fakeDirectory) Bind(dn, password string) error {
+	if want, ok := d.passwords[dn]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+	}
+	d.bound = dn
+	return nil
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	for _, entry := range d.entries {
+		if !strings.HasSuffix(entry.DN, req.BaseDN) {
+			continue
+		}
+
+		match := true
+		for _, m := range filterAssertion.FindAllStringSubmatch(req.Filter, -1) {
+			found := false
+			for _, v := range entry.GetAttributeValues(m[1]) {
+				// The stand-in only needs to undo the escaping of backslashes and parentheses
+				want := strings.NewReplacer(`\5c`, `\`, `\28`, `(`, `\29`, `)`, `\2a`, `*`).Replace(m[2])
+				if strings.EqualFold(v, want) {
+					found = true
+				}
+			}
+			match = match && found
+		}
+		if match {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeDirectory) Close() error { return nil }
+
+func newTestDirectory() *fakeDirectory {
+	jane := "uid=jane,ou=people,dc=example,dc=com"
+	bob := "uid=bob,ou=people,dc=example,dc=com"
+	return &fakeDirectory{
+		entries: []*ldap.Entry{
+			ldap.NewEntry(jane, map[string][]string{"objectClass": {"person"}, "uid": {"jane"}, "mail": {"jane@example.com"}}),
+			ldap.NewEntry(bob, map[string][]string{"objectClass": {"person"}, "uid": {"bob"}}),
+			ldap.NewEntry("cn=notes,ou=groups,dc=example,dc=com", map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"notes"}, "member": {jane}}),
+		},
+		passwords: map[string]string{
+			"cn=service,dc=example,dc=com": "service secret",
+			jane:                           "jane's password",
+			bob:                            "bob's password",
+		},
+	}
+}
+
+func newTestLDAPAuthenticator(t *testing.T, dir *fakeDirectory) (*ldapAuthenticator, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := defaultConfig().LDAP
+	cfg.URL = "ldap://directory.example.com"
+	cfg.BindDN = "cn=service,dc=example,dc=com"
+	cfg.BindPassword = "service secret"
+	cfg.BaseDN = "ou=people,dc=example,dc=com"
+	cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	cfg.GroupFilter = "(&(objectClass=groupOfNames)(cn=notes)(member={dn}))"
+
+	auth := newLDAPAuthenticator(cfg, db)
+	auth.dial = func() (ldapConn, error) { return dir, nil }
+	return auth, mock
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	dir := newTestDirectory()
+	auth, mock := newTestLDAPAuthenticator(t, dir)
+
+	// The first login creates the user
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane").WillReturnRows(sqlmock.NewRows([]string{"password"}))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO users").WithArgs("jane", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	name, err := auth.Authenticate("JANE", "jane's password")
+	if err != nil || name != "jane" {
+		t.Errorf("Expected jane to log in, but got %q, %v", name, err)
+	}
+	if dir.bound != "uid=jane,ou=people,dc=example,dc=com" {
+		t.Errorf("Expected a bind as the user, but the last bind was %q", dir.bound)
+	}
+
+	tests := []struct {
+		name, username, password string
+	}{
+		{"wrong password", "jane", "wrong"},
+		{"empty password", "jane", ""},
+		{"unknown user", "nobody", "jane's password"},
+		{"not in the group", "bob", "bob's password"},
+		{"filter injection", "*", "jane's password"},
+	}
+	for _, tt := range tests {
+		if _, err := auth.Authenticate(tt.username, tt.password); err != errBadCredentials {
+			t.Errorf("%s: expected errBadCredentials, but got %v", tt.name, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLDAPAuthenticator_ExistingUsers(t *testing.T) {
+	dir := newTestDirectory()
+	auth, mock := newTestLDAPAuthenticator(t, dir)
+
+	// A user created by an earlier LDAP login has no password
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(""))
+	if name, err := auth.Authenticate("jane", "jane's password"); err != nil || name != "jane" {
+		t.Errorf("Expected jane to log in, but got %q, %v", name, err)
+	}
+
+	// A local user with the same name is not taken over by the directory
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("$2a$10$hash"))
+	if _, err := auth.Authenticate("jane", "jane's password"); err != errBadCredentials {
+		t.Errorf("Expected errBadCredentials for a local user, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuthenticatorChain_LocalFallback(t *testing.T) {
+	dir := newTestDirectory()
+	ldapAuth, mock := newTestLDAPAuthenticator(t, dir)
+	chain := authenticatorChain{ldapAuth, &localAuthenticator{db: ldapAuth.db}}
+
+	// A user only known locally, such as a bootstrap administrator
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}))
+
+	if _, err := chain.Authenticate("nobody", "secret"); err != errBadCredentials {
+		t.Errorf("Expected errBadCredentials, but got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuthenticatorChain_DirectoryDown(t *testing.T) {
+	ldapAuth, mock := newTestLDAPAuthenticator(t, newTestDirectory())
+	ldapAuth.dial = func() (ldapConn, error) { return nil, errors.New("connection refused") }
+	chain := authenticatorChain{ldapAuth, &localAuthenticator{db: ldapAuth.db}}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}).AddRow("admin", string(hash)))
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}).AddRow("admin", string(hash)))
+
+	// Local users can still log in while the directory is down
+	if name, err := chain.Authenticate("admin", "secret"); err != nil || name != "admin" {
+		t.Errorf("Expected admin to log in, but got %q, %v", name, err)
+	}
+	// Other logins fail with the directory's error rather than as bad credentials
+	if _, err := chain.Authenticate("admin", "wrong"); err == nil || err == errBadCredentials {
+		t.Errorf("Expected the directory error, but got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginHandler_UsesAuthenticator(t *testing.T) {
+	dir := newTestDirectory()
+	ldapAuth, mock := newTestLDAPAuthenticator(t, dir)
+	a := App{db: ldapAuth.db, authenticator: ldapAuth}
+	if session.Global == nil {
+		session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	}
+
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane").WillReturnRows(sqlmock.NewRows([]string{"password"}))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM login_failures").WithArgs(loginFailureUser, "JANE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("jane").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL FROM users").WithArgs("jane").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	expectAudit(mock, "jane", auditLogin, 0, "", "password")
+
+	// The failures of the username as typed are cleared
+	rr, message := postLogin(&a, "JANE", "jane's password")
+	if rr.Header().Get("Location") != "/list" {
+		t.Errorf("Expected jane to be logged in, but got %q %q", rr.Header().Get("Location"), message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
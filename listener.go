@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// listenAddr is a parsed listen address.
+type listenAddr struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Systemd bool
+}
+
+// parseListenAddr interprets the configured listen address. A bare host such
+// as 0.0.0.0 or 127.0.0.1 is combined with port, and an empty address listens
+// on port on all interfaces.
+func parseListenAddr(addr, port string) (listenAddr, error) {
+	switch {
+	case addr == "":
+		return listenAddr{Network: "tcp", Address: ":" + port}, nil
+	case addr == "systemd":
+		return listenAddr{Systemd: true}, nil
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		if path == "" {
+			return listenAddr{}, errors.New("listen address unix: needs a socket path")
+		}
+		return listenAddr{Network: "unix", Address: path}, nil
+	case strings.HasPrefix(addr, "/"):
+		return listenAddr{Network: "unix", Address: addr}, nil
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port given, so addr is only the host
+		host, p = strings.Trim(addr, "[]"), port
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return listenAddr{}, fmt.Errorf("listen address %q has an invalid port", addr)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, ":/ ") {
+		return listenAddr{}, fmt.Errorf("listen address %q has an invalid host", addr)
+	}
+
+	return listenAddr{Network: "tcp", Address: net.JoinHostPort(host, p)}, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// or none when the process was not started that way.
+func systemdListeners(pid int, lookupEnv func(string) (string, bool)) ([]net.Listener, error) {
+	listenPID, ok := lookupEnv("LISTEN_PID")
+	if !ok || listenPID != strconv.Itoa(pid) {
+		return nil, nil
+	}
+
+	value, _ := lookupEnv("LISTEN_FDS")
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", value)
+	}
+
+	names, _ := lookupEnv("LISTEN_FDNAMES")
+	fdNames := strings.Split(names, ":")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(sdListenFDsStart+i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s: %v", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket, replacing a stale socket file left by
+// a previous run but not one that another process is still serving.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// listen opens the sockets the HTTP server is served on. Sockets passed by
+// systemd are used when listen is "systemd", or when no address is configured.
+func (a *App) listen(listen, port string) ([]net.Listener, error) {
+	spec, err := parseListenAddr(listen, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Systemd || listen == "" {
+		listeners, err := systemdListeners(os.Getpid(), os.LookupEnv)
+		if err != nil {
+			return nil, err
+		}
+		// The sockets must not be passed on to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if len(listeners) > 0 {
+			return listeners, nil
+		}
+		if spec.Systemd {
+			return nil, errors.New("listen address is systemd, but no sockets were passed by systemd")
+		}
+	}
+
+	if spec.Network == "unix" {
+		ln, err := listenUnix(spec.Address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	ln, err := net.Listen(spec.Network, spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// logListener logs where the server can be reached on ln. For a wildcard
+// address the outbound IP is shown when there is a route to the Internet.
+func logListener(scheme string, ln net.Listener) {
+	tcpAddr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		log.Printf("Starting %s service on %s socket %s", strings.ToUpper(scheme), ln.Addr().Network(), ln.Addr())
+		return
+	}
+
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		host = "localhost"
+		if ip, err := GetOutboundIP(); err == nil {
+			host = ip
+		}
+		log.Printf("Listening on all interfaces, port %d", tcpAddr.Port)
+	}
+
+	log.Printf("Starting %s service on %s://%s", strings.ToUpper(scheme), scheme, net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want listenAddr
+	}{
+		{"", listenAddr{Network: "tcp", Address: ":8080"}},
+		{"0.0.0.0", listenAddr{Network: "tcp", Address: "0.0.0.0:8080"}},
+		{"127.0.0.1:9000", listenAddr{Network: "tcp", Address: "127.0.0.1:9000"}},
+		{"::1", listenAddr{Network: "tcp", Address: "[::1]:8080"}},
+		{"[::]:9000", listenAddr{Network: "tcp", Address: "[::]:9000"}},
+		{"localhost", listenAddr{Network: "tcp", Address: "localhost:8080"}},
+		{"unix:/run/notes.sock", listenAddr{Network: "unix", Address: "/run/notes.sock"}},
+		{"/run/notes.sock", listenAddr{Network: "unix", Address: "/run/notes.sock"}},
+		{"systemd", listenAddr{Systemd: true}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseListenAddr(tt.addr, "8080")
+		if err != nil {
+			t.Errorf("%q: expected no error, but got %v", tt.addr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, addr := range []string{"unix:", "127.0.0.1:http", "127.0.0.1:70000"} {
+		if _, err := parseListenAddr(addr, "8080"); err == nil {
+			t.Errorf("%q: expected an error, but got none", addr)
+		}
+	}
+}
+
+func TestSystemdListeners_NotActivated(t *testing.T) {
+	// Sockets meant for another process must be ignored
+	env := envMap(map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"})
+
+	listeners, err := systemdListeners(os.Getpid()+1, env)
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Expected no listeners, but got %v, %v", listeners, err)
+	}
+
+	env = envMap(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "none"})
+	if _, err := systemdListeners(42, env); err == nil {
+		t.Errorf("Expected an error for invalid LISTEN_FDS, but got none")
+	}
+}
+
+func TestListenUnix_ReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.sock")
+
+	// Leave a socket file behind without anyone serving it
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, but got %v", err)
+	}
+	defer ln.Close()
+
+	// A socket that is being served must not be taken over
+	if _, err := listenUnix(path); err == nil {
+		t.Errorf("Expected an error for a socket in use, but got none")
+	}
+}
+
+func TestListen_LoopbackWithoutRoute(t *testing.T) {
+	a := App{}
+
+	listeners, err := a.listen("127.0.0.1:0", "8080")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer listeners[0].Close()
+
+	addr := listeners[0].Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Errorf("Expected a loopback listener, but got %s", addr)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Kinds of login failure records.
+const (
+	loginFailureUser = "user"
+	loginFailureIP   = "ip"
+)
+
+// Messages shown on the login page. Wrong usernames and wrong passwords get
+// the same message, so that the page does not reveal which accounts exist.
+const (
+	msgInvalidLogin = "Invalid username or password."
+	msgLockedOut    = "Too many failed login attempts. Please try again later."
+	msgDisabled     = "This account has been disabled."
+)
+
+var (
+	// errLoginLocked is returned when attempts for a username or address are refused.
+	errLoginLocked = errors.New("too many failed login attempts")
+
+	// errAccountDisabled is returned for the right password of a disabled user.
+	errAccountDisabled = errors.New("account disabled")
+)
+
+// dummyPasswordHash is compared against when the username does not exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// LoginLockout is a username or client address whose login attempts are being refused.
+type LoginLockout struct {
+	Kind          string    `json:"kind"`
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// loginConfig returns the login protection settings.
+func (a *App) loginConfig() LoginConfig {
+	if a.config == nil {
+		return defaultConfig().Login
+	}
+	return a.config.Login
+}
+
+// lockoutDuration returns how long to refuse attempts after failures failed
+// logins, or 0 while failures is below maxFailures. The lockout doubles with
+// every failure past the limit, up to cfg.LockoutMax.
+func lockoutDuration(cfg LoginConfig, failures, maxFailures int) time.Duration {
+	if failures < maxFailures {
+		return 0
+	}
+
+	lockout := cfg.LockoutBase
+	for i := maxFailures; i < failures && lockout < cfg.LockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > cfg.LockoutMax {
+		lockout = cfg.LockoutMax
+	}
+
+	return lockout
+}
+
+// checkLoginAllowed returns errLoginLocked when the username or the client
+// address is locked out.
+func (a *App) checkLoginAllowed(username, ip string) error {
+	var locked bool
+	err := a.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM login_failures
+			WHERE ((kind = $1 AND key = $2) OR (kind = $3 AND key = $4)) AND locked_until > $5
+		)`, loginFailureUser, truncate(username, 255), loginFailureIP, ip, time.Now().UTC()).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return errLoginLocked
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failed login for the username and the client
+// address, locking them out once they pass their limits.
+func (a *App) recordLoginFailure(username, ip string) error {
+	cfg := a.loginConfig()
+
+	if err := a.recordFailure(loginFailureUser, truncate(username, 255), cfg, cfg.MaxFailures); err != nil {
+		return err
+	}
+	return a.recordFailure(loginFailureIP, ip, cfg, cfg.MaxIPFailures)
+}
+
+// recordFailure counts one failure for a key, forgetting failures older than
+// the failure window, and sets its lockout.
+func (a *App) recordFailure(kind, key string, cfg LoginConfig, maxFailures int) error {
+	now := time.Now().UTC()
+
+	var failures int
+	err := a.db.QueryRow(`
+		INSERT INTO login_failures (kind, key, failures, last_failure_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (kind, key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $4 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = $3
+		RETURNING failures`, kind, key, now, now.Add(-cfg.FailureWindow)).Scan(&failures)
+	if err != nil {
+		return err
+	}
+
+	lockout := lockoutDuration(cfg, failures, maxFailures)
+	if lockout == 0 {
+		return nil
+	}
+
+	_, err = a.db.Exec("UPDATE login_failures SET locked_until = $3 WHERE kind = $1 AND key = $2",
+		kind, key, now.Add(lockout))
+	return err
+}
+
+// clearLoginFailures forgets the failed logins of a username after a successful login.
+// The failures of the client address are kept, so that an attacker with one
+// valid account cannot reset them.
+func (a *App) clearLoginFailures(username string) error {
+	_, err := a.db.Exec("DELETE FROM login_failures WHERE kind = $1 AND key = $2", loginFailureUser, truncate(username, 255))
+	return err
+}
+
+// authenticateUser checks a username and password with the configured
+// authenticator, applying the login protection. It returns errLoginLocked
+// while attempts are refused, sql.ErrNoRows for a wrong username or password
+// and errAccountDisabled for a disabled user.
+func (a *App) authenticateUser(username, password, ip string) (User, error) {
+	if err := a.checkLoginAllowed(username, ip); err != nil {
+		return User{}, err
+	}
+
+	name, err := a.getAuthenticator().Authenticate(username, password)
+	if err == errBadCredentials {
+		if err := a.recordLoginFailure(username, ip); err != nil {
+			return User{}, err
+		}
+		return User{}, sql.ErrNoRows
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	// Failures are counted under the username as typed, which the
+	// authenticator may have changed, for example to another case
+	if err := a.clearLoginFailures(username); err != nil {
+		return User{}, err
+	}
+
+	if disabled, err := a.userDisabled(name); err != nil {
+		return User{}, err
+	} else if disabled {
+		return User{}, errAccountDisabled
+	}
+
+	return User{Username: name}, nil
+}
+
+// userDisabled reports whether an administrator has disabled username.
+func (a *App) userDisabled(username string) (bool, error) {
+	var disabled bool
+	err := a.db.QueryRow("SELECT disabled_at IS NOT NULL FROM users WHERE username = $1", username).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return disabled, err
+}
+
+// listLoginLockouts returns the usernames and addresses currently locked out.
+func (a *App) listLoginLockouts() ([]LoginLockout, error) {
+	rows, err := a.db.Query(`
+		SELECT kind, key, failures, last_failure_at, locked_until
+		FROM login_failures WHERE locked_until > $1
+		ORDER BY locked_until DESC`, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []LoginLockout{}
+	for rows.Next() {
+		var l LoginLockout
+		if err := rows.Scan(&l.Kind, &l.Key, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	return lockouts, rows.Err()
+}
+
+// unlockLogin removes the lockout and failure count of a username or address.
+func (a *App) unlockLogin(kind, key string) error {
+	result, err := a.db.Exec("DELETE FROM login_failures WHERE kind = $1 AND key = $2", kind, key)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
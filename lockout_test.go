@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	cfg := LoginConfig{LockoutBase: time.Minute, LockoutMax: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{4, 0},
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{8, 8 * time.Minute},
+		{9, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutDuration(cfg, tt.failures, 5); got != tt.want {
+			t.Errorf("%d failures: got %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// postLogin submits the login form and returns the message shown afterwards.
+func postLogin(a *App, username, password string) (*httptest.ResponseRecorder, string) {
+	form := url.Values{"usrname": {username}, "psw": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	a.loginHandler(rr, req)
+
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "message" {
+			return rr, c.Value
+		}
+	}
+	return rr, ""
+}
+
+func TestLoginHandler_UniformFailureMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+
+	expectFailure := func(username string) {
+		mock.ExpectQuery("INSERT INTO login_failures").
+			WithArgs(loginFailureUser, username, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+		mock.ExpectQuery("INSERT INTO login_failures").
+			WithArgs(loginFailureIP, "192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	}
+
+	// Unknown user
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}))
+	expectFailure("nobody")
+	_, unknownUser := postLogin(&a, "nobody", "admin")
+
+	// Known user, wrong password
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}).AddRow("mydog7", string(hash)))
+	expectFailure("mydog7")
+	_, wrongPassword := postLogin(&a, "mydog7", "wrong")
+
+	if unknownUser != msgInvalidLogin || wrongPassword != msgInvalidLogin {
+		t.Errorf("Expected the same message, but got %q and %q", unknownUser, wrongPassword)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginHandler_LockedOut(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	// The password is not checked while the account is locked
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(loginFailureUser, "mydog7", loginFailureIP, "192.0.2.1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	rr, message := postLogin(&a, "mydog7", "admin")
+
+	if message != msgLockedOut {
+		t.Errorf("Expected the lockout message, but got %q", message)
+	}
+	if rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a redirect to the login page, but got %q", rr.Header().Get("Location"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecordFailure_LocksAfterLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	mock.ExpectQuery("INSERT INTO login_failures").
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(5))
+	mock.ExpectExec("UPDATE login_failures SET locked_until").
+		WithArgs(loginFailureUser, "mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := a.recordFailure(loginFailureUser, "mydog7", defaultConfig().Login, 5); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUnlockLogin_AdminOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	a.config = defaultConfig()
+	a.config.Admins = []string{"mydog7"}
+
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery("SELECT role").WithArgs("BIGCAT", roleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(false))
+
+	req := loginRequest(httptest.NewRequest("DELETE", "/api/v1/admin/lockouts/user/BIGCAT", nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for a non-admin, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectExec("DELETE FROM login_failures").
+		WithArgs(loginFailureUser, "BIGCAT").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req = loginRequest(httptest.NewRequest("DELETE", "/api/v1/admin/lockouts/user/BIGCAT", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d for an admin, but got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
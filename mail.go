@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MailMessage is a plain text email.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users.
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+// newMailer creates the mailer selected by the configuration.
+func newMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return &smtpMailer{
+			addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			host:     cfg.SMTPHost,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+			from:     cfg.From,
+		}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("creating mail directory: %v", err)
+		}
+		return &fileMailer{dir: cfg.Dir, from: cfg.From}, nil
+	case "log", "":
+		return &logMailer{from: cfg.From}, nil
+	}
+
+	return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+}
+
+// formatMail renders a message with its headers, ready to be sent.
+func formatMail(from string, msg MailMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// smtpMailer sends emails through an SMTP server. net/smtp upgrades the
+// connection with STARTTLS when the server offers it.
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(msg MailMessage) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, formatMail(m.from, msg))
+}
+
+// fileMailer writes every email to its own file in dir, for development and tests.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(msg MailMessage) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.dir, name), formatMail(m.from, msg), 0600)
+}
+
+// logMailer writes emails to the log instead of sending them.
+type logMailer struct {
+	from string
+}
+
+func (m *logMailer) Send(msg MailMessage) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
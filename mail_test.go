@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer_WritesMessage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer, err := newMailer(MailConfig{Driver: "file", Dir: dir, From: "notes@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	msg := MailMessage{To: "mydog7@example.com", Subject: "Hello", Body: "First line\nSecond line\n"}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message file, but got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, want := range []string{"From: notes@example.com\r\n", "To: mydog7@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nFirst line\r\nSecond line\r\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected the message to contain %q, but got %q", want, data)
+		}
+	}
+}
+
+func TestNewMailer_UnknownDriver(t *testing.T) {
+	if _, err := newMailer(MailConfig{Driver: "pigeon"}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
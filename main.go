@@ -1,7 +1,73 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const usage = `Usage:
+  notes [flags]                             start the web server
+  notes [flags] migrate [up|down [N]|status] apply, revert or list schema migrations
+  notes [flags] seed                        import the demo users and notes into an empty database
+
+Run "notes -h" to list the flags. The database password can only be set in the
+config file or with NOTES_DB_PASSWORD / DATABASE_URL.`
+
 func main() {
-	a := App{}
+	cfg, args, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println(usage)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	a := App{config: cfg}
+
+	if len(args) > 0 {
+		a.runCommand(args[0], args[1:])
+		return
+	}
+
 	a.Initialize()
 	a.Run("")
 }
+
+// runCommand runs one of the maintenance subcommands and exits.
+func (a *App) runCommand(command string, args []string) {
+	switch command {
+	case "migrate", "seed":
+	case "help":
+		fmt.Println(usage)
+		return
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	db, err := setupDatabase(a.config.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.db = db
+	defer a.db.Close()
+
+	switch command {
+	case "migrate":
+		err = a.runMigrateCommand(args)
+	case "seed":
+		if err = a.migrateUp(context.Background()); err == nil {
+			err = a.seedDemoData()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// maxDescriptionLength is the longest note description accepted, in bytes.
+const maxDescriptionLength = 65536
+
+// markdown parses note descriptions as CommonMark with the GitHub extensions
+// for tables, task lists, strikethrough and links.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// markdownPolicy removes anything from the rendered HTML that could run
+// scripts or change the page, such as script and style elements, event
+// handlers and javascript: links. Besides the user generated content
+// policy it keeps the task list checkboxes and the language of code blocks.
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^(checked|disabled|)$`)).OnElements("input")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+	return p
+}()
+
+// renderMarkdown renders a note description to sanitized HTML.
+func renderMarkdown(source string) template.HTML {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		log.Printf("Error rendering markdown: %v", err)
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	return template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes()))
+}
+
+// renderDescriptions renders the descriptions of the notes.
+func renderDescriptions(notes []Note) {
+	for i := range notes {
+		notes[i].DescriptionHTML = renderMarkdown(notes[i].Description)
+	}
+}
+
+// markdownText returns the text of a note description without the markdown
+// syntax, one line per paragraph, list item, table cell or line of code.
+// Raw HTML is left out. It is what full text search and find look at.
+func markdownText(source string) string {
+	src := []byte(source)
+	doc := markdown.Parser().Parse(text.NewReader(src))
+
+	var buf strings.Builder
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			if n.Type() == ast.TypeBlock {
+				buf.WriteByte('\n')
+			}
+			return ast.WalkContinue, nil
+		}
+
+		switch n := n.(type) {
+		case *ast.Text:
+			buf.Write(n.Segment.Value(src))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				buf.WriteByte('\n')
+			}
+		case *ast.String:
+			buf.Write(n.Value)
+		case *ast.AutoLink:
+			buf.Write(n.URL(src))
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				buf.Write(segment.Value(src))
+			}
+		case *ast.RawHTML, *ast.HTMLBlock:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	source := "# Plan\n\n- [x] Book flights\n- [ ] Pack\n\n| Day | Place |\n| --- | --- |\n| 1 | Rome |\n\n```go\nfmt.Println(\"hi\")\n```\n"
+	html := string(renderMarkdown(source))
+
+	for _, want := range []string{
+		"<h1",
+		`<input checked="" disabled="" type="checkbox"`,
+		`<input disabled="" type="checkbox"`,
+		"<table>",
+		"<td>Rome</td>",
+		`<code class="language-go">`,
+		"fmt.Println(&#34;hi&#34;)",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("Expected %q in %s", want, html)
+		}
+	}
+}
+
+func TestRenderMarkdown_Sanitized(t *testing.T) {
+	tests := []string{
+		"<script>alert(1)</script>",
+		"<style>body { display: none }</style>",
+		"<img src=x onerror=alert(1)>",
+		"[click](javascript:alert(1))",
+		`<a href="#" onclick="alert(1)">link</a>`,
+		"<input type=\"text\" name=\"csrf_token\">",
+	}
+
+	for _, source := range tests {
+		html := strings.ToLower(string(renderMarkdown(source)))
+		for _, bad := range []string{"<script", "<style", "onerror", "onclick", "javascript:", `type="text"`} {
+			if strings.Contains(html, bad) {
+				t.Errorf("Rendering %q kept %q: %s", source, bad, html)
+			}
+		}
+	}
+}
+
+func TestMarkdownText(t *testing.T) {
+	source := "# Trip to *Rome*\n\nSee [the guide](https://example.com) and <b>bold</b>.\n\n- [ ] Pack `bags`\n\n| Day | Place |\n| --- | --- |\n| 1 | Colosseum |\n\n```\nline one\n```\n"
+
+	want := "Trip to Rome\nSee the guide and bold.\nPack bags\nDay\nPlace\n1\nColosseum\nline one"
+	if got := markdownText(source); got != want {
+		t.Errorf("Expected %q, but got %q", want, got)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating, so that
+// several instances starting at once do not apply the same migration twice.
+const migrationLockID = 727274
+
+// migrationFileName matches files such as 0002_api_tokens.up.sql.
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migration is one versioned schema change with its up and down SQL.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrationStatus describes whether a migration has been applied.
+type migrationStatus struct {
+	migration
+	AppliedAt sql.NullTime
+}
+
+// loadMigrations reads the migrations from fsys, ordered by version.
+// Every version needs both an up and a down file.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected file in migrations: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration lock.
+func (a *App) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// appliedMigrations returns the applied versions and when they were applied.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// runMigration executes one migration and records it, in a single transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script := m.Down
+	record := "DELETE FROM schema_migrations WHERE version = $1"
+	args := []interface{}{m.Version}
+	if up {
+		script = m.Up
+		record = "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+		args = append(args, m.Name)
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %04d_%s failed: %v", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in version order.
+func (a *App) migrateUp(ctx context.Context) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	return a.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			log.Printf("Applying migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrateDown reverts the most recently applied migrations, steps at a time.
+func (a *App) migrateDown(ctx context.Context, steps int) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	return a.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			log.Printf("Reverting migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// migrationStatuses lists every known migration and whether it has been applied.
+func (a *App) migrationStatuses(ctx context.Context) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	err = a.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			status := migrationStatus{migration: m}
+			if appliedAt, ok := applied[m.Version]; ok {
+				status.AppliedAt = sql.NullTime{Time: appliedAt, Valid: true}
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// runMigrateCommand implements "notes migrate [up|down [N]|status]".
+func (a *App) runMigrateCommand(args []string) error {
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		return a.migrateUp(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		return a.migrateDown(ctx, steps)
+	case "status":
+		statuses, err := a.migrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt.Valid {
+				applied = "applied " + s.AppliedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_second.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"m/0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"m/0001_first.up.sql":    {Data: []byte("CREATE TABLE a ();")},
+		"m/0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+	}
+
+	migrations, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations, but got %d", len(migrations))
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "first" || migrations[1].Version != 2 {
+		t.Errorf("Migrations not ordered by version: %+v", migrations)
+	}
+	if migrations[1].Up != "CREATE TABLE b ();" || migrations[1].Down != "DROP TABLE b;" {
+		t.Errorf("Unexpected SQL for migration 2: %+v", migrations[1])
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"missing down", fstest.MapFS{
+			"m/0001_first.up.sql": {Data: []byte("SELECT 1;")},
+		}},
+		{"bad file name", fstest.MapFS{
+			"m/first.sql": {Data: []byte("SELECT 1;")},
+		}},
+		{"conflicting names", fstest.MapFS{
+			"m/0001_first.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_other.down.sql": {Data: []byte("SELECT 1;")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadMigrations(tt.fsys, "m"); err == nil {
+				t.Errorf("Expected an error, but got none")
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("Embedded migrations are invalid: %v", err)
+	}
+
+	// Versions must be consecutive so that the order is unambiguous
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected migration version %d, but got %04d_%s", i+1, m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrateUp_AppliesPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := App{db: db}
+
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first migration has been applied so far
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	for _, m := range migrations[1:] {
+		mock.ExpectBegin()
+		mock.ExpectExec(".+").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(m.Version, m.Name).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := a.migrateUp(context.Background()); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateDown_RevertsLatest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := App{db: db}
+
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1]
+
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, m := range migrations {
+		rows.AddRow(m.Version, time.Now())
+	}
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec(".+").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(latest.Version).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := a.migrateDown(context.Background(), 1); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,17 @@
+-- Login sessions, shared by every instance of the server.
+-- Only a hash of the session id is stored, the id itself is in the session cookie.
+CREATE TABLE IF NOT EXISTS "sessions" (
+    id_hash CHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    cattrs BYTEA NOT NULL,
+    attrs BYTEA NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    accessed_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS sessions_username_idx ON sessions (username);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);
@@ -0,0 +1,12 @@
+-- Failed login attempts per submitted username ("user") and per client
+-- address ("ip"), with the time until which further attempts are refused.
+-- Usernames are tracked whether or not the account exists, so that a lockout
+-- does not reveal which accounts exist.
+CREATE TABLE IF NOT EXISTS "login_failures" (
+    kind VARCHAR(10) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (kind, key)
+);
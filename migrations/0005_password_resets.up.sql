@@ -0,0 +1,15 @@
+-- Email addresses are optional; they are needed to reset a forgotten password.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (LOWER(email));
+
+-- Single-use password reset tokens. Only a hash of the token is stored,
+-- the token itself is sent to the user by email.
+CREATE TABLE IF NOT EXISTS "password_resets" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
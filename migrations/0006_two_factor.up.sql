@@ -0,0 +1,23 @@
+-- Optional TOTP two-factor authentication. totp_last_step is the last time
+-- step a code was accepted for, so that a code cannot be used twice.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Single-use recovery codes, stored as hashes.
+CREATE TABLE IF NOT EXISTS "recovery_codes" (
+    id SERIAL PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    UNIQUE (username, code_hash),
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- Logins waiting for the second factor, identified by the hash of a cookie.
+CREATE TABLE IF NOT EXISTS "login_challenges" (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
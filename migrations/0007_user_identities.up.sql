@@ -0,0 +1,12 @@
+-- Accounts at single sign-on providers linked to local users.
+CREATE TABLE IF NOT EXISTS "user_identities" (
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_login_at TIMESTAMP,
+    PRIMARY KEY (issuer, subject),
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_username_idx ON user_identities (username);
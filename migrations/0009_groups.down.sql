@@ -0,0 +1,4 @@
+DROP VIEW IF EXISTS effective_shares;
+DROP TABLE IF EXISTS group_shares;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
@@ -0,0 +1,45 @@
+-- Groups of users that notes can be shared with as a whole.
+CREATE TABLE IF NOT EXISTS "groups" (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    owner VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_idx ON groups (LOWER(name));
+
+CREATE TABLE IF NOT EXISTS "group_members" (
+    group_id INTEGER NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    PRIMARY KEY (group_id, username),
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS group_members_username_idx ON group_members (username);
+
+CREATE TABLE IF NOT EXISTS "group_shares" (
+    note_id INTEGER NOT NULL,
+    group_id INTEGER NOT NULL,
+    privileges VARCHAR(20) NOT NULL,
+    PRIMARY KEY (group_id, note_id),
+    FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS group_shares_note_id_idx ON group_shares (note_id);
+
+-- The strongest privileges each user has on a note, directly or through
+-- any of their groups. Membership changes apply immediately.
+CREATE OR REPLACE VIEW effective_shares AS
+SELECT note_id, username,
+    CASE WHEN bool_or(privileges IN ('editor', 'write')) THEN 'editor' ELSE 'viewer' END AS privileges
+FROM (
+    SELECT note_id, username, privileges FROM user_shares
+    UNION ALL
+    SELECT gs.note_id, gm.username, gs.privileges
+    FROM group_shares gs
+    INNER JOIN group_members gm ON gm.group_id = gs.group_id
+) shares
+GROUP BY note_id, username;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS groups_org_name_idx;
+ALTER TABLE groups DROP COLUMN IF EXISTS org_id;
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_idx ON groups (LOWER(name));
+ALTER TABLE users DROP COLUMN IF EXISTS org_id;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,22 @@
+-- Organizations separate the users of one instance. Users only see, share
+-- with and delegate to users of their own organization.
+CREATE TABLE IF NOT EXISTS "organizations" (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS organizations_name_idx ON organizations (LOWER(name));
+
+-- Existing and newly registered users belong to the default organization
+INSERT INTO organizations (id, name) VALUES (1, 'Default') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('organizations', 'id'), (SELECT MAX(id) FROM organizations));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS org_id INTEGER NOT NULL DEFAULT 1 REFERENCES organizations (id);
+CREATE INDEX IF NOT EXISTS users_org_id_idx ON users (org_id);
+
+-- Group names are unique within an organization
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS org_id INTEGER NOT NULL DEFAULT 1 REFERENCES organizations (id);
+UPDATE groups SET org_id = users.org_id FROM users WHERE users.username = groups.owner;
+DROP INDEX IF EXISTS groups_name_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS groups_org_name_idx ON groups (org_id, LOWER(name));
@@ -0,0 +1,24 @@
+-- Every saved version of a note, so edits can be reviewed and undone
+CREATE TABLE IF NOT EXISTS "note_revisions" (
+    id SERIAL PRIMARY KEY,
+    note_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    edited_by VARCHAR(50),
+    edited_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title VARCHAR(255) NOT NULL,
+    noteType VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    taskCompletionTime VARCHAR(255),
+    taskCompletionDate VARCHAR(255),
+    noteStatus VARCHAR(20),
+    noteDelegation VARCHAR(50),
+    UNIQUE (note_id, revision),
+    FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (edited_by) REFERENCES users (username) ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+-- Existing notes start their history with their current content
+INSERT INTO note_revisions (note_id, revision, edited_by, edited_at, title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
+SELECT id, 1, owner, noteCreated, title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation
+FROM notes n
+WHERE NOT EXISTS (SELECT 1 FROM note_revisions r WHERE r.note_id = n.id);
@@ -0,0 +1,4 @@
+-- Notes in the trash were deleted by their owners, so they are not brought back
+DELETE FROM notes WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS notes_deleted_at_idx;
+ALTER TABLE notes DROP COLUMN IF EXISTS deleted_at;
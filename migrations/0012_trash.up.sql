@@ -0,0 +1,3 @@
+-- Deleted notes stay in the trash of their owner until they are purged
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS notes_deleted_at_idx ON notes (deleted_at) WHERE deleted_at IS NOT NULL;
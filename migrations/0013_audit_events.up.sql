@@ -0,0 +1,28 @@
+-- Security-relevant and sharing events, kept for compliance reviews. The
+-- usernames and note IDs are plain values, so events outlive the users and
+-- notes they mention.
+CREATE TABLE IF NOT EXISTS "audit_events" (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP NOT NULL,
+    actor VARCHAR(50) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    note_id INTEGER,
+    target VARCHAR(100),
+    details VARCHAR(255),
+    ip_address VARCHAR(64)
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_occurred_at_idx ON audit_events (occurred_at);
+CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor);
+CREATE INDEX IF NOT EXISTS audit_events_note_id_idx ON audit_events (note_id);
+
+-- Events can be added but never changed or removed
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
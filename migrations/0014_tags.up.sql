@@ -0,0 +1,19 @@
+-- Tags belong to the owner of the notes they label. Names are stored in
+-- lower case and are unique per owner.
+CREATE TABLE IF NOT EXISTS "tags" (
+    id SERIAL PRIMARY KEY,
+    owner VARCHAR(50) NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    UNIQUE (owner, name),
+    FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "note_tags" (
+    note_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (note_id, tag_id),
+    FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS note_tags_tag_id_idx ON note_tags (tag_id);
@@ -0,0 +1,17 @@
+CREATE OR REPLACE VIEW effective_shares AS
+SELECT note_id, username,
+    CASE WHEN bool_or(privileges IN ('editor', 'write')) THEN 'editor' ELSE 'viewer' END AS privileges
+FROM (
+    SELECT note_id, username, privileges FROM user_shares
+    UNION ALL
+    SELECT gs.note_id, gm.username, gs.privileges
+    FROM group_shares gs
+    INNER JOIN group_members gm ON gm.group_id = gs.group_id
+) shares
+GROUP BY note_id, username;
+
+DROP VIEW IF EXISTS notebook_effective_shares;
+DROP VIEW IF EXISTS notebook_ancestors;
+DROP TABLE IF EXISTS notebook_shares;
+ALTER TABLE notes DROP COLUMN IF EXISTS notebook_id;
+DROP TABLE IF EXISTS notebooks;
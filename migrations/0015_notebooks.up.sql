@@ -0,0 +1,67 @@
+-- Notebooks organise the notes of their owner in a tree. Names are unique
+-- among the notebooks with the same parent.
+CREATE TABLE IF NOT EXISTS "notebooks" (
+    id SERIAL PRIMARY KEY,
+    owner VARCHAR(50) NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    parent_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (parent_id) REFERENCES notebooks (id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS notebooks_owner_parent_name_idx ON notebooks (owner, COALESCE(parent_id, 0), LOWER(name));
+CREATE INDEX IF NOT EXISTS notebooks_parent_id_idx ON notebooks (parent_id);
+
+-- Notes of a deleted notebook are kept outside of any notebook
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS notebook_id INTEGER REFERENCES notebooks (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS notes_notebook_id_idx ON notes (notebook_id);
+
+CREATE TABLE IF NOT EXISTS "notebook_shares" (
+    notebook_id INTEGER NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    privileges VARCHAR(20) NOT NULL,
+    PRIMARY KEY (notebook_id, username),
+    FOREIGN KEY (notebook_id) REFERENCES notebooks (id) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS notebook_shares_username_idx ON notebook_shares (username);
+
+-- Every notebook paired with itself and each notebook it is nested in.
+CREATE OR REPLACE VIEW notebook_ancestors AS
+WITH RECURSIVE tree (notebook_id, ancestor_id) AS (
+    SELECT id, id FROM notebooks
+    UNION ALL
+    SELECT tree.notebook_id, nb.parent_id
+    FROM tree
+    INNER JOIN notebooks nb ON nb.id = tree.ancestor_id
+    WHERE nb.parent_id IS NOT NULL
+)
+SELECT notebook_id, ancestor_id FROM tree;
+
+-- The strongest privileges each user has on a notebook, shared directly or
+-- through any notebook it is nested in.
+CREATE OR REPLACE VIEW notebook_effective_shares AS
+SELECT na.notebook_id, ns.username,
+    CASE WHEN bool_or(ns.privileges IN ('editor', 'write')) THEN 'editor' ELSE 'viewer' END AS privileges
+FROM notebook_ancestors na
+INNER JOIN notebook_shares ns ON ns.notebook_id = na.ancestor_id
+GROUP BY na.notebook_id, ns.username;
+
+-- Notes inherit the shares of their notebook
+CREATE OR REPLACE VIEW effective_shares AS
+SELECT note_id, username,
+    CASE WHEN bool_or(privileges IN ('editor', 'write')) THEN 'editor' ELSE 'viewer' END AS privileges
+FROM (
+    SELECT note_id, username, privileges FROM user_shares
+    UNION ALL
+    SELECT gs.note_id, gm.username, gs.privileges
+    FROM group_shares gs
+    INNER JOIN group_members gm ON gm.group_id = gs.group_id
+    UNION ALL
+    SELECT n.id, nes.username, nes.privileges
+    FROM notes n
+    INNER JOIN notebook_effective_shares nes ON nes.notebook_id = n.notebook_id
+) shares
+GROUP BY note_id, username;
@@ -0,0 +1,3 @@
+-- Longer descriptions are cut short.
+ALTER TABLE note_revisions ALTER COLUMN description TYPE VARCHAR(255) USING LEFT(description, 255);
+ALTER TABLE notes ALTER COLUMN description TYPE VARCHAR(255) USING LEFT(description, 255);
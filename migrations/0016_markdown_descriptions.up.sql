@@ -0,0 +1,4 @@
+-- Note descriptions are markdown of any length. The revisions keep the
+-- descriptions in the same type.
+ALTER TABLE notes ALTER COLUMN description TYPE TEXT;
+ALTER TABLE note_revisions ALTER COLUMN description TYPE TEXT;
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/csv"
 	"fmt"
+	"html/template"
 	"log"
 	"os"
 	"time"
@@ -26,6 +27,7 @@ type Note struct {
 	Title              string `json:"title"`
 	NoteType           string `json:"note_type"`
 	Description        string `json:"description"`
+	DescriptionHTML    template.HTML `json:"description_html,omitempty"`
 	NoteCreated        time.Time `json:"note_created"`
 	TaskCompletionTime sql.NullString `json:"task_completion_time"`
 	TaskCompletionDate sql.NullString `json:"task_completion_date"`
@@ -35,6 +37,8 @@ type Note struct {
 	FTSText            sql.NullString `json:"fts_text"`
 	Privileges         string
 	SharedUsers		   []UserShare
+	Tags               []string `json:"tags,omitempty"`
+	NotebookID         int       `json:"notebook_id,omitempty"`
 }
 
 // User represents a user in the application.
@@ -45,6 +49,30 @@ type User struct {
 	
 }
 
+// APIToken represents a personal API token used by non-browser clients.
+// Only a hash of the token is stored, the token itself is shown once on creation.
+type APIToken struct {
+	ID         int          `json:"id"`
+	Username   string       `json:"username"`
+	Name       string       `json:"name"`
+	ReadOnly   bool         `json:"read_only"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  sql.NullTime `json:"expires_at"`
+	LastUsedAt sql.NullTime `json:"last_used_at"`
+}
+
+// UserSession describes an active login session of a user.
+// ID is the hash of the session id, which identifies it without exposing the cookie value.
+type UserSession struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	AccessedAt time.Time `json:"accessed_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
 // SearchResult represents a search result in the application.
 type SearchResult struct {
     Count       int
@@ -77,143 +105,58 @@ func readData(fileName string) ([][]string, error) {
 	return records, nil
 }
 
-// importData initializes the database schema and imports data from CSV files.
-func (a *App) importData() error {
-
-	// Drop foreign key constraints if they exist
-	dropFKConstraintsSQL := `
-	ALTER TABLE IF EXISTS user_shares DROP CONSTRAINT IF EXISTS user_shares_note_id_fkey;
-	ALTER TABLE IF EXISTS user_shares DROP CONSTRAINT IF EXISTS user_shares_username_fkey;
-	ALTER TABLE IF EXISTS notes DROP CONSTRAINT IF EXISTS notes_owner_fkey;
-	
-	`
-
-	_, err := a.db.Exec(dropFKConstraintsSQL)
+// seedDemoData inserts the demonstration users and notes from the CSV file.
+// It refuses to run on a database that already has users, so it never
+// overwrites real data. The schema itself is created by the migrations.
+func (a *App) seedDemoData() error {
+	var userCount int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
 	if err != nil {
-		log.Println("Error dropping foreign key constraints:", err)
-	} else {
-		log.Printf("Foreign key constraints dropped.")
-	}
-
-	log.Printf("Dropping existing tables...")
-
-	// Drop tables if they exist
-	dropTablesSQL := `
-	DROP TABLE IF EXISTS users;
-	DROP TABLE IF EXISTS user_shares;
-	DROP TABLE IF EXISTS notes;
-	
-	`
-
-	_, err = a.db.Exec(dropTablesSQL)
-	if err != nil {
-		log.Println("Error dropping tables:", err)
-	} else {
-		log.Printf("Tables notes and user_shares dropped.")
+		return err
 	}
-
-	
-    log.Printf("Creating tables...")
-
-    // Create table as required, along with attribute constraints
-    createTablesSQL := `
-    CREATE TABLE IF NOT EXISTS "users" (
-        username VARCHAR(50) UNIQUE PRIMARY KEY NOT NULL,
-        password VARCHAR(255) NOT NULL
-    );
-
-    CREATE TABLE IF NOT EXISTS "notes" (
-        id SERIAL PRIMARY KEY NOT NULL,
-        title VARCHAR(255) NOT NULL,
-        noteType VARCHAR(255) NOT NULL,
-        description VARCHAR(255) NOT NULL,
-        noteCreated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-        taskCompletionTime VARCHAR(255),
-        taskCompletionDate VARCHAR(255),
-        noteStatus VARCHAR(20),
-        noteDelegation VARCHAR(50),
-        owner VARCHAR(50),
-        fts_text tsvector,
-        FOREIGN KEY (owner) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
-    );
-
-    CREATE TABLE IF NOT EXISTS "user_shares" (
-        note_id INTEGER NOT NULL,
-        username VARCHAR(50) NOT NULL,
-        privileges VARCHAR(20) NOT NULL,
-        PRIMARY KEY (username, note_id),
-        FOREIGN KEY (note_id) REFERENCES notes (id) ON UPDATE CASCADE ON DELETE CASCADE,
-        FOREIGN KEY (username) REFERENCES users (username) ON UPDATE CASCADE ON DELETE CASCADE
-    );
-`
-
-    _, err = a.db.Exec(createTablesSQL)
-	if err != nil {
-		log.Println("Error creating tables:", err)
-	} else {
-		log.Printf("Tables notes, user_shares, and users created.")
+	if userCount > 0 {
+		return fmt.Errorf("database already contains %d users, not importing demo data", userCount)
 	}
 
     log.Printf("Inserting data...")
 
-	// Insert two users with hashed passwords
+	// Insert two administrators with hashed passwords
     hashedPasswordMydog7, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
-    _, err = a.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", "mydog7", hashedPasswordMydog7)
+    _, err = a.db.Exec("INSERT INTO users(username, password, role) VALUES($1, $2, $3)", "mydog7", hashedPasswordMydog7, roleAdmin)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
 
     hashedPasswordBIGCAT, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
-    _, err = a.db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", "BIGCAT", hashedPasswordBIGCAT)
+    _, err = a.db.Exec("INSERT INTO users(username, password, role) VALUES($1, $2, $3)", "BIGCAT", hashedPasswordBIGCAT, roleAdmin)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
 
-    insertQuery := `
-        INSERT INTO notes (title, noteType, description, TaskCompletionDate, TaskCompletionTime, NoteStatus, NoteDelegation, owner, fts_text)
-		VALUES (
-			$1::text, $2::text, $3::text, $4::text, $5::text, $6::text, $7::text, $8::text,
-			to_tsvector('english', $1::text || ' ' || $2::text || ' ' || $3::text || ' ' || $4::text || ' ' || $5::text || ' ' || $6::text || ' ' || $7::text)
-		)
-		`
-
-	insertStmt, err := a.db.Prepare(insertQuery)
-	if err != nil {
-		return err
-	}
-
-
-    importDataFromCSV(a, "data/notes.csv", insertStmt, importNotesData)
-
-    // Create a temp file to notify data imported (can use the database directly, but this is an example)
-    file, err := os.Create("./imported")
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer file.Close()
-
-    return nil // Return nil to indicate success
+    return importDataFromCSV(a, "data/notes.csv", importNotesData)
 }
 
-// importDataFromCSV reads data from a CSV file and imports it into the database using the provided statement.
-func importDataFromCSV(a *App, fileName string, stmt *sql.Stmt, dataImporter func(*App, []string) error) {
+// importDataFromCSV reads data from a CSV file and imports each row with the provided importer.
+func importDataFromCSV(a *App, fileName string, dataImporter func(*App, []string) error) error {
     data, err := readData(fileName)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
 
     for _, row := range data {
         err := dataImporter(a, row)
         if err != nil {
-            log.Fatal(err)
+            return err
         }
     }
+
+    return nil
 }
 
 // importNotesData imports note data from a CSV row into the database.
@@ -228,10 +171,14 @@ func importNotesData(a *App, row []string) error {
     owner := row[7]
     
     // Calculate fts_text using to_tsvector
-    ftsText := fmt.Sprintf("%s %s %s %s %s %s %s", title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
+    ftsText := fmt.Sprintf("%s %s %s %s %s %s %s", title, noteType, markdownText(description), taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
 
-    _, err := a.db.Exec("INSERT INTO notes (title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, fts_text) VALUES($1,$2,$3,$4,$5,$6,$7,$8, to_tsvector('english', $9))", title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, ftsText)
+    var id int
+    err := a.db.QueryRow("INSERT INTO notes (title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, fts_text) VALUES($1,$2,$3,$4,$5,$6,$7,$8, to_tsvector('english', $9)) RETURNING id", title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, ftsText).Scan(&id)
+    if err != nil {
+        return err
+    }
 
-    return err
+    return a.recordRevision(id, owner)
 }
 
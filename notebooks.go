@@ -0,0 +1,923 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxNotebookNameLength is the longest notebook name accepted.
+const maxNotebookNameLength = 100
+
+var (
+	errNotebookNotFound    = errors.New("notebook not found")
+	errNotebookForbidden   = errors.New("only the owner of the notebook can change it")
+	errNotebookNameTaken   = errors.New("a notebook with this name already exists in the same place")
+	errNotebookCycle       = errors.New("a notebook cannot be moved into itself or a notebook inside it")
+	errNotebookShared      = errors.New("notebook is already shared with this user")
+	errNotebookOwnerShare  = errors.New("a notebook cannot be shared with its owner")
+	errNotebookPrivileges  = errors.New("privileges must be editor or viewer")
+	errInvalidNotebookName = fmt.Errorf("notebook names must have 1 to %d characters", maxNotebookNameLength)
+)
+
+// Notebook is a folder of notes, possibly nested in another notebook of the
+// same owner. ParentID is 0 for top level notebooks. Privileges are those of
+// the user the notebook is shared with, directly or through a parent, and
+// empty for the owner. Depth is the nesting level when listed as a tree.
+type Notebook struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	ParentID   int    `json:"parent_id,omitempty"`
+	Privileges string `json:"privileges,omitempty"`
+	Depth      int    `json:"-"`
+}
+
+// NotebookShare is the share of a notebook with a user.
+type NotebookShare struct {
+	NotebookID int    `json:"notebook_id"`
+	Username   string `json:"username"`
+	Privileges string `json:"privileges"`
+}
+
+// notebookInput is the JSON body accepted when creating or changing a
+// notebook. A parent_id of 0 moves the notebook to the top level.
+type notebookInput struct {
+	Name     *string `json:"name"`
+	ParentID *int    `json:"parent_id"`
+}
+
+// noteNotebookInput is the JSON body accepted when moving a note.
+type noteNotebookInput struct {
+	NotebookID int `json:"notebook_id"`
+}
+
+// noteNotebookResponse describes which notebook a note is in.
+type noteNotebookResponse struct {
+	NoteID     int `json:"note_id"`
+	NotebookID int `json:"notebook_id"`
+}
+
+// listNotebooks returns the notebooks of username and the notebooks shared
+// with them, parents before their children.
+func (a *App) listNotebooks(username string) ([]Notebook, error) {
+	rows, err := a.db.Query(`
+		SELECT nb.id, nb.name, nb.owner, COALESCE(nb.parent_id, 0), COALESCE(s.privileges, '')
+		FROM notebooks nb
+		INNER JOIN users o ON o.username = nb.owner
+		LEFT JOIN notebook_effective_shares s ON s.notebook_id = nb.id AND s.username = $1
+		WHERE nb.owner = $1
+			OR (s.username IS NOT NULL AND o.org_id = (SELECT org_id FROM users WHERE username = $1))
+		ORDER BY LOWER(nb.name), nb.id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notebooks := []Notebook{}
+	for rows.Next() {
+		var nb Notebook
+		if err := rows.Scan(&nb.ID, &nb.Name, &nb.Owner, &nb.ParentID, &nb.Privileges); err != nil {
+			return nil, err
+		}
+		notebooks = append(notebooks, nb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return notebookTree(notebooks), nil
+}
+
+// notebookTree orders notebooks depth first, keeping the order of siblings.
+// Notebooks whose parent is not in the list, such as a notebook shared
+// without its parent, are listed at the top level.
+func notebookTree(notebooks []Notebook) []Notebook {
+	ids := make(map[int]bool, len(notebooks))
+	for _, nb := range notebooks {
+		ids[nb.ID] = true
+	}
+	children := make(map[int][]Notebook)
+	for _, nb := range notebooks {
+		parent := nb.ParentID
+		if !ids[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], nb)
+	}
+
+	tree := make([]Notebook, 0, len(notebooks))
+	var walk func(parent, depth int)
+	walk = func(parent, depth int) {
+		for _, nb := range children[parent] {
+			nb.Depth = depth
+			tree = append(tree, nb)
+			walk(nb.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return tree
+}
+
+// getNotebook returns a notebook, or errNotebookNotFound.
+func (a *App) getNotebook(notebookID int) (*Notebook, error) {
+	var nb Notebook
+	err := a.db.QueryRow("SELECT id, name, owner, COALESCE(parent_id, 0) FROM notebooks WHERE id = $1", notebookID).
+		Scan(&nb.ID, &nb.Name, &nb.Owner, &nb.ParentID)
+	if err == sql.ErrNoRows {
+		return nil, errNotebookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &nb, nil
+}
+
+// authorizeNotebook checks that username may see the notebook, or change it
+// when manage is set. Only the owner can change a notebook. It returns
+// errNotebookNotFound for notebooks the user cannot see.
+func (a *App) authorizeNotebook(username string, notebookID int, manage bool) error {
+	var owner string
+	var privileges sql.NullString
+	err := a.db.QueryRow(`
+		SELECT nb.owner, s.privileges
+		FROM notebooks nb
+		INNER JOIN users o ON o.username = nb.owner
+		LEFT JOIN notebook_effective_shares s ON s.notebook_id = nb.id AND s.username = $2
+		WHERE nb.id = $1 AND o.org_id = (SELECT org_id FROM users WHERE username = $2)`, notebookID, username).
+		Scan(&owner, &privileges)
+	if err == sql.ErrNoRows {
+		return errNotebookNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case owner == username:
+		return nil
+	case !privileges.Valid:
+		return errNotebookNotFound
+	case manage:
+		return errNotebookForbidden
+	}
+	return nil
+}
+
+// validNotebookName trims name and checks its length.
+func validNotebookName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxNotebookNameLength {
+		return "", errInvalidNotebookName
+	}
+	return name, nil
+}
+
+// notebookNameTaken reports whether another notebook than notebookID of
+// owner with the parent parentID uses name, ignoring case.
+func notebookNameTaken(tx *sql.Tx, owner, name string, parentID, notebookID int) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM notebooks
+			WHERE owner = $1 AND COALESCE(parent_id, 0) = $2 AND LOWER(name) = LOWER($3) AND id != $4
+		)`, owner, parentID, name, notebookID).Scan(&taken)
+	return taken, err
+}
+
+// checkParent checks that parentID is 0 or a notebook of owner.
+func checkParent(tx *sql.Tx, owner string, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM notebooks WHERE id = $1 AND owner = $2)", parentID, owner).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNotebookNotFound
+	}
+	return nil
+}
+
+// nullIfZero stores a parent or notebook ID of 0 as NULL.
+func nullIfZero(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// createNotebook creates a notebook of owner inside parentID, or at the top
+// level when parentID is 0, and returns its ID.
+func (a *App) createNotebook(owner, name string, parentID int) (int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkParent(tx, owner, parentID); err != nil {
+		return 0, err
+	}
+	if taken, err := notebookNameTaken(tx, owner, name, parentID, 0); err != nil {
+		return 0, err
+	} else if taken {
+		return 0, errNotebookNameTaken
+	}
+
+	var id int
+	err = tx.QueryRow("INSERT INTO notebooks (owner, name, parent_id) VALUES ($1, $2, $3) RETURNING id",
+		owner, name, nullIfZero(parentID)).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// updateNotebook renames a notebook and moves it inside parentID. A notebook
+// cannot be moved into itself or one of the notebooks inside it.
+func (a *App) updateNotebook(notebook Notebook) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkParent(tx, notebook.Owner, notebook.ParentID); err != nil {
+		return err
+	}
+	if notebook.ParentID != 0 {
+		var nested bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM notebook_ancestors WHERE notebook_id = $1 AND ancestor_id = $2)",
+			notebook.ParentID, notebook.ID).Scan(&nested)
+		if err != nil {
+			return err
+		}
+		if nested {
+			return errNotebookCycle
+		}
+	}
+	if taken, err := notebookNameTaken(tx, notebook.Owner, notebook.Name, notebook.ParentID, notebook.ID); err != nil {
+		return err
+	} else if taken {
+		return errNotebookNameTaken
+	}
+
+	_, err = tx.Exec("UPDATE notebooks SET name = $2, parent_id = $3 WHERE id = $1",
+		notebook.ID, notebook.Name, nullIfZero(notebook.ParentID))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteNotebook deletes a notebook together with the notebooks inside it.
+// Their notes are kept outside of any notebook.
+func (a *App) deleteNotebook(notebookID int) error {
+	_, err := a.db.Exec("DELETE FROM notebooks WHERE id = $1", notebookID)
+	return err
+}
+
+// moveNote puts a note in a notebook of the note's owner, or takes it out of
+// its notebook when notebookID is 0.
+func (a *App) moveNote(noteID, notebookID int) error {
+	if notebookID == 0 {
+		_, err := a.db.Exec("UPDATE notes SET notebook_id = NULL WHERE id = $1", noteID)
+		return err
+	}
+
+	result, err := a.db.Exec(`
+		UPDATE notes SET notebook_id = $2
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM notebooks nb WHERE nb.id = $2 AND nb.owner = notes.owner)`,
+		noteID, notebookID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotebookNotFound
+	}
+	return nil
+}
+
+// loadNotebookIDs fills in the notebook of each note.
+func (a *App) loadNotebookIDs(notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	placeholders, args, positions := noteIDArgs(notes)
+	rows, err := a.db.Query("SELECT id, notebook_id FROM notes WHERE notebook_id IS NOT NULL AND id IN ("+placeholders+")", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID, notebookID int
+		if err := rows.Scan(&noteID, &notebookID); err != nil {
+			return err
+		}
+		for _, i := range positions[noteID] {
+			notes[i].NotebookID = notebookID
+		}
+	}
+
+	return rows.Err()
+}
+
+// notebookScope returns the IDs of a notebook and the notebooks inside it.
+func (a *App) notebookScope(notebookID int) (map[int]bool, error) {
+	rows, err := a.db.Query("SELECT notebook_id FROM notebook_ancestors WHERE ancestor_id = $1", notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scope := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		scope[id] = true
+	}
+
+	return scope, rows.Err()
+}
+
+// inNotebooks returns the notes in one of the notebooks of scope. Notebook
+// IDs must have been loaded.
+func inNotebooks(notes []Note, scope map[int]bool) []Note {
+	result := []Note{}
+	for _, note := range notes {
+		if scope[note.NotebookID] {
+			result = append(result, note)
+		}
+	}
+	return result
+}
+
+// scopeToNotebook loads the notebooks of the notes and, unless notebookID is
+// 0, keeps the notes in that notebook or the notebooks inside it.
+func (a *App) scopeToNotebook(notes []Note, notebookID int) ([]Note, error) {
+	if err := a.loadNotebookIDs(notes); err != nil {
+		return nil, err
+	}
+	if notebookID == 0 {
+		return notes, nil
+	}
+
+	scope, err := a.notebookScope(notebookID)
+	if err != nil {
+		return nil, err
+	}
+	return inNotebooks(notes, scope), nil
+}
+
+// listNotebookShares returns the users a notebook is shared with directly.
+func (a *App) listNotebookShares(notebookID int) ([]NotebookShare, error) {
+	rows, err := a.db.Query(`
+		SELECT notebook_id, username, privileges
+		FROM notebook_shares
+		WHERE notebook_id = $1
+		ORDER BY username`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []NotebookShare{}
+	for rows.Next() {
+		var share NotebookShare
+		if err := rows.Scan(&share.NotebookID, &share.Username, &share.Privileges); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+// shareNotebook shares a notebook, and so every note in it and in the
+// notebooks inside it, with a user in the organization of its owner. It
+// returns sql.ErrNoRows for unknown users and errNotebookShared if the
+// notebook is already shared with the user.
+func (a *App) shareNotebook(notebookID int, username, privileges string) error {
+	var exists bool
+	err := a.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u
+			INNER JOIN users o ON o.org_id = u.org_id
+			INNER JOIN notebooks nb ON nb.owner = o.username
+			WHERE u.username = $1 AND nb.id = $2 AND nb.owner != $1
+		)`, username, notebookID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	result, err := a.db.Exec(`
+		INSERT INTO notebook_shares (notebook_id, username, privileges)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, notebookID, username, privileges)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotebookShared
+	}
+	return nil
+}
+
+// updateNotebookShare changes the privileges of a notebook share, returning
+// sql.ErrNoRows if the notebook is not shared with the user.
+func (a *App) updateNotebookShare(notebookID int, username, privileges string) error {
+	result, err := a.db.Exec("UPDATE notebook_shares SET privileges = $3 WHERE notebook_id = $1 AND username = $2", notebookID, username, privileges)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// removeNotebookShare stops sharing a notebook with a user.
+func (a *App) removeNotebookShare(notebookID int, username string) error {
+	_, err := a.db.Exec("DELETE FROM notebook_shares WHERE notebook_id = $1 AND username = $2", notebookID, username)
+	return err
+}
+
+// notebookAuditDetails describes a notebook share in the audit log.
+func notebookAuditDetails(notebookID int, privileges string) string {
+	if privileges == "" {
+		return fmt.Sprintf("notebook %d", notebookID)
+	}
+	return fmt.Sprintf("notebook %d, %s", notebookID, privileges)
+}
+
+// notebookErrorStatus maps an error from the notebook functions to an HTTP status code.
+func notebookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotebookNotFound), err == sql.ErrNoRows:
+		return http.StatusNotFound
+	case errors.Is(err, errNotebookForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errNotebookNameTaken), errors.Is(err, errNotebookShared):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidNotebookName), errors.Is(err, errNotebookCycle),
+		errors.Is(err, errNotebookOwnerShare), errors.Is(err, errNotebookPrivileges):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respondWithNotebookError writes the JSON error response for a notebook function error.
+func respondWithNotebookError(w http.ResponseWriter, err error) {
+	message := err.Error()
+	if err == sql.ErrNoRows {
+		message = "user not found"
+	}
+	respondWithError(w, notebookErrorStatus(err), message)
+}
+
+// notebookIDFromVars parses the {notebookID} route variable.
+func notebookIDFromVars(r *http.Request) (int, error) {
+	notebookID, err := strconv.Atoi(mux.Vars(r)["notebookID"])
+	if err != nil {
+		return 0, errors.New("invalid notebookID")
+	}
+	return notebookID, nil
+}
+
+// authorizeAPINotebook parses the notebook ID from the URL and checks access
+// to it. On failure it writes the JSON error response and returns false.
+func (a *App) authorizeAPINotebook(w http.ResponseWriter, r *http.Request, manage bool) (int, bool) {
+	notebookID, err := notebookIDFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return 0, false
+	}
+
+	if err := a.authorizeNotebook(currentUsername(r), notebookID, manage); err != nil {
+		respondWithNotebookError(w, err)
+		return 0, false
+	}
+
+	return notebookID, true
+}
+
+// apiListNotebooksHandler returns the notebooks of the user and those shared with them.
+func (a *App) apiListNotebooksHandler(w http.ResponseWriter, r *http.Request) {
+	notebooks, err := a.listNotebooks(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notebooks)
+}
+
+// apiCreateNotebookHandler creates a notebook owned by the user.
+func (a *App) apiCreateNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	var in notebookInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var name string
+	if in.Name != nil {
+		name = *in.Name
+	}
+	name, err := validNotebookName(name)
+	if err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+	var parentID int
+	if in.ParentID != nil {
+		parentID = *in.ParentID
+	}
+
+	id, err := a.createNotebook(currentUsername(r), name, parentID)
+	if err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+
+	notebook, err := a.getNotebook(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/notebooks/%d", id))
+	respondWithJSON(w, http.StatusCreated, notebook)
+}
+
+// apiGetNotebookHandler returns a notebook.
+func (a *App) apiGetNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, false)
+	if !ok {
+		return
+	}
+
+	notebook, err := a.getNotebook(notebookID)
+	if err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notebook)
+}
+
+// apiUpdateNotebookHandler renames or moves a notebook.
+func (a *App) apiUpdateNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, true)
+	if !ok {
+		return
+	}
+
+	var in notebookInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	notebook, err := a.getNotebook(notebookID)
+	if err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+	if in.Name != nil {
+		if notebook.Name, err = validNotebookName(*in.Name); err != nil {
+			respondWithNotebookError(w, err)
+			return
+		}
+	}
+	if in.ParentID != nil {
+		notebook.ParentID = *in.ParentID
+	}
+
+	if err := a.updateNotebook(*notebook); err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notebook)
+}
+
+// apiDeleteNotebookHandler deletes a notebook and the notebooks inside it.
+func (a *App) apiDeleteNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, true)
+	if !ok {
+		return
+	}
+
+	if err := a.deleteNotebook(notebookID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListNotebookSharesHandler returns the users a notebook is shared with.
+func (a *App) apiListNotebookSharesHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, false)
+	if !ok {
+		return
+	}
+
+	shares, err := a.listNotebookShares(notebookID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, shares)
+}
+
+// apiCreateNotebookShareHandler shares a notebook with a user.
+func (a *App) apiCreateNotebookShareHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, true)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithNotebookError(w, errNotebookPrivileges)
+		return
+	}
+	if in.Username == currentUsername(r) {
+		respondWithNotebookError(w, errNotebookOwnerShare)
+		return
+	}
+
+	if err := a.shareNotebook(notebookID, in.Username, in.Privileges); err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditShareNotebook, Target: in.Username, Details: notebookAuditDetails(notebookID, in.Privileges)})
+
+	respondWithJSON(w, http.StatusCreated, NotebookShare{NotebookID: notebookID, Username: in.Username, Privileges: in.Privileges})
+}
+
+// apiUpdateNotebookShareHandler changes the privileges of a notebook share.
+func (a *App) apiUpdateNotebookShareHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, true)
+	if !ok {
+		return
+	}
+
+	var in shareInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isValidPrivilege(in.Privileges) {
+		respondWithNotebookError(w, errNotebookPrivileges)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if err := a.updateNotebookShare(notebookID, username, in.Privileges); err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "notebook is not shared with this user")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUpdateNotebookPrivileges, Target: username, Details: notebookAuditDetails(notebookID, in.Privileges)})
+
+	respondWithJSON(w, http.StatusOK, NotebookShare{NotebookID: notebookID, Username: username, Privileges: in.Privileges})
+}
+
+// apiDeleteNotebookShareHandler stops sharing a notebook with a user.
+func (a *App) apiDeleteNotebookShareHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, ok := a.authorizeAPINotebook(w, r, true)
+	if !ok {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if err := a.removeNotebookShare(notebookID, username); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditUnshareNotebook, Target: username, Details: notebookAuditDetails(notebookID, "")})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetNoteNotebookHandler returns the notebook a note is in, 0 for none.
+func (a *App) apiGetNoteNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, noteNotebookResponse{NoteID: noteID, NotebookID: note.NotebookID})
+}
+
+// apiPutNoteNotebookHandler moves a note into a notebook of its owner.
+func (a *App) apiPutNoteNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionMove)
+	if !ok {
+		return
+	}
+
+	var in noteNotebookInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.moveNote(noteID, in.NotebookID); err != nil {
+		respondWithNotebookError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, noteNotebookResponse{NoteID: noteID, NotebookID: in.NotebookID})
+}
+
+// apiDeleteNoteNotebookHandler takes a note out of its notebook.
+func (a *App) apiDeleteNoteNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionMove)
+	if !ok {
+		return
+	}
+
+	if err := a.moveNote(noteID, 0); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// selectedNotebook returns the notebook given by the form or query value
+// notebook, which must be one of notebooks, or nil when there is none.
+func (a *App) selectedNotebook(r *http.Request, notebooks []Notebook) (*Notebook, error) {
+	value := r.FormValue("notebook")
+	if value == "" {
+		return nil, nil
+	}
+
+	notebookID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errNotebookNotFound
+	}
+	for _, nb := range notebooks {
+		if nb.ID == notebookID {
+			return &nb, nil
+		}
+	}
+	return nil, errNotebookNotFound
+}
+
+// notebookError redirects back to the notes list, showing err, unless it
+// is an internal error.
+func notebookError(w http.ResponseWriter, r *http.Request, err error) {
+	if notebookErrorStatus(err) == http.StatusInternalServerError {
+		checkInternalServerError(err, w)
+		return
+	}
+	message := err.Error()
+	if err == sql.ErrNoRows {
+		message = "user not found"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:  "errorMessage",
+		Value: "Notebook Error: " + message + ".",
+		Path:  "/list",
+	})
+	http.Redirect(w, r, "/list", http.StatusSeeOther)
+}
+
+// createNotebookHandler creates a notebook from the notes list and shows it.
+func (a *App) createNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := validNotebookName(r.FormValue("Name"))
+	if err != nil {
+		notebookError(w, r, err)
+		return
+	}
+	parentID, _ := strconv.Atoi(r.FormValue("ParentID"))
+
+	id, err := a.createNotebook(currentUsername(r), name, parentID)
+	if err != nil {
+		notebookError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/list?notebook=%d", id), http.StatusSeeOther)
+}
+
+// notebookActionHandler renames, moves, deletes or shares a notebook from
+// the notes list.
+func (a *App) notebookActionHandler(w http.ResponseWriter, r *http.Request) {
+	notebookID, err := notebookIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.authorizeNotebook(currentUsername(r), notebookID, true); err != nil {
+		notebookError(w, r, err)
+		return
+	}
+
+	username := r.FormValue("Username")
+	switch mux.Vars(r)["action"] {
+	case "update":
+		var notebook *Notebook
+		if notebook, err = a.getNotebook(notebookID); err != nil {
+			break
+		}
+		if notebook.Name, err = validNotebookName(r.FormValue("Name")); err != nil {
+			break
+		}
+		notebook.ParentID, _ = strconv.Atoi(r.FormValue("ParentID"))
+		err = a.updateNotebook(*notebook)
+	case "delete":
+		if err = a.deleteNotebook(notebookID); err == nil {
+			http.Redirect(w, r, "/list", http.StatusSeeOther)
+			return
+		}
+	case "share":
+		privileges := r.FormValue("Privileges")
+		switch {
+		case !isValidPrivilege(privileges):
+			err = errNotebookPrivileges
+		case username == currentUsername(r):
+			err = errNotebookOwnerShare
+		default:
+			if err = a.shareNotebook(notebookID, username, privileges); err == nil {
+				a.audit(r, AuditEvent{Action: auditShareNotebook, Target: username, Details: notebookAuditDetails(notebookID, privileges)})
+			}
+		}
+	case "unshare":
+		if err = a.removeNotebookShare(notebookID, username); err == nil {
+			a.audit(r, AuditEvent{Action: auditUnshareNotebook, Target: username, Details: notebookAuditDetails(notebookID, "")})
+		}
+	}
+	if err != nil {
+		notebookError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/list?notebook=%d", notebookID), http.StatusSeeOther)
+}
+
+// moveNoteHandler moves a note of the user into another notebook, or out
+// of any notebook, from the notes list.
+func (a *App) moveNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionMove); err != nil {
+		respondWithNoteAuthError(w, err)
+		return
+	}
+
+	notebookID, _ := strconv.Atoi(r.FormValue("NotebookID"))
+	if err := a.moveNote(noteID, notebookID); err != nil {
+		notebookError(w, r, err)
+		return
+	}
+
+	if notebookID == 0 {
+		http.Redirect(w, r, "/list", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/list?notebook=%d", notebookID), http.StatusSeeOther)
+}
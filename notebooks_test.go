@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// notebookAccessQuery is the query authorizeNotebook uses to check access.
+const notebookAccessQuery = "SELECT nb.owner, s.privileges FROM notebooks nb"
+
+func TestNotebookTree(t *testing.T) {
+	notebooks := []Notebook{
+		{ID: 3, Name: "Archive", ParentID: 1},
+		{ID: 4, Name: "Holidays"},
+		{ID: 2, Name: "Q4", ParentID: 1},
+		{ID: 1, Name: "Work"},
+		{ID: 7, Name: "Shared", ParentID: 9},
+	}
+
+	var got []int
+	var depths []int
+	for _, nb := range notebookTree(notebooks) {
+		got = append(got, nb.ID)
+		depths = append(depths, nb.Depth)
+	}
+	if want := []int{4, 1, 3, 2, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected notebooks %v, but got %v", want, got)
+	}
+	if want := []int{0, 0, 1, 1, 0}; !reflect.DeepEqual(depths, want) {
+		t.Errorf("Expected depths %v, but got %v", want, depths)
+	}
+}
+
+func TestAPICreateNotebook(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM notebooks WHERE id = \\$1 AND owner = \\$2\\)").WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("LOWER\\(name\\) = LOWER\\(\\$3\\)").WithArgs("mydog7", 1, "Q4", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("INSERT INTO notebooks").WithArgs("mydog7", "Q4", nullIfZero(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT id, name, owner, COALESCE\\(parent_id, 0\\) FROM notebooks").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "owner", "parent_id"}).AddRow(2, "Q4", "mydog7", 1))
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notebooks", strings.NewReader(`{"name": " Q4 ", "parent_id": 1}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if location := rr.Header().Get("Location"); location != "/api/v1/notebooks/2" {
+		t.Errorf("Unexpected Location %q", location)
+	}
+
+	var notebook Notebook
+	if err := json.Unmarshal(rr.Body.Bytes(), &notebook); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Notebook{ID: 2, Name: "Q4", Owner: "mydog7", ParentID: 1}); notebook != want {
+		t.Errorf("Expected %+v, but got %+v", want, notebook)
+	}
+
+	// Names are required
+	expectActiveUser(mock, "mydog7")
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/notebooks", strings.NewReader(`{"name": "  "}`)), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUpdateNotebook_Cycle(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("mydog7", nil))
+	mock.ExpectQuery("SELECT id, name, owner, COALESCE\\(parent_id, 0\\) FROM notebooks").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "owner", "parent_id"}).AddRow(1, "Work", "mydog7", 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM notebooks WHERE id = \\$1 AND owner = \\$2\\)").WithArgs(2, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM notebook_ancestors").WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	req := loginRequest(httptest.NewRequest("PATCH", "/api/v1/notebooks/1", strings.NewReader(`{"parent_id": 2}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+
+	// Users the notebook is shared with cannot change it
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("mydog7", privilegeEditor))
+
+	req = loginRequest(httptest.NewRequest("PATCH", "/api/v1/notebooks/1", strings.NewReader(`{"name": "Mine"}`)), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIShareNotebook(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("mydog7", nil))
+	mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM users u").WithArgs("BIGCAT", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO notebook_shares").WithArgs(1, "BIGCAT", privilegeEditor).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, "mydog7", auditShareNotebook, 0, "BIGCAT", "notebook 1, editor")
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notebooks/1/shares", strings.NewReader(`{"username": "BIGCAT", "privileges": "editor"}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	// Sharing twice is a conflict
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("mydog7", nil))
+	mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM users u").WithArgs("BIGCAT", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO notebook_shares").WithArgs(1, "BIGCAT", privilegeViewer).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/notebooks/1/shares", strings.NewReader(`{"username": "BIGCAT", "privileges": "viewer"}`)), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIPutNoteNotebook(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	mock.ExpectExec("UPDATE notes SET notebook_id = \\$2").WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := loginRequest(httptest.NewRequest("PUT", "/api/v1/notes/1/notebook", strings.NewReader(`{"notebook_id": 2}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// Notebooks of other users are not found
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	mock.ExpectExec("UPDATE notes SET notebook_id = \\$2").WithArgs(1, 5).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req = loginRequest(httptest.NewRequest("PUT", "/api/v1/notes/1/notebook", strings.NewReader(`{"notebook_id": 5}`)), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Only the owner can move a note
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeEditor))
+
+	req = loginRequest(httptest.NewRequest("PUT", "/api/v1/notes/1/notebook", strings.NewReader(`{"notebook_id": 2}`)), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIListNotes_NotebookScope(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("mydog7", nil))
+	mock.ExpectPrepare("SELECT n.id, n.title").ExpectQuery().WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "noteType", "description", "noteCreated", "taskCompletionTime",
+			"taskCompletionDate", "noteStatus", "noteDelegation", "owner", "username", "privileges"}).
+			AddRow(1, "Report", "Task", "", created, nil, nil, nil, nil, "mydog7", nil, nil).
+			AddRow(2, "Budget", "Note", "", created, nil, nil, nil, nil, "mydog7", nil, nil).
+			AddRow(3, "Groceries", "Note", "", created, nil, nil, nil, nil, "mydog7", nil, nil))
+	mock.ExpectQuery(tagsQuery).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"note_id", "name"}))
+	mock.ExpectQuery("SELECT id, notebook_id FROM notes").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "notebook_id"}).AddRow(1, 1).AddRow(2, 2).AddRow(3, 4))
+	mock.ExpectQuery("SELECT notebook_id FROM notebook_ancestors WHERE ancestor_id = \\$1").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"notebook_id"}).AddRow(1).AddRow(2))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/notes?scope=owned&notebook=1", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var notes []noteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &notes); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("Expected the 2 notes of the notebook and its child, but got %+v", notes)
+	}
+	for _, note := range notes {
+		if note.ID == 3 {
+			t.Errorf("Unexpected note %+v", note)
+		}
+	}
+
+	// Notebooks the user cannot see are not found
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(notebookAccessQuery).WithArgs(9, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "privileges"}).AddRow("BIGCAT", nil))
+
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/notes?notebook=9", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/icza/session"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcFlowCookie holds the state, nonce and PKCE verifier of a sign-in in progress.
+	oidcFlowCookie = "oidc_flow"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// errNoLinkedUser is returned when a provider account is not linked to a
+// user and may not create one.
+var errNoLinkedUser = errors.New("no user is linked to this account")
+
+// oidcClaims are the ID token claims used to find or create the local user.
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// oidcClient holds the provider, discovered on first use.
+type oidcClient struct {
+	cfg OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// oidcProvider returns the client of the configured provider, running
+// discovery if it has not succeeded yet. A provider that is down when the
+// server starts does not stop password logins.
+func (a *App) oidcProvider(ctx context.Context) (*oidcClient, *oidc.Provider, error) {
+	if a.oidc == nil {
+		return nil, nil, errors.New("single sign-on is not configured")
+	}
+
+	a.oidc.mu.Lock()
+	defer a.oidc.mu.Unlock()
+	if a.oidc.provider == nil {
+		provider, err := oidc.NewProvider(ctx, a.oidc.cfg.Issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discovering the OIDC provider: %v", err)
+		}
+		a.oidc.provider = provider
+	}
+
+	return a.oidc, a.oidc.provider, nil
+}
+
+// oauth2Config returns the OAuth 2.0 client configuration for the provider.
+func (a *App) oauth2Config(client *oidcClient, provider *oidc.Provider) *oauth2.Config {
+	redirectURL := client.cfg.RedirectURL
+	if redirectURL == "" {
+		redirectURL = a.publicURL() + "/login/oidc/callback"
+	}
+
+	return &oauth2.Config{
+		ClientID:     client.cfg.ClientID,
+		ClientSecret: client.cfg.ClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       client.cfg.Scopes,
+	}
+}
+
+// oidcLoginHandler starts a sign-in at the provider.
+func (a *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	client, provider, err := a.oidcProvider(r.Context())
+	if err != nil {
+		log.Println(err)
+		redirectToLoginWithMessage(w, r, "Single sign-on is not available right now.")
+		return
+	}
+
+	state, err := generateResetToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateResetToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.config != nil && a.config.Server.TLS.Enabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := a.oauth2Config(client, provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler finishes a sign-in: it exchanges the code, verifies
+// the ID token and creates the session of the linked user.
+func (a *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	failed := func(reason string, err error) {
+		log.Printf("Single sign-on failed: %s: %v", reason, err)
+		redirectToLoginWithMessage(w, r, "Single sign-on failed. Please try again.")
+	}
+
+	// The flow cookie is only used once
+	cookie, err := r.Cookie(oidcFlowCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, MaxAge: -1, Path: "/login/oidc"})
+	if err != nil {
+		failed("no sign-in in progress", err)
+		return
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		failed("malformed flow cookie", nil)
+		return
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		failed("provider returned an error", fmt.Errorf("%s: %s", e, r.URL.Query().Get("error_description")))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+		failed("state does not match", nil)
+		return
+	}
+
+	client, provider, err := a.oidcProvider(r.Context())
+	if err != nil {
+		failed("provider unavailable", err)
+		return
+	}
+
+	token, err := a.oauth2Config(client, provider).Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		failed("exchanging the code", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		failed("no ID token in the token response", nil)
+		return
+	}
+
+	// Verify checks the signature, issuer, audience and expiry
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: client.cfg.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		failed("verifying the ID token", err)
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		failed("reading the ID token claims", err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		failed("nonce does not match", nil)
+		return
+	}
+
+	var all map[string]interface{}
+	if err := idToken.Claims(&all); err != nil {
+		failed("reading the ID token claims", err)
+		return
+	}
+	preferred, _ := all[client.cfg.UsernameClaim].(string)
+
+	username, err := a.oidcUser(client.cfg, idToken.Issuer, claims, preferred)
+	if err == errNoLinkedUser {
+		redirectToLoginWithMessage(w, r, "Your account is not linked to a user of this application.")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if disabled, err := a.userDisabled(username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if disabled {
+		redirectToLoginWithMessage(w, r, msgDisabled)
+		return
+	}
+
+	// Single sign-on replaces the password, not the second factor
+	twoFactor, err := a.totpEnabled(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if twoFactor {
+		token, err := a.createLoginChallenge(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %s signed in with single sign-on, waiting for the second factor", username)
+		a.setLoginChallengeCookie(w, token)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("User %s signed in with single sign-on", username)
+	sess := a.newLoginSession(r, username)
+	a.audit(r, AuditEvent{Actor: username, Action: auditLogin, Details: "sso"})
+	session.Add(sess, w)
+	http.Redirect(w, r, "/list", http.StatusSeeOther)
+}
+
+// oidcUser returns the local user of a provider account. Accounts are linked
+// on first sign-in, to the user without a password with the same verified
+// email address when cfg.LinkByEmail is set, or to a new user when
+// cfg.AutoCreate is set. Users with a password are never linked by email,
+// and a new user never takes over an existing username.
+func (a *App) oidcUser(cfg OIDCConfig, issuer string, claims oidcClaims, preferred string) (string, error) {
+	now := time.Now().UTC()
+
+	var username string
+	err := a.db.QueryRow("UPDATE user_identities SET last_login_at = $3 WHERE issuer = $1 AND subject = $2 RETURNING username",
+		issuer, claims.Subject, now).Scan(&username)
+	if err != sql.ErrNoRows {
+		return username, err
+	}
+
+	email, _ := normalizeEmail(claims.Email)
+	if !claims.EmailVerified {
+		email = ""
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if cfg.LinkByEmail && email != "" {
+		err = tx.QueryRow("SELECT username FROM users WHERE LOWER(email) = LOWER($1) AND password = ''", email).Scan(&username)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	if username == "" {
+		if !cfg.AutoCreate {
+			return "", errNoLinkedUser
+		}
+		if username, err = createSSOUser(tx, oidcUsername(preferred, email, claims.Subject), email); err != nil {
+			return "", err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (issuer, subject, username, created_at, last_login_at) VALUES ($1, $2, $3, $4, $4)",
+		issuer, claims.Subject, username, now)
+	if err != nil {
+		return "", err
+	}
+
+	return username, tx.Commit()
+}
+
+// usernameUnsafe matches characters not used in generated usernames.
+var usernameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcUsername picks the username for a new user from the claims.
+func oidcUsername(preferred, email, subject string) string {
+	name := preferred
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	name = usernameUnsafe.ReplaceAllString(name, "")
+	if name == "" {
+		name = "user-" + usernameUnsafe.ReplaceAllString(subject, "")
+	}
+	return truncate(name, 40)
+}
+
+// createSSOUser creates a user without a password, adding a number to the
+// username if it is taken. The email address is only kept when no other user has it.
+func createSSOUser(tx *sql.Tx, base, email string) (string, error) {
+	if email != "" {
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))", email).Scan(&taken); err != nil {
+			return "", err
+		}
+		if taken {
+			email = ""
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		// An empty password hash never matches, so the user can only sign in
+		// with single sign-on until they reset their password
+		result, err := tx.Exec(`
+			INSERT INTO users (username, password, email) VALUES ($1, '', $2)
+			ON CONFLICT (username) DO NOTHING`, username, sql.NullString{String: email, Valid: email != ""})
+		if err != nil {
+			return "", err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if n == 1 {
+			log.Printf("Created user %s for single sign-on", username)
+			return username, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free username for %s", base)
+}
+
+// redirectToLoginWithMessage shows message on the login page.
+func redirectToLoginWithMessage(w http.ResponseWriter, r *http.Request, message string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/",
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/icza/session"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider. Tests register the
+// claims to return for an authorization code with the PKCE challenge sent
+// to the authorization endpoint.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	codes map[string]mockOIDCCode
+}
+
+type mockOIDCCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockOIDCCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &p.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code, ok := p.codes[r.FormValue("code")]
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(p.codes, r.FormValue("code"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     p.sign(t, code.claims),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// sign returns a signed ID token with the standard claims and extra.
+func (p *mockOIDCProvider) sign(t *testing.T, extra map[string]interface{}) string {
+	claims := map[string]interface{}{
+		"iss": p.URL,
+		"aud": "notes",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	payload, _ := json.Marshal(claims)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newOIDCTestApp returns an App using the mock provider for single sign-on.
+func newOIDCTestApp(t *testing.T, provider *mockOIDCProvider) (*App, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if session.Global == nil {
+		session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	}
+
+	cfg := defaultConfig()
+	cfg.OIDC.Issuer = provider.URL
+	cfg.OIDC.ClientID = "notes"
+	cfg.OIDC.ClientSecret = "secret"
+	cfg.OIDC.RedirectURL = "http://notes.test/login/oidc/callback"
+
+	return &App{db: db, config: cfg, oidc: &oidcClient{cfg: cfg.OIDC}}, mock
+}
+
+// startOIDCLogin starts a sign-in and returns the flow cookie and the
+// parameters sent to the authorization endpoint.
+func startOIDCLogin(t *testing.T, a *App) (*http.Cookie, url.Values) {
+	rr := httptest.NewRecorder()
+	a.oidcLoginHandler(rr, httptest.NewRequest("GET", "/login/oidc", nil))
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || location.Path != "/authorize" {
+		t.Fatalf("Expected a redirect to the provider, but got %q", rr.Header().Get("Location"))
+	}
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcFlowCookie {
+			return c, location.Query()
+		}
+	}
+	t.Fatal("Expected a flow cookie")
+	return nil, nil
+}
+
+// finishOIDCLogin calls the callback as the provider redirects back.
+func finishOIDCLogin(a *App, cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	a.oidcCallbackHandler(rr, req)
+	return rr
+}
+
+func TestOIDCLogin_CreatesUser(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	a, mock := newOIDCTestApp(t, provider)
+
+	cookie, params := startOIDCLogin(t, a)
+	if params.Get("code_challenge_method") != "S256" || params.Get("client_id") != "notes" || params.Get("nonce") == "" {
+		t.Errorf("Unexpected authorization request %v", params)
+	}
+
+	provider.codes["code-1"] = mockOIDCCode{
+		challenge: params.Get("code_challenge"),
+		claims: map[string]interface{}{
+			"sub":                "248289761001",
+			"nonce":              params.Get("nonce"),
+			"email":              "jane@example.com",
+			"email_verified":     true,
+			"preferred_username": "jane.doe",
+		},
+	}
+
+	mock.ExpectQuery("UPDATE user_identities SET last_login_at").WithArgs(provider.URL, "248289761001", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO users").WithArgs("jane.doe", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_identities").WithArgs(provider.URL, "248289761001", "jane.doe", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("jane.doe").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL FROM users").WithArgs("jane.doe").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	expectAudit(mock, "jane.doe", auditLogin, 0, "", "sso")
+
+	rr := finishOIDCLogin(a, cookie, params.Get("state"), "code-1")
+	if rr.Header().Get("Location") != "/list" {
+		t.Errorf("Expected to be logged in, but got %q", rr.Header().Get("Location"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCLogin_TwoFactor(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	a, mock := newOIDCTestApp(t, provider)
+
+	// A linked user with two-factor authentication still has to give a code
+	cookie, params := startOIDCLogin(t, a)
+	provider.codes["code-1"] = mockOIDCCode{challenge: params.Get("code_challenge"), claims: map[string]interface{}{"sub": "42", "nonce": params.Get("nonce")}}
+
+	mock.ExpectQuery("UPDATE user_identities SET last_login_at").WithArgs(provider.URL, "42", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("mydog7"))
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+	mock.ExpectExec("DELETE FROM login_challenges WHERE expires_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO login_challenges").WithArgs(sqlmock.AnyArg(), "mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := finishOIDCLogin(a, cookie, params.Get("state"), "code-1")
+	if rr.Header().Get("Location") != "/login/2fa" {
+		t.Errorf("Expected the two-factor page, but got %q", rr.Header().Get("Location"))
+	}
+	var challenge bool
+	for _, c := range rr.Result().Cookies() {
+		switch c.Name {
+		case loginChallengeCookie:
+			challenge = true
+		case "sessid":
+			t.Error("Expected no session before the second factor")
+		}
+	}
+	if !challenge {
+		t.Error("Expected a login challenge cookie")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCLogin_Rejected(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	a, mock := newOIDCTestApp(t, provider)
+
+	// A callback with another state is refused before the code is used
+	cookie, params := startOIDCLogin(t, a)
+	provider.codes["code-1"] = mockOIDCCode{challenge: params.Get("code_challenge"), claims: map[string]interface{}{"sub": "1", "nonce": params.Get("nonce")}}
+	if rr := finishOIDCLogin(a, cookie, "forged", "code-1"); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a forged state to be refused, but got %q", rr.Header().Get("Location"))
+	}
+
+	// An ID token for another nonce is refused
+	cookie, params = startOIDCLogin(t, a)
+	provider.codes["code-2"] = mockOIDCCode{challenge: params.Get("code_challenge"), claims: map[string]interface{}{"sub": "1", "nonce": "replayed"}}
+	if rr := finishOIDCLogin(a, cookie, params.Get("state"), "code-2"); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a wrong nonce to be refused, but got %q", rr.Header().Get("Location"))
+	}
+
+	// A code sent without the matching PKCE verifier is refused by the provider
+	cookie, params = startOIDCLogin(t, a)
+	provider.codes["code-3"] = mockOIDCCode{challenge: "another challenge", claims: map[string]interface{}{"sub": "1", "nonce": params.Get("nonce")}}
+	if rr := finishOIDCLogin(a, cookie, params.Get("state"), "code-3"); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a wrong verifier to be refused, but got %q", rr.Header().Get("Location"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCUser_LinkByEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+	cfg := OIDCConfig{LinkByEmail: true}
+
+	mock.ExpectQuery("UPDATE user_identities").WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM users WHERE LOWER\\(email\\) = LOWER\\(\\$1\\) AND password = ''").WithArgs("mydog7@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("mydog7"))
+	mock.ExpectExec("INSERT INTO user_identities").WithArgs("https://idp.example.com", "42", "mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	username, err := a.oidcUser(cfg, "https://idp.example.com", oidcClaims{Subject: "42", Email: "mydog7@example.com", EmailVerified: true}, "")
+	if err != nil || username != "mydog7" {
+		t.Errorf("Expected the existing user, but got %q, %v", username, err)
+	}
+
+	// Users with a password are not linked, and no user is created
+	mock.ExpectQuery("UPDATE user_identities").WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM users WHERE LOWER\\(email\\) = LOWER\\(\\$1\\) AND password = ''").WithArgs("admin@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectRollback()
+	if _, err := a.oidcUser(cfg, "https://idp.example.com", oidcClaims{Subject: "44", Email: "admin@example.com", EmailVerified: true}, ""); err != errNoLinkedUser {
+		t.Errorf("Expected errNoLinkedUser, but got %v", err)
+	}
+
+	// Without a verified address nothing is linked, and no user is created
+	mock.ExpectQuery("UPDATE user_identities").WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	if _, err := a.oidcUser(cfg, "https://idp.example.com", oidcClaims{Subject: "43", Email: "mydog7@example.com"}, ""); err != errNoLinkedUser {
+		t.Errorf("Expected errNoLinkedUser, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	tests := []struct {
+		preferred, email, subject, want string
+	}{
+		{"jane.doe", "", "1", "jane.doe"},
+		{"", "jane@example.com", "1", "jane"},
+		{"Jane Doe!", "", "1", "JaneDoe"},
+		{"", "", "abc|123", "user-abc123"},
+	}
+
+	for _, tt := range tests {
+		if got := oidcUsername(tt.preferred, tt.email, tt.subject); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultOrganizationID is the organization created by the migration, which
+// existing and newly registered users belong to.
+const defaultOrganizationID = 1
+
+// maxOrganizationNameLength is the longest organization name accepted.
+const maxOrganizationNameLength = 100
+
+var (
+	errOrganizationNameTaken   = errors.New("an organization with this name already exists")
+	errInvalidOrganizationName = fmt.Errorf("organization names must have 1 to %d characters", maxOrganizationNameLength)
+	errDelegateNotFound        = errors.New("delegated user not found")
+)
+
+// Organization is a separate space of users and their notes.
+type Organization struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+// inSameOrganization reports whether other is a user in the organization of username.
+func (a *App) inSameOrganization(username, other string) (bool, error) {
+	var same bool
+	err := a.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u INNER JOIN users o ON o.org_id = u.org_id
+			WHERE u.username = $1 AND o.username = $2
+		)`, username, other).Scan(&same)
+	return same, err
+}
+
+// checkDelegate returns errDelegateNotFound unless delegate is empty or a
+// user in the organization of username.
+func (a *App) checkDelegate(username, delegate string) error {
+	if delegate == "" {
+		return nil
+	}
+
+	same, err := a.inSameOrganization(username, delegate)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return errDelegateNotFound
+	}
+	return nil
+}
+
+// listOrganizations returns all organizations with their number of users.
+func (a *App) listOrganizations() ([]Organization, error) {
+	rows, err := a.db.Query(`
+		SELECT o.id, o.name, (SELECT COUNT(*) FROM users u WHERE u.org_id = o.id)
+		FROM organizations o
+		ORDER BY LOWER(o.name)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Users); err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, o)
+	}
+
+	return organizations, rows.Err()
+}
+
+// createOrganization creates an organization and returns its ID.
+func (a *App) createOrganization(name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxOrganizationNameLength {
+		return 0, errInvalidOrganizationName
+	}
+
+	var taken bool
+	if err := a.db.QueryRow("SELECT EXISTS (SELECT 1 FROM organizations WHERE LOWER(name) = LOWER($1))", name).Scan(&taken); err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, errOrganizationNameTaken
+	}
+
+	var id int
+	err := a.db.QueryRow("INSERT INTO organizations (name) VALUES ($1) RETURNING id", name).Scan(&id)
+	return id, err
+}
+
+// moveToOrganization moves a user with their notes to the organization
+// called orgName. Shares, delegations and group memberships that would
+// cross organizations afterwards are removed.
+func moveToOrganization(tx *sql.Tx, username, orgName string) error {
+	var orgID int
+	err := tx.QueryRow("SELECT id FROM organizations WHERE LOWER(name) = LOWER($1)", orgName).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return userActionError(fmt.Sprintf("Organization %s does not exist.", orgName))
+	}
+	if err != nil {
+		return err
+	}
+
+	var owned int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM groups WHERE owner = $1 AND org_id != $2", username, orgID).Scan(&owned); err != nil {
+		return err
+	}
+	if owned > 0 {
+		return userActionError(fmt.Sprintf("%s owns groups in their organization. Delete them first.", username))
+	}
+
+	if err := execOne(tx, "UPDATE users SET org_id = $2 WHERE username = $1", username, orgID); err != nil {
+		return err
+	}
+
+	// Users outside the new organization
+	const outside = "(SELECT username FROM users WHERE org_id != $2)"
+	statements := []string{
+		// Shares of the user's notes and shares of other notes with the user
+		"DELETE FROM user_shares WHERE note_id IN (SELECT id FROM notes WHERE owner = $1) AND username IN " + outside,
+		"DELETE FROM user_shares WHERE username = $1 AND note_id IN (SELECT id FROM notes WHERE owner IN " + outside + ")",
+		// Shares of the user's notebooks and shares of other notebooks with the user
+		"DELETE FROM notebook_shares WHERE notebook_id IN (SELECT id FROM notebooks WHERE owner = $1) AND username IN " + outside,
+		"DELETE FROM notebook_shares WHERE username = $1 AND notebook_id IN (SELECT id FROM notebooks WHERE owner IN " + outside + ")",
+		"DELETE FROM group_shares WHERE note_id IN (SELECT id FROM notes WHERE owner = $1) AND group_id IN (SELECT id FROM groups WHERE org_id != $2)",
+		"DELETE FROM group_members WHERE username = $1 AND group_id IN (SELECT id FROM groups WHERE org_id != $2)",
+		"UPDATE notes SET noteDelegation = NULL WHERE owner = $1 AND noteDelegation IN " + outside,
+		"UPDATE notes SET noteDelegation = NULL WHERE noteDelegation = $1 AND owner IN " + outside,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, username, orgID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apiListOrganizationsHandler lists all organizations.
+func (a *App) apiListOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	organizations, err := a.listOrganizations()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, organizations)
+}
+
+// apiCreateOrganizationHandler creates an organization.
+func (a *App) apiCreateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := a.createOrganization(in.Name)
+	switch {
+	case errors.Is(err, errInvalidOrganizationName):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, errOrganizationNameTaken):
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, Organization{ID: id, Name: strings.TrimSpace(in.Name)})
+}
+
+// adminCreateOrganizationHandler creates an organization from the admin console.
+func (a *App) adminCreateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+
+	message := fmt.Sprintf("Organization %s has been created.", strings.TrimSpace(name))
+	_, err := a.createOrganization(name)
+	switch {
+	case errors.Is(err, errInvalidOrganizationName), errors.Is(err, errOrganizationNameTaken):
+		message = err.Error()
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/admin",
+	})
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthorizeNote_OtherOrganization(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	// The access query only finds notes whose owner is in the user's organization
+	mock.ExpectQuery(noteAccessQuery+" .* o.org_id = \\(SELECT org_id FROM users WHERE username = \\$2\\)").
+		WithArgs(7, "outsider").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}))
+
+	if err := a.authorizeNote(context.Background(), "outsider", 7, noteActionRead); err != errNoteNotFound {
+		t.Errorf("Expected errNoteNotFound, but got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIPutDelegation_OtherOrganization(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, nil))
+	mock.ExpectQuery("SELECT EXISTS \\( SELECT 1 FROM users u INNER JOIN users o").WithArgs("mydog7", "outsider").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	body := strings.NewReader(`{"username": "outsider"}`)
+	req := loginRequest(httptest.NewRequest("PUT", "/api/v1/notes/1/delegation", body), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusNotFound, rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPerformUserAction_Organization(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	// Unknown organization
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM organizations").WithArgs("Nowhere").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+	var actionErr userActionError
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "organization", "Nowhere"); !errors.As(err, &actionErr) {
+		t.Errorf("Expected a userActionError, but got %v", err)
+	}
+
+	// Owners of groups stay until the groups are deleted
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM organizations").WithArgs("Sales").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM groups").WithArgs("BIGCAT", 2).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "organization", "Sales"); !errors.As(err, &actionErr) {
+		t.Errorf("Expected a userActionError, but got %v", err)
+	}
+
+	// Links to the old organization are removed
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM organizations").WithArgs("Sales").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM groups").WithArgs("BIGCAT", 2).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("UPDATE users SET org_id").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_shares WHERE note_id IN").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_shares WHERE username").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM notebook_shares WHERE notebook_id IN").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM notebook_shares WHERE username").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM group_shares").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM group_members").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE notes SET noteDelegation = NULL WHERE owner").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE notes SET noteDelegation = NULL WHERE noteDelegation").WithArgs("BIGCAT", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if _, err := a.performUserAction("mydog7", "BIGCAT", "organization", "Sales"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPICreateOrganization(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectAdmin := func() {
+		expectActiveUser(mock, "mydog7")
+		mock.ExpectQuery("SELECT role").WithArgs("mydog7", roleAdmin).
+			WillReturnRows(sqlmock.NewRows([]string{"admin"}).AddRow(true))
+	}
+
+	expectAdmin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("Sales").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("INSERT INTO organizations").WithArgs("Sales").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/admin/organizations", strings.NewReader(`{"name": "Sales"}`)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	expectAdmin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("sales").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/admin/organizations", strings.NewReader(`{"name": "sales"}`)), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, but got %d", http.StatusConflict, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordPolicy checks new passwords against the configured rules.
+type passwordPolicy struct {
+	minLength int
+	maxLength int
+
+	// breached holds the upper case hex SHA-1 of every breached password
+	breached map[string]struct{}
+}
+
+// passwordSHA1 returns the upper case hex SHA-1 of a password, as used in breach corpora.
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// isSHA1Hex reports whether s looks like a hex encoded SHA-1.
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// newPasswordPolicy creates the policy, loading the breached password list if one is configured.
+func newPasswordPolicy(cfg PasswordConfig) (*passwordPolicy, error) {
+	p := &passwordPolicy{
+		minLength: cfg.MinLength,
+		maxLength: cfg.MaxLength,
+		breached:  make(map[string]struct{}),
+	}
+	if cfg.BreachedListFile == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.BreachedListFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening breached password list: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		// Hash lists may carry a count after the hash
+		hash, _, _ := strings.Cut(line, ":")
+		if isSHA1Hex(hash) {
+			p.breached[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			p.breached[passwordSHA1(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading breached password list: %v", err)
+	}
+
+	log.Printf("Loaded %d breached passwords", len(p.breached))
+	return p, nil
+}
+
+// check returns an error, worded for the user, when password may not be used.
+func (p *passwordPolicy) check(username, password string) error {
+	if utf8.RuneCountInString(password) < p.minLength {
+		return fmt.Errorf("Password must have at least %d characters.", p.minLength)
+	}
+	if len(password) > p.maxLength {
+		return fmt.Errorf("Password must not be longer than %d bytes.", p.maxLength)
+	}
+	if strings.EqualFold(password, username) {
+		return errors.New("Password must be different from the username.")
+	}
+	if _, ok := p.breached[passwordSHA1(password)]; ok {
+		return errors.New("This password has appeared in a data breach. Please choose a different one.")
+	}
+
+	return nil
+}
+
+// passwordPolicy returns the policy loaded at startup, or the default rules.
+func (a *App) passwordPolicy() *passwordPolicy {
+	if a.passwords != nil {
+		return a.passwords
+	}
+
+	p, _ := newPasswordPolicy(defaultConfig().Password)
+	return p
+}
+
+// changePassword replaces the password of a user and ends their sessions
+// other than the one with keepSessionHash.
+func (a *App) changePassword(username, newPassword, keepSessionHash string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET password = $2 WHERE username = $1", username, hash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE username = $1 AND id_hash <> $2", username, keepSessionHash); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// changePasswordHandler shows the change password form and changes the
+// password after checking the current one.
+func (a *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	// Check for a message cookie
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/account/password"})
+	}
+
+	if r.Method != http.MethodPost {
+		tmpl, err := template.ParseFiles("tmpl/password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var email sql.NullString
+		if err := a.db.QueryRow("SELECT email FROM users WHERE username = $1", username).Scan(&email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		admin, err := a.isAdmin(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Username  string
+			Email     string
+			IsAdmin   bool
+			Message   string
+			CSRFToken string
+		}{
+			Username:  username,
+			Email:     email.String,
+			IsAdmin:   admin,
+			Message:   message,
+			CSRFToken: csrfToken(r),
+		}
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	redirectWithMessage := func(message string) {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: message,
+			Path:  "/account/password",
+		})
+		http.Redirect(w, r, "/account/password", http.StatusSeeOther)
+	}
+
+	current := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+
+	var hash string
+	err := a.db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&hash)
+	if err == sql.ErrNoRows || (err == nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(current)) != nil) {
+		redirectWithMessage("The current password is not correct.")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if newPassword != r.FormValue("new_password_again") {
+		redirectWithMessage("The new passwords do not match.")
+		return
+	}
+	if err := a.passwordPolicy().check(username, newPassword); err != nil {
+		redirectWithMessage(err.Error())
+		return
+	}
+
+	var keep string
+	if sess := session.Get(r); sess != nil {
+		keep = hashSessionID(sess.ID())
+	}
+	if err := a.changePassword(username, newPassword, keep); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s changed their password", username)
+	redirectWithMessage("Your password has been changed. Your other sessions have been signed out.")
+}
+
+// emailTaken reports whether another user than username already has email.
+func (a *App) emailTaken(email, username string) (bool, error) {
+	var taken bool
+	err := a.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND username <> $2)",
+		email, username).Scan(&taken)
+	return taken, err
+}
+
+// changeEmailHandler sets or clears the email address used for password
+// resets, after checking the current password.
+func (a *App) changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	redirectWithMessage := func(message string) {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: message,
+			Path:  "/account/password",
+		})
+		http.Redirect(w, r, "/account/password", http.StatusSeeOther)
+	}
+
+	var hash string
+	err := a.db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&hash)
+	if err == sql.ErrNoRows || (err == nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.FormValue("current_password"))) != nil) {
+		redirectWithMessage("The current password is not correct.")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	email, err := normalizeEmail(r.FormValue("email"))
+	if err != nil {
+		redirectWithMessage(err.Error())
+		return
+	}
+	if email != "" {
+		taken, err := a.emailTaken(email, username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			redirectWithMessage("This email address is already used by another account.")
+			return
+		}
+	}
+
+	_, err = a.db.Exec("UPDATE users SET email = $2 WHERE username = $1", username, sql.NullString{String: email, Valid: email != ""})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s changed their email address", username)
+	if email == "" {
+		redirectWithMessage("Your email address has been removed.")
+		return
+	}
+	redirectWithMessage("Your email address has been changed.")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	// The list mixes plain passwords with hashes in the breach corpus format
+	list := "letmein123\n" + passwordSHA1("correcthorse") + ":4211\n\n"
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := newPasswordPolicy(PasswordConfig{MinLength: 8, MaxLength: 72, BreachedListFile: path})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"", false},
+		{"short", false},
+		{"mydog7mydog7", true},
+		{"LONGUSERNAME", false},
+		{strings.Repeat("a", 73), false},
+		{"letmein123", false},
+		{"correcthorse", false},
+		{"a much better passphrase", true},
+	}
+
+	for _, tt := range tests {
+		err := policy.check("longusername", tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.password, err)
+		}
+	}
+}
+
+func TestNewPasswordPolicy_MissingFile(t *testing.T) {
+	_, err := newPasswordPolicy(PasswordConfig{MinLength: 8, MaxLength: 72, BreachedListFile: "does-not-exist.txt"})
+	if err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+// postPasswordChange submits the change password form for mydog7.
+func postPasswordChange(a *App, current, newPassword, again string) (*httptest.ResponseRecorder, string) {
+	form := url.Values{"current_password": {current}, "new_password": {newPassword}, "new_password_again": {again}}
+	req := loginRequest(httptest.NewRequest("POST", "/account/password", strings.NewReader(form.Encode())), "mydog7")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	a.changePasswordHandler(rr, req)
+
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "message" {
+			return rr, c.Value
+		}
+	}
+	return rr, ""
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+	expectCurrent := func() {
+		mock.ExpectQuery("SELECT password FROM users").WithArgs("mydog7").
+			WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(hash)))
+	}
+
+	// Wrong current password
+	expectCurrent()
+	if _, message := postPasswordChange(&a, "wrong", "a new passphrase", "a new passphrase"); !strings.Contains(message, "current password") {
+		t.Errorf("Expected the current password to be rejected, but got %q", message)
+	}
+
+	// New password against the policy
+	expectCurrent()
+	if _, message := postPasswordChange(&a, "admin", "short", "short"); !strings.Contains(message, "at least") {
+		t.Errorf("Expected the policy to be applied, but got %q", message)
+	}
+
+	// Success ends the other sessions in the same transaction
+	expectCurrent()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET password").WithArgs("mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions WHERE username = \\$1 AND id_hash <> \\$2").
+		WithArgs("mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	rr, message := postPasswordChange(&a, "admin", "a new passphrase", "a new passphrase")
+	if rr.Code != http.StatusSeeOther || !strings.Contains(message, "has been changed") {
+		t.Errorf("Expected the password to be changed, but got %d %q", rr.Code, message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangePassword_KeepsCurrentSession(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	sess := session.NewSession()
+	keep := hashSessionID(sess.ID())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET password").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions").WithArgs("mydog7", keep).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := a.changePassword("mydog7", "a new passphrase", keep); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Messages shown by the password reset flow. The same message is shown
+// whether or not an account matched, so that the page does not reveal
+// which accounts or addresses exist.
+const (
+	msgResetSent        = "If an account with an email address matches, a link to reset the password has been sent to it."
+	msgResetInvalid     = "This password reset link is invalid or has expired."
+	msgResetUnavailable = "Password reset by email is not available. Please ask an administrator to reset your password."
+)
+
+// resetRequestInterval is the minimum time between two reset emails for the same account.
+const resetRequestInterval = time.Minute
+
+// generateResetToken returns a new random password reset token.
+func generateResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// mailConfig returns the mail settings.
+func (a *App) mailConfig() MailConfig {
+	if a.config == nil {
+		return defaultConfig().Mail
+	}
+	return a.config.Mail
+}
+
+// getMailer returns the configured mailer, or one writing to the log.
+func (a *App) getMailer() Mailer {
+	if a.mailer != nil {
+		return a.mailer
+	}
+	return &logMailer{from: a.mailConfig().From}
+}
+
+// publicURL returns the configured base URL for links sent to users, or ""
+// when public_url is not set. Links are never built from the request, whose
+// Host header is chosen by the client.
+func (a *App) publicURL() string {
+	if a.config == nil {
+		return ""
+	}
+	return strings.TrimRight(a.config.Server.PublicURL, "/")
+}
+
+// normalizeEmail validates an optional email address entered by a user.
+// It returns "" for an empty address.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email || len(email) > 255 {
+		return "", fmt.Errorf("%q is not a valid email address.", email)
+	}
+	return addr.Address, nil
+}
+
+// createPasswordReset stores a new reset token for the account with the given
+// username or email address. It returns the token and the address to send it
+// to, or sql.ErrNoRows when no account with an email address matches or a
+// link was sent to it very recently.
+func (a *App) createPasswordReset(login string) (token, username, email string, err error) {
+	err = a.db.QueryRow(`
+		SELECT username, email FROM users
+		WHERE (username = $1 OR LOWER(email) = LOWER($1)) AND email IS NOT NULL
+		LIMIT 1`, login).Scan(&username, &email)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	now := time.Now().UTC()
+	var recent bool
+	err = a.db.QueryRow("SELECT EXISTS (SELECT 1 FROM password_resets WHERE username = $1 AND created_at > $2)",
+		username, now.Add(-resetRequestInterval)).Scan(&recent)
+	if err != nil {
+		return "", "", "", err
+	}
+	if recent {
+		return "", "", "", sql.ErrNoRows
+	}
+
+	token, err = generateResetToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// Only the newest link of an account can be used
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE username = $1 AND used_at IS NULL", username); err != nil {
+		return "", "", "", err
+	}
+	_, err = tx.Exec("INSERT INTO password_resets (username, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		username, hashAPIToken(token), now, now.Add(a.mailConfig().ResetTokenTTL))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return token, username, email, tx.Commit()
+}
+
+// lookupPasswordReset returns the username a reset token belongs to, or
+// sql.ErrNoRows when the token is unknown, used or expired.
+func (a *App) lookupPasswordReset(token string) (string, error) {
+	var username string
+	err := a.db.QueryRow(`
+		SELECT username FROM password_resets
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`,
+		hashAPIToken(token), time.Now().UTC()).Scan(&username)
+	return username, err
+}
+
+// resetPassword uses a reset token to set a new password. The token is
+// marked as used, and all sessions and failed logins of the account are
+// removed. It returns sql.ErrNoRows when the token cannot be used.
+func (a *App) resetPassword(token, newPassword string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Marking the token in the same statement makes it single-use, even
+	// with concurrent requests
+	var username string
+	err = tx.QueryRow(`
+		UPDATE password_resets SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		RETURNING username`, hashAPIToken(token), time.Now().UTC()).Scan(&username)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password = $2 WHERE username = $1", username, hash); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE username = $1", username); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE kind = $1 AND key = $2", loginFailureUser, username); err != nil {
+		return "", err
+	}
+
+	return username, tx.Commit()
+}
+
+// forgotPasswordHandler shows the forgot password form and emails a reset
+// link to the matching account.
+func (a *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		tmpl, err := template.ParseFiles("tmpl/forgot_password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Without a public URL the link could only point to the Host of the
+	// request, which would send the token to whoever chose it
+	baseURL := a.publicURL()
+	if baseURL == "" {
+		log.Printf("Password reset refused: server public_url is not set")
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: msgResetUnavailable,
+			Path:  "/",
+		})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	login := strings.TrimSpace(r.FormValue("login"))
+	token, username, email, err := a.createPasswordReset(truncate(login, 255))
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		link := baseURL + "/reset-password?token=" + url.QueryEscape(token)
+		msg := MailMessage{
+			To:      email,
+			Subject: "Reset your Notes password",
+			Body: fmt.Sprintf("Hello %s,\n\n"+
+				"Someone asked to reset the password of your Notes account. "+
+				"To choose a new password, open this link within %s:\n\n%s\n\n"+
+				"If you did not ask for this, you can ignore this email.\n",
+				username, a.mailConfig().ResetTokenTTL, link),
+		}
+
+		// Sending in the background keeps the response time the same
+		// whether or not an account matched
+		mailer := a.getMailer()
+		go func() {
+			if err := mailer.Send(msg); err != nil {
+				log.Printf("Sending the password reset email for %s failed: %v", username, err)
+			}
+		}()
+		log.Printf("Password reset requested for %s", username)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: msgResetSent,
+		Path:  "/",
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// resetPasswordHandler shows the new password form for a reset link and
+// sets the new password.
+func (a *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	invalidLink := func() {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: msgResetInvalid,
+			Path:  "/",
+		})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+
+	username, err := a.lookupPasswordReset(token)
+	if err == sql.ErrNoRows {
+		invalidLink()
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check for a message cookie
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/reset-password"})
+	}
+
+	if r.Method != http.MethodPost {
+		tmpl, err := template.ParseFiles("tmpl/reset_password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Username string
+			Token    string
+			Message  string
+		}{
+			Username: username,
+			Token:    token,
+			Message:  message,
+		}
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	redirectWithMessage := func(message string) {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: message,
+			Path:  "/reset-password",
+		})
+		http.Redirect(w, r, "/reset-password?token="+url.QueryEscape(token), http.StatusSeeOther)
+	}
+
+	newPassword := r.FormValue("new_password")
+	if newPassword != r.FormValue("new_password_again") {
+		redirectWithMessage("The new passwords do not match.")
+		return
+	}
+	if err := a.passwordPolicy().check(username, newPassword); err != nil {
+		redirectWithMessage(err.Error())
+		return
+	}
+
+	username, err = a.resetPassword(token, newPassword)
+	if err == sql.ErrNoRows {
+		invalidLink()
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s reset their password", username)
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: "Your password has been reset. Please log in.",
+		Path:  "/",
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// chanMailer hands sent messages to the test.
+type chanMailer chan MailMessage
+
+func (m chanMailer) Send(msg MailMessage) error {
+	m <- msg
+	return nil
+}
+
+// postForm submits a public form to handler and returns the message shown afterwards.
+func postForm(handler http.HandlerFunc, path string, form url.Values) (*httptest.ResponseRecorder, string) {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "message" {
+			return rr, c.Value
+		}
+	}
+	return rr, ""
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+		ok    bool
+	}{
+		{"", "", true},
+		{" mydog7@example.com ", "mydog7@example.com", true},
+		{"not an address", "", false},
+		{"My Dog <mydog7@example.com>", "", false},
+		{"mydog7@example.com\r\nBcc: x@example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeEmail(tt.email)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %q, %v", tt.email, got, err)
+		}
+	}
+}
+
+func TestForgotPasswordHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mails := make(chanMailer, 1)
+	cfg := defaultConfig()
+	cfg.Server.PublicURL = "https://notes.example.com/"
+	a := App{db: db, config: cfg, mailer: mails}
+
+	// Unknown account
+	mock.ExpectQuery("SELECT username, email FROM users").WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}))
+	_, unknown := postForm(a.forgotPasswordHandler, "/forgot-password", url.Values{"login": {"nobody"}})
+
+	// Known account, looked up by email address
+	mock.ExpectQuery("SELECT username, email FROM users").WithArgs("mydog7@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).AddRow("mydog7", "mydog7@example.com"))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("mydog7", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM password_resets").WithArgs("mydog7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO password_resets").
+		WithArgs("mydog7", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	_, known := postForm(a.forgotPasswordHandler, "/forgot-password", url.Values{"login": {"mydog7@example.com"}})
+
+	if unknown != msgResetSent || known != msgResetSent {
+		t.Errorf("Expected the same message, but got %q and %q", unknown, known)
+	}
+
+	select {
+	case msg := <-mails:
+		if msg.To != "mydog7@example.com" || !strings.Contains(msg.Body, "https://notes.example.com/reset-password?token=") {
+			t.Errorf("Unexpected email to %s: %s", msg.To, msg.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a reset email to be sent")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestForgotPasswordHandler_NoPublicURL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// No token is created and nothing is sent, whatever the Host header says
+	mails := make(chanMailer, 1)
+	a := App{db: db, config: defaultConfig(), mailer: mails}
+	_, message := postForm(a.forgotPasswordHandler, "/forgot-password", url.Values{"login": {"mydog7"}})
+
+	if message != msgResetUnavailable {
+		t.Errorf("Expected %q, but got %q", msgResetUnavailable, message)
+	}
+	select {
+	case msg := <-mails:
+		t.Errorf("Unexpected email to %s: %s", msg.To, msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	token := "a-reset-token"
+	expectLookup := func() {
+		mock.ExpectQuery("SELECT username FROM password_resets").WithArgs(hashAPIToken(token), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("mydog7"))
+	}
+
+	// The policy is applied
+	expectLookup()
+	rr, message := postForm(a.resetPasswordHandler, "/reset-password",
+		url.Values{"token": {token}, "new_password": {"short"}, "new_password_again": {"short"}})
+	if !strings.Contains(message, "at least") || !strings.HasPrefix(rr.Header().Get("Location"), "/reset-password?token=") {
+		t.Errorf("Expected the policy to be applied, but got %q", message)
+	}
+
+	// Success uses the token, ends all sessions and clears the lockout
+	expectLookup()
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE password_resets SET used_at").WithArgs(hashAPIToken(token), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("mydog7"))
+	mock.ExpectExec("UPDATE users SET password").WithArgs("mydog7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions WHERE username = \\$1$").WithArgs("mydog7").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM login_failures").WithArgs(loginFailureUser, "mydog7").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	form := url.Values{"token": {token}, "new_password": {"a new passphrase"}, "new_password_again": {"a new passphrase"}}
+	if _, message := postForm(a.resetPasswordHandler, "/reset-password", form); !strings.Contains(message, "has been reset") {
+		t.Errorf("Expected the password to be reset, but got %q", message)
+	}
+
+	// The token cannot be used again
+	mock.ExpectQuery("SELECT username FROM password_resets").WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	if _, message := postForm(a.resetPasswordHandler, "/reset-password", form); message != msgResetInvalid {
+		t.Errorf("Expected a used token to be refused, but got %q", message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
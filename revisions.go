@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// NoteRevision is the content of a note as saved by one edit.
+type NoteRevision struct {
+	NoteID             int       `json:"note_id"`
+	Revision           int       `json:"revision"`
+	EditedBy           string    `json:"edited_by"`
+	EditedAt           time.Time `json:"edited_at"`
+	Title              string    `json:"title"`
+	NoteType           string    `json:"note_type"`
+	Description        string    `json:"description"`
+	TaskCompletionTime string    `json:"task_completion_time"`
+	TaskCompletionDate string    `json:"task_completion_date"`
+	NoteStatus         string    `json:"note_status"`
+	NoteDelegation     string    `json:"note_delegation"`
+}
+
+// FieldChange is a field whose value differs between two revisions.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// revisionDiff is the JSON response for the changes between two revisions.
+type revisionDiff struct {
+	NoteID  int           `json:"note_id"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// revisionFields returns the fields of a revision that are compared, named as
+// in the JSON representation of notes.
+func revisionFields(r NoteRevision) [][2]string {
+	return [][2]string{
+		{"title", r.Title},
+		{"note_type", r.NoteType},
+		{"description", r.Description},
+		{"task_completion_time", r.TaskCompletionTime},
+		{"task_completion_date", r.TaskCompletionDate},
+		{"note_status", r.NoteStatus},
+		{"note_delegation", r.NoteDelegation},
+	}
+}
+
+// diffRevisions lists the fields that changed from one revision to another.
+func diffRevisions(from, to NoteRevision) []FieldChange {
+	changes := []FieldChange{}
+	fromFields, toFields := revisionFields(from), revisionFields(to)
+	for i := range toFields {
+		if fromFields[i][1] != toFields[i][1] {
+			changes = append(changes, FieldChange{Field: toFields[i][0], From: fromFields[i][1], To: toFields[i][1]})
+		}
+	}
+	return changes
+}
+
+// recordRevision saves the current content of a note as its next revision.
+func (a *App) recordRevision(noteID int, editor string) error {
+	_, err := a.db.Exec(`
+		INSERT INTO note_revisions (note_id, revision, edited_by, title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation)
+		SELECT id, COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = $1), 0) + 1, $2,
+			title, noteType, description, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation
+		FROM notes
+		WHERE id = $1`, noteID, editor)
+	return err
+}
+
+// revisionColumns are the columns scanned by scanRevision.
+const revisionColumns = `note_id, revision, COALESCE(edited_by, ''), edited_at, title, noteType, description,
+	COALESCE(taskCompletionTime, ''), COALESCE(taskCompletionDate, ''), COALESCE(noteStatus, ''), COALESCE(noteDelegation, '')`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRevision(row rowScanner) (NoteRevision, error) {
+	var r NoteRevision
+	err := row.Scan(&r.NoteID, &r.Revision, &r.EditedBy, &r.EditedAt, &r.Title, &r.NoteType, &r.Description,
+		&r.TaskCompletionTime, &r.TaskCompletionDate, &r.NoteStatus, &r.NoteDelegation)
+	return r, err
+}
+
+// listRevisions returns the revisions of a note, newest first.
+func (a *App) listRevisions(noteID int) ([]NoteRevision, error) {
+	rows, err := a.db.Query("SELECT "+revisionColumns+" FROM note_revisions WHERE note_id = $1 ORDER BY revision DESC", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+// getRevision returns one revision of a note, or errRevisionNotFound.
+func (a *App) getRevision(noteID, revision int) (NoteRevision, error) {
+	r, err := scanRevision(a.db.QueryRow("SELECT "+revisionColumns+" FROM note_revisions WHERE note_id = $1 AND revision = $2", noteID, revision))
+	if err == sql.ErrNoRows {
+		return r, errRevisionNotFound
+	}
+	return r, err
+}
+
+// diffAgainst returns the changes from revision from to revision to of a
+// note. Revision 0 stands for the empty note before the first revision.
+func (a *App) diffAgainst(noteID, from, to int) ([]FieldChange, error) {
+	newer, err := a.getRevision(noteID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var older NoteRevision
+	if from > 0 {
+		if older, err = a.getRevision(noteID, from); err != nil {
+			return nil, err
+		}
+	}
+
+	return diffRevisions(older, newer), nil
+}
+
+// restoreRevision writes the content of a revision back to the note, which
+// records it as a new revision. A delegation to a user who has since left
+// the organization of the owner is not restored.
+func (a *App) restoreRevision(noteID, revision int, editor string) (*Note, error) {
+	r, err := a.getRevision(noteID, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the owner may hand the note to someone else, so restores by
+	// other users keep the current delegate
+	delegation := note.NoteDelegation.String
+	if editor == note.Owner {
+		delegation = r.NoteDelegation
+		if err := a.checkDelegate(note.Owner, delegation); err == errDelegateNotFound {
+			delegation = ""
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	note.Title = r.Title
+	note.NoteType = r.NoteType
+	note.Description = r.Description
+	note.TaskCompletionTime = sql.NullString{String: r.TaskCompletionTime, Valid: r.TaskCompletionTime != ""}
+	note.TaskCompletionDate = sql.NullString{String: r.TaskCompletionDate, Valid: r.TaskCompletionDate != ""}
+	note.NoteStatus = sql.NullString{String: r.NoteStatus, Valid: r.NoteStatus != ""}
+	note.NoteDelegation = sql.NullString{String: delegation, Valid: delegation != ""}
+
+	if err := a.updateNoteInDatabase(*note, editor); err != nil {
+		return nil, err
+	}
+
+	return note, nil
+}
+
+// revisionFromVars parses the revision number in the URL.
+func revisionFromVars(r *http.Request) (int, error) {
+	revision, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil || revision < 1 {
+		return 0, errors.New("invalid revision")
+	}
+	return revision, nil
+}
+
+// apiListRevisionsHandler lists the revisions of a note, newest first.
+func (a *App) apiListRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+
+	revisions, err := a.listRevisions(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, revisions)
+}
+
+// apiGetRevisionHandler returns one revision of a note.
+func (a *App) apiGetRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+	revision, err := revisionFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rev, err := a.getRevision(noteID, revision)
+	if err == errRevisionNotFound {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, rev)
+}
+
+// apiDiffRevisionHandler returns the fields changed by a revision. The from
+// query parameter selects the revision to compare with, by default the
+// previous one.
+func (a *App) apiDiffRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionRead)
+	if !ok {
+		return
+	}
+	revision, err := revisionFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from := revision - 1
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil || from < 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid from revision")
+			return
+		}
+	}
+
+	changes, err := a.diffAgainst(noteID, from, revision)
+	if err == errRevisionNotFound {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, revisionDiff{NoteID: noteID, From: from, To: revision, Changes: changes})
+}
+
+// apiRestoreRevisionHandler restores a revision of a note.
+func (a *App) apiRestoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := a.authorizeAPINote(w, r, noteActionUpdate)
+	if !ok {
+		return
+	}
+	revision, err := revisionFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note, err := a.restoreRevision(noteID, revision, currentUsername(r))
+	if err == errRevisionNotFound {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newNoteResponse(*note))
+}
+
+// historyEntry is a revision with its changes from the previous revision.
+type historyEntry struct {
+	NoteRevision
+	Changes []FieldChange
+}
+
+// noteHistoryHandler shows the revisions of a note with what each one changed.
+func (a *App) noteHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username := currentUsername(r)
+	if err := a.authorizeNote(r.Context(), username, noteID, noteActionRead); err != nil {
+		respondWithNoteAuthError(w, err)
+		return
+	}
+	canRestore := a.authorizeNote(r.Context(), username, noteID, noteActionUpdate) == nil
+
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/notes"})
+	}
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	revisions, err := a.listRevisions(noteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Revisions are newest first, so the previous revision is the next one
+	entries := make([]historyEntry, len(revisions))
+	for i, rev := range revisions {
+		var previous NoteRevision
+		if i+1 < len(revisions) {
+			previous = revisions[i+1]
+		}
+		entries[i] = historyEntry{NoteRevision: rev, Changes: diffRevisions(previous, rev)}
+	}
+
+	tmpl, err := template.ParseFiles("tmpl/note_history.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Note       *Note
+		Revisions  []historyEntry
+		CanRestore bool
+		Message    string
+		CSRFToken  string
+	}{
+		Note:       note,
+		Revisions:  entries,
+		CanRestore: canRestore,
+		Message:    message,
+		CSRFToken:  csrfToken(r),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// restoreRevisionHandler restores a revision from the history page.
+func (a *App) restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revision, err := revisionFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.authorizeNote(r.Context(), currentUsername(r), noteID, noteActionUpdate); err != nil {
+		respondWithNoteAuthError(w, err)
+		return
+	}
+
+	message := fmt.Sprintf("Revision %d has been restored.", revision)
+	if _, err := a.restoreRevision(noteID, revision, currentUsername(r)); err == errRevisionNotFound {
+		message = fmt.Sprintf("Revision %d does not exist.", revision)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/notes",
+	})
+	http.Redirect(w, r, fmt.Sprintf("/notes/%d/history", noteID), http.StatusSeeOther)
+}
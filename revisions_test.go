@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// revisionQuery is the query getRevision uses to load one revision.
+const revisionQuery = "SELECT note_id, revision, .* FROM note_revisions WHERE note_id = \\$1 AND revision = \\$2"
+
+var revisionRowColumns = []string{"note_id", "revision", "edited_by", "edited_at", "title", "notetype", "description",
+	"taskcompletiontime", "taskcompletiondate", "notestatus", "notedelegation"}
+
+func TestDiffRevisions(t *testing.T) {
+	from := NoteRevision{Title: "Shopping", NoteType: "Task", Description: "Milk", NoteStatus: "Pending"}
+	to := NoteRevision{Title: "Shopping", NoteType: "Task", Description: "Milk and eggs", NoteStatus: "Delegated", NoteDelegation: "BIGCAT"}
+
+	want := []FieldChange{
+		{Field: "description", From: "Milk", To: "Milk and eggs"},
+		{Field: "note_status", From: "Pending", To: "Delegated"},
+		{Field: "note_delegation", From: "", To: "BIGCAT"},
+	}
+	if got := diffRevisions(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, but got %+v", want, got)
+	}
+
+	if got := diffRevisions(to, to); len(got) != 0 {
+		t.Errorf("Expected no changes, but got %+v", got)
+	}
+}
+
+func TestAPIDiffRevision(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	editedAt := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeViewer))
+	mock.ExpectQuery(revisionQuery).WithArgs(1, 3).
+		WillReturnRows(sqlmock.NewRows(revisionRowColumns).AddRow(1, 3, "BIGCAT", editedAt, "Groceries", "Note", "Milk", "", "", "", ""))
+	mock.ExpectQuery(revisionQuery).WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows(revisionRowColumns).AddRow(1, 2, "mydog7", editedAt, "Shopping", "Note", "Milk", "", "", "", ""))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/notes/1/revisions/3/diff", nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var diff revisionDiff
+	if err := json.Unmarshal(rr.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldChange{{Field: "title", From: "Shopping", To: "Groceries"}}
+	if diff.From != 2 || diff.To != 3 || !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+
+	// Missing revisions
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeViewer))
+	mock.ExpectQuery(revisionQuery).WithArgs(1, 9).
+		WillReturnRows(sqlmock.NewRows(revisionRowColumns))
+
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/notes/1/revisions/9/diff", nil), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIRestoreRevision(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	editedAt := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	// Viewers cannot restore
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeViewer))
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/revisions/2/restore", nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Editors can, and the restore is a new revision. Only the owner can
+	// change the delegate, so the delegation is not restored.
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeEditor))
+	mock.ExpectQuery(revisionQuery).WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows(revisionRowColumns).AddRow(1, 2, "mydog7", editedAt, "Shopping", "Task", "Milk", "", "", "Delegated", "LITTLECAT"))
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(1, "Groceries", "", "Note", nil, nil, nil, nil, "mydog7", editedAt, 0))
+	mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().
+		WithArgs("Shopping", "Task", "Milk", "", "", "Delegated", "", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("UPDATE notes SET fts_text").ExpectExec().WithArgs(1, "Milk").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(1, "BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/notes/1/revisions/2/restore", nil), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var note noteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &note); err != nil {
+		t.Fatal(err)
+	}
+	if note.Title != "Shopping" || note.NoteDelegation != nil {
+		t.Errorf("Unexpected note %+v", note)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -15,25 +15,124 @@ func (a *App) initializeRoutes() {
 	staticFileDirectory := http.Dir("./statics/")
 	staticFileHandler := http.StripPrefix("/statics/", http.FileServer(staticFileDirectory))
 	a.Router.PathPrefix("/statics/").Handler(staticFileHandler).Methods("GET")
-	a.Router.HandleFunc("/", a.indexHandler).Methods("GET")
 	a.Router.HandleFunc("/login", a.loginHandler).Methods("POST", "GET")
+	a.Router.HandleFunc("/login/2fa", a.loginTwoFactorHandler).Methods("POST", "GET")
+	a.Router.HandleFunc("/login/oidc", a.oidcLoginHandler).Methods("GET")
+	a.Router.HandleFunc("/login/oidc/callback", a.oidcCallbackHandler).Methods("GET")
 	a.Router.HandleFunc("/user-logout", a.logoutHandler).Methods("GET")
 	a.Router.HandleFunc("/register", a.registerHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/list", a.listHandler).Methods("GET")
-	a.Router.HandleFunc("/create", a.createHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/update", a.updateHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/delete", a.deleteHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/share", a.shareHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/search", a.searchNotesHandler).Methods("POST", "GET")
-	a.Router.HandleFunc("/remove-shared-note", a.removeSharedNoteHandler).Methods("POST")
-	a.Router.HandleFunc("/getSharedUsersForNote/{noteID:[0-9]+}", a.getSharedUsersForNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/getUnsharedUsersForNote/{noteID:[0-9]+}", a.getUnsharedUsersForNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/find/{noteID:[0-9]+}", a.findInNoteHandler).Methods("GET")
-	a.Router.HandleFunc("/update-privileges", a.updatePrivilegesHandler).Methods("POST")
-	a.Router.HandleFunc("/remove-delegation/{noteID:[0-9]+}", a.removeDelegationHandler).Methods("POST")
-	
+	a.Router.HandleFunc("/forgot-password", a.forgotPasswordHandler).Methods("POST", "GET")
+	a.Router.HandleFunc("/reset-password", a.resetPasswordHandler).Methods("POST", "GET")
 
+	// Versioned JSON API
+	api := a.Router.PathPrefix("/api/v1").Subrouter()
+	api.Use(a.requireAPIAuth)
+	api.HandleFunc("/notes", a.apiListNotesHandler).Methods("GET")
+	api.HandleFunc("/notes", a.apiCreateNoteHandler).Methods("POST")
+	api.HandleFunc("/notes/{noteID:[0-9]+}", a.apiGetNoteHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}", a.apiPatchNoteHandler).Methods("PATCH")
+	api.HandleFunc("/notes/{noteID:[0-9]+}", a.apiDeleteNoteHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/shares", a.apiListSharesHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/shares", a.apiCreateShareHandler).Methods("POST")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/shares/{username}", a.apiUpdateShareHandler).Methods("PATCH")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/shares/{username}", a.apiDeleteShareHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/delegation", a.apiGetDelegationHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/delegation", a.apiPutDelegationHandler).Methods("PUT")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/delegation", a.apiDeleteDelegationHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/group-shares", a.apiListGroupSharesHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/group-shares", a.apiCreateGroupShareHandler).Methods("POST")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/group-shares/{groupID:[0-9]+}", a.apiUpdateGroupShareHandler).Methods("PATCH")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/group-shares/{groupID:[0-9]+}", a.apiDeleteGroupShareHandler).Methods("DELETE")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/revisions", a.apiListRevisionsHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/revisions/{revision:[0-9]+}", a.apiGetRevisionHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/revisions/{revision:[0-9]+}/diff", a.apiDiffRevisionHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/revisions/{revision:[0-9]+}/restore", a.apiRestoreRevisionHandler).Methods("POST")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/notebook", a.apiGetNoteNotebookHandler).Methods("GET")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/notebook", a.apiPutNoteNotebookHandler).Methods("PUT")
+	api.HandleFunc("/notes/{noteID:[0-9]+}/notebook", a.apiDeleteNoteNotebookHandler).Methods("DELETE")
+	api.HandleFunc("/notebooks", a.apiListNotebooksHandler).Methods("GET")
+	api.HandleFunc("/notebooks", a.apiCreateNotebookHandler).Methods("POST")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}", a.apiGetNotebookHandler).Methods("GET")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}", a.apiUpdateNotebookHandler).Methods("PATCH")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}", a.apiDeleteNotebookHandler).Methods("DELETE")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}/shares", a.apiListNotebookSharesHandler).Methods("GET")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}/shares", a.apiCreateNotebookShareHandler).Methods("POST")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}/shares/{username}", a.apiUpdateNotebookShareHandler).Methods("PATCH")
+	api.HandleFunc("/notebooks/{notebookID:[0-9]+}/shares/{username}", a.apiDeleteNotebookShareHandler).Methods("DELETE")
+	api.HandleFunc("/tags", a.apiTagCloudHandler).Methods("GET")
+	api.HandleFunc("/trash", a.apiListTrashHandler).Methods("GET")
+	api.HandleFunc("/trash/{noteID:[0-9]+}/restore", a.apiRestoreTrashHandler).Methods("POST")
+	api.HandleFunc("/trash/{noteID:[0-9]+}", a.apiPurgeTrashHandler).Methods("DELETE")
+	api.HandleFunc("/groups", a.apiListGroupsHandler).Methods("GET")
+	api.HandleFunc("/groups", a.apiCreateGroupHandler).Methods("POST")
+	api.HandleFunc("/groups/{groupID:[0-9]+}", a.apiGetGroupHandler).Methods("GET")
+	api.HandleFunc("/groups/{groupID:[0-9]+}", a.apiRenameGroupHandler).Methods("PATCH")
+	api.HandleFunc("/groups/{groupID:[0-9]+}", a.apiDeleteGroupHandler).Methods("DELETE")
+	api.HandleFunc("/groups/{groupID:[0-9]+}/members/{username}", a.apiAddGroupMemberHandler).Methods("PUT")
+	api.HandleFunc("/groups/{groupID:[0-9]+}/members/{username}", a.apiRemoveGroupMemberHandler).Methods("DELETE")
 
+	// Tokens and sessions, managed from a logged in session only
+	sessionOnly := api.NewRoute().Subrouter()
+	sessionOnly.Use(rejectTokens)
+	sessionOnly.HandleFunc("/tokens", a.apiListTokensHandler).Methods("GET")
+	sessionOnly.HandleFunc("/tokens", a.apiCreateTokenHandler).Methods("POST")
+	sessionOnly.HandleFunc("/tokens/{tokenID:[0-9]+}", a.apiRevokeTokenHandler).Methods("DELETE")
+	sessionOnly.HandleFunc("/sessions", a.apiListSessionsHandler).Methods("GET")
+	sessionOnly.HandleFunc("/sessions/{sessionID:[0-9a-f]{64}}", a.apiRevokeSessionHandler).Methods("DELETE")
+
+	// Administration, for users with the admin role logged in with a session
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(rejectTokens, a.requireAdmin)
+	admin.HandleFunc("/lockouts", a.apiListLockoutsHandler).Methods("GET")
+	admin.HandleFunc("/lockouts/{kind:user|ip}/{key}", a.apiUnlockLoginHandler).Methods("DELETE")
+	admin.HandleFunc("/users/{username}/2fa", a.apiResetTwoFactorHandler).Methods("DELETE")
+	admin.HandleFunc("/users", a.apiListUsersHandler).Methods("GET")
+	admin.HandleFunc("/users/{username}", a.apiUpdateUserHandler).Methods("PATCH")
+	admin.HandleFunc("/users/{username}", a.apiDeleteUserHandler).Methods("DELETE")
+	admin.HandleFunc("/users/{username}/password", a.apiSetUserPasswordHandler).Methods("PUT")
+	admin.HandleFunc("/users/{username}/transfer", a.apiTransferNotesHandler).Methods("POST")
+	admin.HandleFunc("/organizations", a.apiListOrganizationsHandler).Methods("GET")
+	admin.HandleFunc("/organizations", a.apiCreateOrganizationHandler).Methods("POST")
+	admin.HandleFunc("/audit", a.apiListAuditEventsHandler).Methods("GET")
+
+	// Everything else requires an authenticated session
+	protected := a.Router.NewRoute().Subrouter()
+	protected.Use(a.requireAuth, a.csrfProtect)
+	protected.HandleFunc("/", a.indexHandler).Methods("GET")
+	protected.HandleFunc("/list", a.listHandler).Methods("GET")
+	protected.HandleFunc("/create", a.createHandler).Methods("POST")
+	protected.HandleFunc("/update", a.updateHandler).Methods("POST")
+	protected.HandleFunc("/delete", a.deleteHandler).Methods("POST")
+	protected.HandleFunc("/share", a.shareHandler).Methods("POST")
+	protected.HandleFunc("/search", a.searchNotesHandler).Methods("POST", "GET")
+	protected.HandleFunc("/remove-shared-note", a.removeSharedNoteHandler).Methods("POST")
+	protected.HandleFunc("/getSharedUsersForNote/{noteID:[0-9]+}", a.getSharedUsersForNoteHandler).Methods("GET")
+	protected.HandleFunc("/getUnsharedUsersForNote/{noteID:[0-9]+}", a.getUnsharedUsersForNoteHandler).Methods("GET")
+	protected.HandleFunc("/find/{noteID:[0-9]+}", a.findInNoteHandler).Methods("GET")
+	protected.HandleFunc("/update-privileges", a.updatePrivilegesHandler).Methods("POST")
+	protected.HandleFunc("/remove-delegation/{noteID:[0-9]+}", a.removeDelegationHandler).Methods("POST")
+	protected.HandleFunc("/notes/{noteID:[0-9]+}/history", a.noteHistoryHandler).Methods("GET")
+	protected.HandleFunc("/notes/{noteID:[0-9]+}/history/{revision:[0-9]+}/restore", a.restoreRevisionHandler).Methods("POST")
+	protected.HandleFunc("/notes/{noteID:[0-9]+}/move", a.moveNoteHandler).Methods("POST")
+	protected.HandleFunc("/notebooks", a.createNotebookHandler).Methods("POST")
+	protected.HandleFunc("/notebooks/{notebookID:[0-9]+}/{action:update|delete|share|unshare}", a.notebookActionHandler).Methods("POST")
+	protected.HandleFunc("/trash", a.trashHandler).Methods("GET")
+	protected.HandleFunc("/trash/{noteID:[0-9]+}/{action:restore|delete}", a.trashActionHandler).Methods("POST")
+	protected.HandleFunc("/sessions", a.sessionsHandler).Methods("GET")
+	protected.HandleFunc("/sessions/revoke", a.revokeSessionHandler).Methods("POST")
+	protected.HandleFunc("/account/password", a.changePasswordHandler).Methods("GET", "POST")
+	protected.HandleFunc("/account/email", a.changeEmailHandler).Methods("POST")
+	protected.HandleFunc("/account/2fa", a.twoFactorHandler).Methods("GET")
+	protected.HandleFunc("/account/2fa/enable", a.enableTwoFactorHandler).Methods("POST")
+	protected.HandleFunc("/account/2fa/disable", a.disableTwoFactorHandler).Methods("POST")
+	protected.HandleFunc("/account/2fa/recovery-codes", a.regenerateRecoveryCodesHandler).Methods("POST")
+
+	// The admin console
+	adminPages := protected.PathPrefix("/admin").Subrouter()
+	adminPages.Use(a.requireAdmin)
+	adminPages.HandleFunc("/users", a.adminUsersHandler).Methods("GET")
+	adminPages.HandleFunc("/users/{username}/{action:role|disable|enable|organization|rename|password|transfer|delete}", a.adminUserActionHandler).Methods("POST")
+	adminPages.HandleFunc("/organizations", a.adminCreateOrganizationHandler).Methods("POST")
 
 	log.Println("Routes established")
 }
\ No newline at end of file
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/icza/session"
+)
+
+// sessionTouchInterval limits how often reading a session extends its expiry,
+// so that every request does not write to the database.
+const sessionTouchInterval = time.Minute
+
+// sessionCAttrNames are the constant session attributes set at login.
+// The session.Session interface cannot list them, so the store saves these by name.
+var sessionCAttrNames = []string{"username"}
+
+// hashSessionID returns the hex SHA-256 of a session id, which is what the store keeps.
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeAttrs serializes session attributes, keeping their Go types.
+func encodeAttrs(attrs map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(attrs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeAttrs is the reverse of encodeAttrs.
+func decodeAttrs(data []byte) (map[string]interface{}, error) {
+	attrs := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// pgSessionStore is a session.Store keeping sessions in the sessions table,
+// so that they survive restarts and are shared between instances.
+// Times are stored in UTC, as the columns have no time zone.
+type pgSessionStore struct {
+	db        *sql.DB
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPGSessionStore creates the store and starts removing expired sessions
+// every sweepInterval.
+func newPGSessionStore(db *sql.DB, sweepInterval time.Duration) *pgSessionStore {
+	s := &pgSessionStore{db: db, done: make(chan struct{})}
+	go s.sweeper(sweepInterval)
+	return s
+}
+
+// sweeper deletes expired sessions until the store is closed.
+func (s *pgSessionStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if n, err := s.deleteExpired(time.Now().UTC()); err != nil {
+				log.Println("Removing expired sessions:", err)
+			} else if n > 0 {
+				log.Printf("Removed %d expired sessions", n)
+			}
+		}
+	}
+}
+
+// deleteExpired removes the sessions that expired before now.
+func (s *pgSessionStore) deleteExpired(now time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Get returns the session with the given id, or nil if it does not exist or has expired.
+func (s *pgSessionStore) Get(id string) session.Session {
+	idHash := hashSessionID(id)
+	now := time.Now().UTC()
+
+	sess := &dbSession{id: id, store: s}
+	var cattrs, attrs []byte
+	var timeoutSecs float64
+	err := s.db.QueryRow(`
+		SELECT cattrs, attrs, created_at, accessed_at, EXTRACT(EPOCH FROM expires_at - accessed_at)::float8
+		FROM sessions WHERE id_hash = $1 AND expires_at > $2`, idHash, now).
+		Scan(&cattrs, &attrs, &sess.created, &sess.accessed, &timeoutSecs)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Loading session:", err)
+		}
+		return nil
+	}
+
+	if sess.cattrs, err = decodeAttrs(cattrs); err != nil {
+		log.Println("Decoding session:", err)
+		return nil
+	}
+	if sess.attrs, err = decodeAttrs(attrs); err != nil {
+		log.Println("Decoding session:", err)
+		return nil
+	}
+	sess.timeout = time.Duration(timeoutSecs * float64(time.Second))
+
+	// Sliding expiry, written at most once per sessionTouchInterval
+	if now.Sub(sess.accessed) >= sessionTouchInterval {
+		sess.accessed = now
+		_, err := s.db.Exec("UPDATE sessions SET accessed_at = $2, expires_at = $3 WHERE id_hash = $1",
+			idHash, now, now.Add(sess.timeout))
+		if err != nil {
+			log.Println("Updating session:", err)
+		}
+	}
+
+	return sess
+}
+
+// Add saves a new session. The user agent and address, when set as the
+// "userAgent" and "remoteAddr" attributes, are kept for the session list.
+func (s *pgSessionStore) Add(sess session.Session) {
+	cattrs := make(map[string]interface{})
+	for _, name := range sessionCAttrNames {
+		if v := sess.CAttr(name); v != nil {
+			cattrs[name] = v
+		}
+	}
+	username, _ := cattrs["username"].(string)
+
+	attrs := sess.Attrs()
+	userAgent, _ := attrs["userAgent"].(string)
+	remoteAddr, _ := attrs["remoteAddr"].(string)
+
+	encodedCAttrs, err := encodeAttrs(cattrs)
+	if err != nil {
+		log.Println("Encoding session:", err)
+		return
+	}
+	encodedAttrs, err := encodeAttrs(attrs)
+	if err != nil {
+		log.Println("Encoding session:", err)
+		return
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO sessions (id_hash, username, cattrs, attrs, user_agent, remote_addr, created_at, accessed_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		hashSessionID(sess.ID()), username, encodedCAttrs, encodedAttrs, truncate(userAgent, 255), remoteAddr,
+		sess.Created().UTC(), sess.Accessed().UTC(), sess.Accessed().Add(sess.Timeout()).UTC())
+	if err != nil {
+		log.Println("Saving session:", err)
+	}
+}
+
+// Remove deletes a session.
+func (s *pgSessionStore) Remove(sess session.Session) {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE id_hash = $1", hashSessionID(sess.ID())); err != nil {
+		log.Println("Removing session:", err)
+	}
+}
+
+// Close stops the expiry sweeper. The database is closed by the App.
+func (s *pgSessionStore) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// saveAttrs writes the variable attributes of a session back to the database.
+func (s *pgSessionStore) saveAttrs(id string, attrs map[string]interface{}) {
+	encoded, err := encodeAttrs(attrs)
+	if err != nil {
+		log.Println("Encoding session:", err)
+		return
+	}
+	if _, err := s.db.Exec("UPDATE sessions SET attrs = $2 WHERE id_hash = $1", hashSessionID(id), encoded); err != nil {
+		log.Println("Updating session:", err)
+	}
+}
+
+// dbSession is a session loaded from the pgSessionStore. Attribute changes are
+// written through to the database, so every instance sees them.
+type dbSession struct {
+	id       string
+	store    *pgSessionStore
+	created  time.Time
+	accessed time.Time
+	timeout  time.Duration
+	cattrs   map[string]interface{}
+	attrs    map[string]interface{}
+	mux      sync.RWMutex
+}
+
+func (s *dbSession) ID() string { return s.id }
+
+func (s *dbSession) New() bool { return s.created.Equal(s.accessed) }
+
+func (s *dbSession) CAttr(name string) interface{} { return s.cattrs[name] }
+
+func (s *dbSession) Attr(name string) interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.attrs[name]
+}
+
+func (s *dbSession) SetAttr(name string, value interface{}) {
+	s.mux.Lock()
+	if value == nil {
+		delete(s.attrs, name)
+	} else {
+		s.attrs[name] = value
+	}
+	attrs := make(map[string]interface{}, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	s.mux.Unlock()
+
+	s.store.saveAttrs(s.id, attrs)
+}
+
+func (s *dbSession) Attrs() map[string]interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	attrs := make(map[string]interface{}, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+func (s *dbSession) Created() time.Time { return s.created }
+
+func (s *dbSession) Accessed() time.Time { return s.accessed }
+
+func (s *dbSession) Timeout() time.Duration { return s.timeout }
+
+func (s *dbSession) Mutex() *sync.RWMutex { return &s.mux }
+
+func (s *dbSession) Access() { s.accessed = time.Now() }
+
+// listUserSessions returns the active sessions of a user, most recently used first.
+func (a *App) listUserSessions(username string) ([]UserSession, error) {
+	rows, err := a.db.Query(`
+		SELECT id_hash, user_agent, remote_addr, created_at, accessed_at, expires_at
+		FROM sessions WHERE username = $1 AND expires_at > $2
+		ORDER BY accessed_at DESC`, username, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UserSession{}
+	for rows.Next() {
+		var s UserSession
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.RemoteAddr, &s.CreatedAt, &s.AccessedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// revokeUserSession deletes one session of a user, identified by its hash.
+func (a *App) revokeUserSession(username, idHash string) error {
+	result, err := a.db.Exec("DELETE FROM sessions WHERE id_hash = $1 AND username = $2", idHash, username)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// newLoginSession creates the session for a user who has just logged in.
+func (a *App) newLoginSession(r *http.Request, username string) session.Session {
+	return session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"username": username},
+		Attrs:   map[string]interface{}{"count": 1, "userAgent": r.UserAgent(), "remoteAddr": clientIP(r), csrfTokenAttr: generateCSRFToken()},
+		Timeout: a.sessionTimeout(),
+	})
+}
+
+// sessionTimeout returns the configured idle timeout of sessions.
+func (a *App) sessionTimeout() time.Duration {
+	if a.config == nil {
+		return defaultConfig().Session.Timeout
+	}
+	return a.config.Session.Timeout
+}
+
+// clientIP returns the address of the client without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// currentSessionHash returns the hash of the session id of the request, if any.
+func currentSessionHash(r *http.Request) string {
+	if sess := session.Get(r); sess != nil {
+		return hashSessionID(sess.ID())
+	}
+	return ""
+}
+
+// truncate shortens s to at most n bytes, without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
+
+// sessionsPersisted reports whether sessions are kept in the database and can be listed.
+func (a *App) sessionsPersisted() bool {
+	return a.config == nil || a.config.Session.Store == "postgres"
+}
+
+// sessionsHandler shows the active sessions of the user, who can revoke them.
+func (a *App) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	var sessions []UserSession
+	if a.sessionsPersisted() {
+		var err error
+		sessions, err = a.listUserSessions(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	current := currentSessionHash(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	tmpl, err := template.ParseFiles("tmpl/sessions.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Username  string
+		Persisted bool
+		Sessions  []UserSession
+		CSRFToken string
+	}{
+		Username:  username,
+		Persisted: a.sessionsPersisted(),
+		Sessions:  sessions,
+		CSRFToken: csrfToken(r),
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// revokeSessionHandler ends one of the user's sessions from the sessions page.
+func (a *App) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.revokeUserSession(currentUsername(r), r.FormValue("id"))
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+}
+
+// apiListSessionsHandler lists the active sessions of the user.
+func (a *App) apiListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.sessionsPersisted() {
+		respondWithError(w, http.StatusNotImplemented, "sessions are not stored in the database")
+		return
+	}
+
+	sessions, err := a.listUserSessions(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	current := currentSessionHash(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// apiRevokeSessionHandler ends one of the user's sessions.
+func (a *App) apiRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.revokeUserSession(currentUsername(r), mux.Vars(r)["sessionID"])
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
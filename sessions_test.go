@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+)
+
+func TestPGSessionStore_AddAndGet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db, done: make(chan struct{})}
+
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.Header.Set("User-Agent", "test-browser")
+	a := App{}
+	sess := a.newLoginSession(req, "mydog7")
+
+	// The id itself is never stored, only its hash
+	cattrs, attrs := &capturedArg{}, &capturedArg{}
+	mock.ExpectExec("INSERT INTO sessions").
+		WithArgs(hashSessionID(sess.ID()), "mydog7", cattrs, attrs, "test-browser", "192.0.2.1",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store.Add(sess)
+
+	// Loading the session again restores the attributes with their types
+	accessed := time.Now().UTC().Add(-5 * time.Minute)
+	mock.ExpectQuery("SELECT cattrs, attrs, created_at, accessed_at").
+		WithArgs(hashSessionID(sess.ID()), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"cattrs", "attrs", "created_at", "accessed_at", "timeout"}).
+			AddRow(cattrs.value, attrs.value, accessed, accessed, 1800.0))
+	mock.ExpectExec("UPDATE sessions SET accessed_at").
+		WithArgs(hashSessionID(sess.ID()), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	loaded := store.Get(sess.ID())
+	if loaded == nil {
+		t.Fatal("Expected the session to be found")
+	}
+	if username, ok := sessionUsername(loaded); !ok || username != "mydog7" {
+		t.Errorf("Expected an authenticated session for mydog7, but got %q, %v", username, ok)
+	}
+	if loaded.Timeout() != 30*time.Minute {
+		t.Errorf("Expected a 30m timeout, but got %v", loaded.Timeout())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPGSessionStore_GetExpired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &pgSessionStore{db: db, done: make(chan struct{})}
+
+	mock.ExpectQuery("SELECT cattrs, attrs, created_at, accessed_at").
+		WithArgs(hashSessionID("gone"), sqlmock.AnyArg()).
+		WillReturnError(sql.ErrNoRows)
+
+	if sess := store.Get("gone"); sess != nil {
+		t.Errorf("Expected no session, but got %v", sess)
+	}
+}
+
+func TestListUserSessions_MarksCurrent(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/sessions", nil), "mydog7")
+	current := hashSessionID(session.Get(req).ID())
+	now := time.Now()
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT id_hash, user_agent, remote_addr").
+		WithArgs("mydog7", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id_hash", "user_agent", "remote_addr", "created_at", "accessed_at", "expires_at"}).
+			AddRow(current, "browser", "192.0.2.1", now, now, now.Add(time.Hour)).
+			AddRow(strings.Repeat("a", 64), "phone", "192.0.2.2", now, now, now.Add(time.Hour)))
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	body := rr.Body.String()
+	if strings.Count(body, `"current":true`) != 1 || !strings.Contains(body, `"user_agent":"phone"`) {
+		t.Errorf("Unexpected sessions: %s", body)
+	}
+}
+
+func TestAPIRevokeSession_NotFound(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	other := strings.Repeat("b", 64)
+
+	// Sessions of other users are not found
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectExec("DELETE FROM sessions WHERE id_hash = \\$1 AND username = \\$2").
+		WithArgs(other, "BIGCAT").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := loginRequest(httptest.NewRequest("DELETE", "/api/v1/sessions/"+other, nil), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Limits on the tags of a note.
+const (
+	maxTagLength = 50
+	maxNoteTags  = 20
+)
+
+// TagCount is a tag of the tag cloud with the number of notes it labels.
+// Weight ranks the tag from 1 to 5 relative to the most used tag.
+type TagCount struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Weight int    `json:"-"`
+}
+
+// tagFilter selects notes by their tags. MatchAll requires every tag,
+// otherwise any of them is enough.
+type tagFilter struct {
+	Tags     []string
+	MatchAll bool
+}
+
+// normalizeTags lower-cases the tag names, collapses their white space and
+// drops empty and duplicate names.
+func normalizeTags(names []string) ([]string, error) {
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, name := range names {
+		name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+		if name == "" || seen[name] {
+			continue
+		}
+		if len(name) > maxTagLength {
+			return nil, fmt.Errorf("tag %q exceeds %d characters", name, maxTagLength)
+		}
+		seen[name] = true
+		tags = append(tags, name)
+	}
+	if len(tags) > maxNoteTags {
+		return nil, fmt.Errorf("a note can have at most %d tags", maxNoteTags)
+	}
+	return tags, nil
+}
+
+// parseTags reads a comma separated list of tags.
+func parseTags(value string) ([]string, error) {
+	return normalizeTags(strings.Split(value, ","))
+}
+
+// parseTagFilter reads the filter from the form or query values tags, a
+// comma separated list, and match, which is all (the default) or any.
+func parseTagFilter(r *http.Request) (tagFilter, error) {
+	f := tagFilter{MatchAll: true}
+
+	var err error
+	if f.Tags, err = parseTags(r.FormValue("tags")); err != nil {
+		return f, err
+	}
+	switch r.FormValue("match") {
+	case "", "all":
+	case "any":
+		f.MatchAll = false
+	default:
+		return f, errors.New("match must be all or any")
+	}
+
+	return f, nil
+}
+
+// Active reports whether the filter selects any tags.
+func (f tagFilter) Active() bool {
+	return len(f.Tags) > 0
+}
+
+// Value is the filter as entered in the tags field.
+func (f tagFilter) Value() string {
+	return strings.Join(f.Tags, ", ")
+}
+
+// Match is the value of the match parameter.
+func (f tagFilter) Match() string {
+	if f.MatchAll {
+		return "all"
+	}
+	return "any"
+}
+
+// matches reports whether the note has all or any of the tags of the filter.
+func (f tagFilter) matches(note Note) bool {
+	if !f.Active() {
+		return true
+	}
+	has := make(map[string]bool, len(note.Tags))
+	for _, tag := range note.Tags {
+		has[tag] = true
+	}
+	for _, tag := range f.Tags {
+		if has[tag] != f.MatchAll {
+			return !f.MatchAll
+		}
+	}
+	return f.MatchAll
+}
+
+// apply returns the notes matching the filter. Tags must have been loaded.
+func (f tagFilter) apply(notes []Note) []Note {
+	if !f.Active() {
+		return notes
+	}
+	result := []Note{}
+	for _, note := range notes {
+		if f.matches(note) {
+			result = append(result, note)
+		}
+	}
+	return result
+}
+
+// setNoteTags replaces the tags of a note. Tags belong to the owner of the
+// note and are created on first use; tags no longer used are removed.
+func (a *App) setNoteTags(noteID int, tags []string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM note_tags WHERE note_id = $1", noteID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		var tagID int
+		err := tx.QueryRow(`
+			INSERT INTO tags (owner, name) SELECT owner, $2 FROM notes WHERE id = $1
+			ON CONFLICT (owner, name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id`, noteID, tag).Scan(&tagID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO note_tags (note_id, tag_id) VALUES ($1, $2)", noteID, tagID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		DELETE FROM tags
+		WHERE owner = (SELECT owner FROM notes WHERE id = $1)
+			AND NOT EXISTS (SELECT 1 FROM note_tags WHERE tag_id = tags.id)`, noteID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// noteIDArgs returns the placeholders and arguments for a query on the IDs
+// of notes, and the positions of each note ID in notes.
+func noteIDArgs(notes []Note) (string, []interface{}, map[int][]int) {
+	placeholders := make([]string, len(notes))
+	args := make([]interface{}, len(notes))
+	positions := make(map[int][]int)
+	for i, note := range notes {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = note.ID
+		positions[note.ID] = append(positions[note.ID], i)
+	}
+	return strings.Join(placeholders, ", "), args, positions
+}
+
+// loadTags fills in the tags of the notes, sorted by name.
+func (a *App) loadTags(notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	placeholders, args, positions := noteIDArgs(notes)
+	for i := range notes {
+		notes[i].Tags = []string{}
+	}
+
+	rows, err := a.db.Query(`
+		SELECT nt.note_id, t.name
+		FROM note_tags nt
+		INNER JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id IN (`+placeholders+`)
+		ORDER BY t.name`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID int
+		var tag string
+		if err := rows.Scan(&noteID, &tag); err != nil {
+			return err
+		}
+		for _, i := range positions[noteID] {
+			notes[i].Tags = append(notes[i].Tags, tag)
+		}
+	}
+
+	return rows.Err()
+}
+
+// loadNoteTags fills in the tags of a single note.
+func (a *App) loadNoteTags(note *Note) error {
+	notes := []Note{*note}
+	if err := a.loadTags(notes); err != nil {
+		return err
+	}
+	note.Tags = notes[0].Tags
+	return nil
+}
+
+// tagCloud returns the tags of the notes owned by username, outside the
+// trash, with the number of notes for each tag.
+func (a *App) tagCloud(username string) ([]TagCount, error) {
+	rows, err := a.db.Query(`
+		SELECT t.name, COUNT(DISTINCT n.id)
+		FROM notes n
+		INNER JOIN note_tags nt ON nt.note_id = n.id
+		INNER JOIN tags t ON t.id = nt.tag_id
+		WHERE n.owner = $1 AND n.deleted_at IS NULL
+		GROUP BY t.name
+		ORDER BY t.name`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cloud := []TagCount{}
+	most := 0
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		if tag.Count > most {
+			most = tag.Count
+		}
+		cloud = append(cloud, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range cloud {
+		cloud[i].Weight = 1 + 4*(cloud[i].Count-1)/max(most-1, 1)
+	}
+	return cloud, nil
+}
+
+// apiTagCloudHandler returns the tag cloud of the user.
+func (a *App) apiTagCloudHandler(w http.ResponseWriter, r *http.Request) {
+	cloud, err := a.tagCloud(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cloud)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// tagsQuery is the query loadTags uses to load the tags of notes.
+const tagsQuery = "SELECT nt.note_id, t.name FROM note_tags"
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" Work,  home  office ,work,, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"work", "home office"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("Expected %q, but got %q", want, tags)
+	}
+
+	if _, err := parseTags(strings.Repeat("x", maxTagLength+1)); err == nil {
+		t.Error("Expected an error for a tag that is too long")
+	}
+	many := make([]string, maxNoteTags+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("tag %d", i)
+	}
+	if _, err := normalizeTags(many); err == nil {
+		t.Error("Expected an error for too many tags")
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	notes := []Note{
+		{ID: 1, Tags: []string{"home", "work"}},
+		{ID: 2, Tags: []string{"work"}},
+		{ID: 3, Tags: []string{}},
+	}
+	ids := func(notes []Note) []int {
+		result := []int{}
+		for _, note := range notes {
+			result = append(result, note.ID)
+		}
+		return result
+	}
+
+	all := tagFilter{Tags: []string{"home", "work"}, MatchAll: true}
+	if got := ids(all.apply(notes)); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("Expected notes [1] with all tags, but got %v", got)
+	}
+	anyTag := tagFilter{Tags: []string{"home", "work"}}
+	if got := ids(anyTag.apply(notes)); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Expected notes [1 2] with any tag, but got %v", got)
+	}
+	if got := ids(tagFilter{}.apply(notes)); len(got) != 3 {
+		t.Errorf("Expected an empty filter to keep every note, but got %v", got)
+	}
+}
+
+func TestAPIListNotes_TagFilter(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectPrepare("SELECT n.id, n.title").ExpectQuery().WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "noteType", "description", "noteCreated", "taskCompletionTime",
+			"taskCompletionDate", "noteStatus", "noteDelegation", "owner", "username", "privileges"}).
+			AddRow(1, "Report", "Task", "", created, nil, nil, nil, nil, "mydog7", nil, nil).
+			AddRow(2, "Groceries", "Note", "", created, nil, nil, nil, nil, "mydog7", nil, nil).
+			AddRow(3, "Holiday", "Note", "", created, nil, nil, nil, nil, "mydog7", nil, nil))
+	mock.ExpectQuery(tagsQuery).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"note_id", "name"}).
+			AddRow(2, "home").AddRow(3, "travel").AddRow(1, "work"))
+	mock.ExpectQuery("SELECT id, notebook_id FROM notes").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "notebook_id"}))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/notes?scope=owned&tags=Work,home&match=any", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var notes []noteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &notes); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("Expected 2 notes, but got %+v", notes)
+	}
+	for _, note := range notes {
+		if note.ID == 3 || len(note.Tags) != 1 {
+			t.Errorf("Unexpected note %+v", note)
+		}
+	}
+
+	// Unknown match values are refused
+	expectActiveUser(mock, "mydog7")
+	req = loginRequest(httptest.NewRequest("GET", "/api/v1/notes?tags=work&match=most", nil), "mydog7")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIPatchNote_Tags(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	created := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	// Editors can change the tags, which are replaced as a whole
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectQuery(noteAccessQuery).WithArgs(1, "BIGCAT").
+		WillReturnRows(sqlmock.NewRows([]string{"owner", "notedelegation", "privileges"}).AddRow("mydog7", nil, privilegeEditor))
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(1, "Report", "", "Task", nil, nil, nil, nil, "mydog7", created, 3))
+	mock.ExpectPrepare("UPDATE notes SET title").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("UPDATE notes SET fts_text").ExpectExec().WithArgs(1, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_revisions").WithArgs(1, "BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM note_tags WHERE note_id = \\$1").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO tags").WithArgs(1, "work").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectExec("INSERT INTO note_tags").WithArgs(1, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO tags").WithArgs(1, "q4").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectExec("INSERT INTO note_tags").WithArgs(1, 9).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM tags").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(tagsQuery).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"note_id", "name"}).AddRow(1, "q4").AddRow(1, "work"))
+
+	req := loginRequest(httptest.NewRequest("PATCH", "/api/v1/notes/1", strings.NewReader(`{"tags": ["Work", "Q4"]}`)), "BIGCAT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var note noteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &note); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"q4", "work"}; !reflect.DeepEqual(note.Tags, want) {
+		t.Errorf("Expected tags %q, but got %q", want, note.Tags)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTagCloud(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	mock.ExpectQuery("SELECT t.name, COUNT\\(DISTINCT n.id\\) FROM notes n .* WHERE n.owner = \\$1 AND n.deleted_at IS NULL").
+		WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "count"}).
+			AddRow("home", 1).AddRow("travel", 3).AddRow("work", 5))
+
+	cloud, err := a.tagCloud("mydog7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TagCount{{"home", 1, 1}, {"travel", 3, 3}, {"work", 5, 5}}
+	if !reflect.DeepEqual(cloud, want) {
+		t.Errorf("Expected %+v, but got %+v", want, cloud)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
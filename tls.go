@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 30 * time.Second
+
+// tlsVersions maps the configured minimum version to its crypto/tls constant.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves a certificate that can be replaced while the server runs.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate and key, failing if they are invalid.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the newest modification time of the certificate and key.
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reads the certificate and key again. On failure the current
+// certificate is kept, so a half-written file does not take the server down.
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged reloads the certificate when its files have been modified.
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	return true, r.reload()
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP and when the files change, until ctx is done.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.reload(); err != nil {
+				log.Println("TLS certificate not reloaded:", err)
+			} else {
+				log.Println("TLS certificate reloaded")
+			}
+		case <-ticker.C:
+			if changed, err := r.reloadIfChanged(); err != nil {
+				log.Println("TLS certificate not reloaded:", err)
+			} else if changed {
+				log.Println("TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+// buildTLSConfig creates the server TLS configuration. HTTP/2 is offered
+// alongside HTTP/1.1.
+func buildTLSConfig(cfg TLSConfig, certs *certReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tlsVersions[cfg.MinVersion],
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	switch cfg.ClientAuth {
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in TLS client CA file")
+	}
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// httpsRedirectHandler redirects every request to the same URL over HTTPS.
+// httpsPort is omitted from the URL when it is the default 443.
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 && httpsPort != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// Keep the method and body of anything other than GET and HEAD
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, code)
+	})
+}
+
+// listenerPort returns the TCP port of ln, or 0 for other kinds of listener.
+func listenerPort(ln net.Listener) int {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and key for localhost into dir.
+func writeTestCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+// servedCommonName returns the common name of the certificate the reloader serves.
+func servedCommonName(t *testing.T, r *certReloader) string {
+	cert, _ := r.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader_ReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if changed, err := certs.reloadIfChanged(); changed || err != nil {
+		t.Errorf("Expected no reload for unchanged files, but got %v, %v", changed, err)
+	}
+
+	// Replace the certificate and make sure its modification time moves on
+	writeTestCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	if changed, err := certs.reloadIfChanged(); !changed || err != nil {
+		t.Fatalf("Expected a reload, but got %v, %v", changed, err)
+	}
+	if name := servedCommonName(t, certs); name != "second" {
+		t.Errorf("Expected the new certificate, but got %q", name)
+	}
+
+	// A broken file keeps the current certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	if err := certs.reload(); err == nil {
+		t.Errorf("Expected an error for an invalid certificate, but got none")
+	}
+	if name := servedCommonName(t, certs); name != "second" {
+		t.Errorf("Expected the previous certificate to be kept, but got %q", name)
+	}
+}
+
+// startTLSServer serves a handler reporting the protocol with the given TLS settings.
+func startTLSServer(t *testing.T, cfg TLSConfig) string {
+	certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := buildTLSConfig(cfg, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	return "https://" + ln.Addr().String() + "/"
+}
+
+// tlsClient trusts the test certificate and optionally presents it as a client certificate.
+func tlsClient(t *testing.T, certFile, keyFile string, withClientCert bool) *http.Client {
+	pemData, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemData)
+
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if withClientCert {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+}
+
+func TestTLSServer_HTTP2(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	url := startTLSServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"})
+
+	resp, err := tlsClient(t, certFile, keyFile, false).Get(url)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, but got %s", resp.Proto)
+	}
+}
+
+func TestTLSServer_RequireClientCert(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	url := startTLSServer(t, TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.3",
+		ClientCAFile: certFile,
+		ClientAuth:   "require",
+	})
+
+	if resp, err := tlsClient(t, certFile, keyFile, false).Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected a client without a certificate to be rejected")
+	}
+
+	resp, err := tlsClient(t, certFile, keyFile, true).Get(url)
+	if err != nil {
+		t.Fatalf("Expected a client certificate to be accepted, but got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	tests := []struct {
+		method    string
+		url       string
+		httpsPort int
+		code      int
+		location  string
+	}{
+		{http.MethodGet, "http://notes.example.com/list?q=a", 443, http.StatusMovedPermanently, "https://notes.example.com/list?q=a"},
+		{http.MethodGet, "http://notes.example.com:8080/list", 8443, http.StatusMovedPermanently, "https://notes.example.com:8443/list"},
+		{http.MethodPost, "http://notes.example.com/create", 443, http.StatusPermanentRedirect, "https://notes.example.com/create"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		rr := httptest.NewRecorder()
+		httpsRedirectHandler(tt.httpsPort).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code || rr.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: got %d %q, want %d %q", tt.method, tt.url, rr.Code, rr.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+}
+
+func TestTLSConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  TLSConfig
+		ok   bool
+	}{
+		{"disabled", TLSConfig{MinVersion: "1.2"}, true},
+		{"cert and key", TLSConfig{CertFile: "c", KeyFile: "k", MinVersion: "1.3"}, true},
+		{"cert without key", TLSConfig{CertFile: "c", MinVersion: "1.2"}, false},
+		{"old version", TLSConfig{CertFile: "c", KeyFile: "k", MinVersion: "1.0"}, false},
+		{"client auth without CA", TLSConfig{CertFile: "c", KeyFile: "k", MinVersion: "1.2", ClientAuth: "require"}, false},
+		{"redirect without TLS", TLSConfig{MinVersion: "1.2", RedirectListen: ":80"}, false},
+	}
+
+	for _, tt := range tests {
+		if problems := tt.cfg.validate(); (len(problems) == 0) != tt.ok {
+			t.Errorf("%s: got problems %v", tt.name, problems)
+		}
+	}
+}
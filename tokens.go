@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiTokenPrefix makes personal API tokens easy to recognise, e.g. in secret scanners.
+const apiTokenPrefix = "nt_"
+
+// apiTokenKey holds the *APIToken used to authenticate a request in its context.
+const apiTokenKey contextKey = "apiToken"
+
+var errInvalidAPIToken = errors.New("invalid or expired API token")
+
+// tokenInput is the JSON body accepted when creating an API token.
+type tokenInput struct {
+	Name          string `json:"name"`
+	ReadOnly      bool   `json:"read_only"`
+	ExpiresInDays int    `json:"expires_in_days"`
+}
+
+// createdTokenResponse is returned once when a token is created.
+type createdTokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// generateAPIToken returns a new random token.
+func generateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAPIToken returns the hex encoded SHA-256 hash stored for a token.
+// Tokens are long random values, so a fast hash is sufficient.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertAPIToken stores the hash of a new token for username.
+func (a *App) insertAPIToken(username, name, tokenHash string, readOnly bool, expiresAt sql.NullTime) (*APIToken, error) {
+	query := `
+		INSERT INTO api_tokens (username, name, token_hash, read_only, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	token := APIToken{Username: username, Name: name, ReadOnly: readOnly, ExpiresAt: expiresAt}
+	err := a.db.QueryRow(query, username, name, tokenHash, readOnly, expiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// listAPITokens returns the tokens created by username.
+func (a *App) listAPITokens(username string) ([]APIToken, error) {
+	query := `
+		SELECT id, username, name, read_only, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE username = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := a.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var token APIToken
+		if err := rows.Scan(&token.ID, &token.Username, &token.Name, &token.ReadOnly, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// revokeAPIToken deletes a token belonging to username.
+// It reports false when no such token exists.
+func (a *App) revokeAPIToken(username string, id int) (bool, error) {
+	result, err := a.db.Exec("DELETE FROM api_tokens WHERE id = $1 AND username = $2", id, username)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// lookupAPIToken returns the token matching the presented value if it has not expired,
+// and records when it was last used.
+func (a *App) lookupAPIToken(presented string) (*APIToken, error) {
+	if !strings.HasPrefix(presented, apiTokenPrefix) {
+		return nil, errInvalidAPIToken
+	}
+
+	query := `
+		SELECT id, username, name, read_only, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE token_hash = $1 AND username NOT IN (SELECT username FROM users WHERE disabled_at IS NOT NULL)
+	`
+
+	var token APIToken
+	err := a.db.QueryRow(query, hashAPIToken(presented)).Scan(
+		&token.ID, &token.Username, &token.Name, &token.ReadOnly, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ExpiresAt.Valid && time.Now().After(token.ExpiresAt.Time) {
+		return nil, errInvalidAPIToken
+	}
+
+	_, err = a.db.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1", token.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// apiTokenFromContext returns the token used to authenticate the request, if any.
+func apiTokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenKey).(*APIToken)
+	return token
+}
+
+// requireAPIAuth authenticates API requests with a bearer token, falling back
+// to the session cookie used by the web interface.
+// Read-only tokens may only be used for GET and HEAD requests, and session
+// requests that change data need the CSRF token of the session.
+func (a *App) requireAPIAuth(next http.Handler) http.Handler {
+	// Cookies are sent by browsers automatically, so session requests need a CSRF token
+	sessionAuth := a.requireAuth(a.csrfProtect(next))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := bearerToken(r)
+		if !ok {
+			sessionAuth.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := a.lookupAPIToken(presented)
+		if errors.Is(err, errInvalidAPIToken) {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if token.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			respondWithError(w, http.StatusForbidden, "this API token is read-only")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), usernameKey, token.Username)
+		ctx = context.WithValue(ctx, apiTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rejectTokens is a middleware that only lets requests authenticated with a
+// session through, for endpoints too powerful to hand to an API token, such
+// as managing API tokens, so a leaked token cannot be used to mint new ones.
+// It must run after requireAPIAuth.
+func rejectTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiTokenFromContext(r.Context()) != nil {
+			respondWithError(w, http.StatusForbidden, "this endpoint can only be used from a logged in session")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiListTokensHandler lists the user's API tokens.
+func (a *App) apiListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := a.listAPITokens(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+// apiCreateTokenHandler creates a named API token and returns it once.
+func (a *App) apiCreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var in tokenInput
+	if err := decodeJSON(r, &in); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || len(in.Name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "name is required and must be at most 100 characters")
+		return
+	}
+	if in.ExpiresInDays < 0 {
+		respondWithError(w, http.StatusBadRequest, "expires_in_days cannot be negative")
+		return
+	}
+
+	var expiresAt sql.NullTime
+	if in.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, in.ExpiresInDays), Valid: true}
+	}
+
+	plain, err := generateAPIToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := a.insertAPIToken(currentUsername(r), in.Name, hashAPIToken(plain), in.ReadOnly, expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/tokens/%d", token.ID))
+	respondWithJSON(w, http.StatusCreated, createdTokenResponse{APIToken: *token, Token: plain})
+}
+
+// apiRevokeTokenHandler deletes one of the user's API tokens.
+func (a *App) apiRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["tokenID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid tokenID")
+		return
+	}
+
+	found, err := a.revokeAPIToken(currentUsername(r), id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "token not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// capturedArg is a sqlmock argument matcher that remembers the value it saw.
+type capturedArg struct {
+	value driver.Value
+}
+
+func (c *capturedArg) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+func TestRequireAPIAuth(t *testing.T) {
+	validToken := apiTokenPrefix + "valid"
+	expiredToken := apiTokenPrefix + "expired"
+	readOnlyToken := apiTokenPrefix + "readonly"
+	columns := []string{"id", "username", "name", "read_only", "created_at", "expires_at", "last_used_at"}
+	created := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		method     string
+		header     string
+		setup      func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:   "valid token",
+			method: "GET",
+			header: "Bearer " + validToken,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, name, read_only").
+					WithArgs(hashAPIToken(validToken)).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "mydog7", "ci", false, created, nil, nil))
+				mock.ExpectExec("UPDATE api_tokens SET last_used_at").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "mydog7",
+		},
+		{
+			name:   "expired token",
+			method: "GET",
+			header: "Bearer " + expiredToken,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, name, read_only").
+					WithArgs(hashAPIToken(expiredToken)).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(2, "mydog7", "old", false, created, created.AddDate(0, 0, 1), nil))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown token",
+			method: "GET",
+			header: "Bearer " + validToken,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, name, read_only").
+					WithArgs(hashAPIToken(validToken)).
+					WillReturnRows(sqlmock.NewRows(columns))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "malformed token",
+			method:     "GET",
+			header:     "Bearer not-a-token",
+			setup:      func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "read-only token writing",
+			method: "POST",
+			header: "Bearer " + readOnlyToken,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, name, read_only").
+					WithArgs(hashAPIToken(readOnlyToken)).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(3, "mydog7", "reporting", true, created, nil, nil))
+				mock.ExpectExec("UPDATE api_tokens SET last_used_at").
+					WithArgs(3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			a := App{db: db}
+			tt.setup(mock)
+
+			// The wrapped handler echoes the username found in the request context
+			handler := a.requireAPIAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(currentUsername(r)))
+			}))
+
+			req := httptest.NewRequest(tt.method, "/api/v1/notes", nil)
+			req.Header.Set("Authorization", tt.header)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %q, but got %q", tt.wantBody, rr.Body.String())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPICreateToken(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	hash := &capturedArg{}
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("INSERT INTO api_tokens").
+		WithArgs("mydog7", "ci", hash, true, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+
+	body := `{"name": "ci", "read_only": true, "expires_in_days": 30}`
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/tokens", strings.NewReader(body)), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v (%s)", status, http.StatusCreated, rr.Body.String())
+	}
+
+	var created createdTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !strings.HasPrefix(created.Token, apiTokenPrefix) {
+		t.Errorf("Expected token with prefix %q, but got %q", apiTokenPrefix, created.Token)
+	}
+
+	// Only the hash of the returned token may be stored
+	if hash.value != hashAPIToken(created.Token) {
+		t.Errorf("Stored hash %v does not match the returned token", hash.value)
+	}
+	if !created.ExpiresAt.Valid || !created.ReadOnly {
+		t.Errorf("Expected a read-only token with an expiry, but got %+v", created.APIToken)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPITokens_SessionOnly(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	token := apiTokenPrefix + "valid"
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/v1/tokens"},
+		{"POST", "/api/v1/tokens"},
+		{"DELETE", "/api/v1/tokens/1"},
+		{"GET", "/api/v1/sessions"},
+	} {
+		mock.ExpectQuery("SELECT id, username, name, read_only").WithArgs(hashAPIToken(token)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "name", "read_only", "created_at", "expires_at", "last_used_at"}).
+				AddRow(1, "mydog7", "ci", false, time.Now(), nil, nil))
+		mock.ExpectExec("UPDATE api_tokens SET last_used_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := httptest.NewRequest(route.method, route.path, strings.NewReader(`{"name": "more"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected status %d, but got %d", route.method, route.path, http.StatusForbidden, rr.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
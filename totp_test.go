@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, base32 encoded.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// The last six digits of the eight digit codes in RFC 6238, appendix B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil || got != tt.want {
+			t.Errorf("%d: got %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+	previous, _ := totpCode(rfc6238Secret, step-1)
+
+	if got, ok := verifyTOTP(rfc6238Secret, "005924", now, 0); !ok || got != step {
+		t.Errorf("Expected the current code to match step %d, but got %d, %v", step, got, ok)
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, previous, now, 0); !ok {
+		t.Errorf("Expected the code of the previous step to be accepted")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "005924", now, step); ok {
+		t.Errorf("Expected a used code to be refused")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "005924", now.Add(5*time.Minute), 0); ok {
+		t.Errorf("Expected an old code to be refused")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "", now, 0); ok {
+		t.Errorf("Expected an empty code to be refused")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("my dog", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/Notes:my%20dog?") || !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=Notes") {
+		t.Errorf("Unexpected URI %q", uri)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TrashedNote is a note in the trash of its owner.
+type TrashedNote struct {
+	Note
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// trashedNoteResponse is the JSON representation of a note in the trash.
+type trashedNoteResponse struct {
+	noteResponse
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// trashConfig returns the trash settings.
+func (a *App) trashConfig() TrashConfig {
+	if a.config == nil {
+		return defaultConfig().Trash
+	}
+	return a.config.Trash
+}
+
+// listTrash returns the notes of owner in the trash, most recently deleted first.
+func (a *App) listTrash(owner string) ([]TrashedNote, error) {
+	rows, err := a.db.Query(`
+		SELECT id, title, noteType, description, noteCreated, taskCompletionTime, taskCompletionDate, noteStatus, noteDelegation, owner, deleted_at
+		FROM notes
+		WHERE owner = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retention := a.trashConfig().Retention
+	notes := []TrashedNote{}
+	for rows.Next() {
+		var n TrashedNote
+		err := rows.Scan(&n.ID, &n.Title, &n.NoteType, &n.Description, &n.NoteCreated, &n.TaskCompletionTime,
+			&n.TaskCompletionDate, &n.NoteStatus, &n.NoteDelegation, &n.Owner, &n.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		n.PurgeAt = n.DeletedAt.Add(retention)
+		notes = append(notes, n)
+	}
+
+	return notes, rows.Err()
+}
+
+// restoreFromTrash takes a note of owner out of the trash. It returns
+// errNoteNotFound unless the note is in the trash of owner.
+func (a *App) restoreFromTrash(noteID int, owner string) error {
+	result, err := a.db.Exec("UPDATE notes SET deleted_at = NULL WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL", noteID, owner)
+	if err != nil {
+		return err
+	}
+	return requireTrashedNote(result)
+}
+
+// purgeFromTrash deletes a note in the trash of owner for good, together
+// with its shares and history.
+func (a *App) purgeFromTrash(noteID int, owner string) error {
+	result, err := a.db.Exec("DELETE FROM notes WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL", noteID, owner)
+	if err != nil {
+		return err
+	}
+	return requireTrashedNote(result)
+}
+
+func requireTrashedNote(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoteNotFound
+	}
+	return nil
+}
+
+// purgeExpiredTrash deletes the notes that have been in the trash for longer
+// than retention and returns how many there were.
+func (a *App) purgeExpiredTrash(retention time.Duration) (int64, error) {
+	result, err := a.db.Exec("DELETE FROM notes WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(secs => $1)", retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeTrash empties expired notes from the trash every purge interval until
+// ctx is done.
+func (a *App) purgeTrash(ctx context.Context) {
+	cfg := a.trashConfig()
+	ticker := time.NewTicker(cfg.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := a.purgeExpiredTrash(cfg.Retention); err != nil {
+				log.Println("Purging the trash:", err)
+			} else if n > 0 {
+				log.Printf("Purged %d notes from the trash", n)
+			}
+		}
+	}
+}
+
+// apiListTrashHandler lists the notes in the trash of the user.
+func (a *App) apiListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	notes, err := a.listTrash(currentUsername(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]trashedNoteResponse, 0, len(notes))
+	for _, note := range notes {
+		resp = append(resp, trashedNoteResponse{newNoteResponse(note.Note), note.DeletedAt, note.PurgeAt})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// apiRestoreTrashHandler takes a note out of the trash.
+func (a *App) apiRestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.restoreFromTrash(noteID, currentUsername(r)); err != nil {
+		respondWithError(w, noteAuthStatus(err), err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditRestore, NoteID: noteID})
+
+	note, err := a.getNoteByID(noteID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newNoteResponse(*note))
+}
+
+// apiPurgeTrashHandler deletes a note in the trash for good.
+func (a *App) apiPurgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.purgeFromTrash(noteID, currentUsername(r)); err != nil {
+		respondWithError(w, noteAuthStatus(err), err.Error())
+		return
+	}
+	a.audit(r, AuditEvent{Action: auditPurge, NoteID: noteID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashHandler shows the notes in the trash of the user.
+func (a *App) trashHandler(w http.ResponseWriter, r *http.Request) {
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/trash"})
+	}
+
+	notes, err := a.listTrash(currentUsername(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range notes {
+		notes[i].DescriptionHTML = renderMarkdown(notes[i].Description)
+	}
+
+	tmpl, err := template.ParseFiles("tmpl/trash.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Notes     []TrashedNote
+		Retention string
+		Message   string
+		CSRFToken string
+	}{
+		Notes:     notes,
+		Retention: formatRetention(a.trashConfig().Retention),
+		Message:   message,
+		CSRFToken: csrfToken(r),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// trashActionHandler restores or purges a note from the trash page.
+func (a *App) trashActionHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, err := noteIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var message, action string
+	if mux.Vars(r)["action"] == "restore" {
+		err = a.restoreFromTrash(noteID, currentUsername(r))
+		message, action = "The note has been restored.", auditRestore
+	} else {
+		err = a.purgeFromTrash(noteID, currentUsername(r))
+		message, action = "The note has been deleted for good.", auditPurge
+	}
+	switch {
+	case err == errNoteNotFound:
+		message = "The note is no longer in the trash."
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		a.audit(r, AuditEvent{Action: action, NoteID: noteID})
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/trash",
+	})
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// formatRetention describes a retention period in days, or as a duration
+// when it is shorter than a day.
+func formatRetention(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	switch {
+	case days == 1:
+		return "1 day"
+	case days > 1:
+		return fmt.Sprintf("%d days", days)
+	default:
+		return d.String()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAPIListTrash(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	deletedAt := time.Date(2023, 11, 1, 15, 6, 20, 0, time.UTC)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT id, title, .* FROM notes WHERE owner = \\$1 AND deleted_at IS NOT NULL").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "noteType", "description", "noteCreated", "taskCompletionTime",
+			"taskCompletionDate", "noteStatus", "noteDelegation", "owner", "deleted_at"}).
+			AddRow(4, "Old", "Note", "", deletedAt, nil, nil, nil, nil, "mydog7", deletedAt))
+
+	req := loginRequest(httptest.NewRequest("GET", "/api/v1/trash", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var notes []trashedNoteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &notes); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].ID != 4 || !notes[0].PurgeAt.Equal(deletedAt.Add(30*24*time.Hour)) {
+		t.Errorf("Unexpected trash %+v", notes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIRestoreTrash(t *testing.T) {
+	a, mock := newAPITestApp(t)
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectExec("UPDATE notes SET deleted_at = NULL").WithArgs(4, "mydog7").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, "mydog7", auditRestore, 4, "", "")
+	mock.ExpectQuery("SELECT id, title, description, noteType").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "noteType", "taskCompletionTime", "taskCompletionDate", "noteStatus", "noteDelegation", "owner", "noteCreated", "notebook_id"}).
+			AddRow(4, "Old", "", "Note", nil, nil, nil, nil, "mydog7", time.Now(), 0))
+
+	req := loginRequest(httptest.NewRequest("POST", "/api/v1/trash/4/restore", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// Only the owner can restore a note, and only from the trash
+	expectActiveUser(mock, "BIGCAT")
+	mock.ExpectExec("UPDATE notes SET deleted_at = NULL").WithArgs(4, "BIGCAT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req = loginRequest(httptest.NewRequest("POST", "/api/v1/trash/4/restore", nil), "BIGCAT")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	mock.ExpectExec("DELETE FROM notes WHERE deleted_at < CURRENT_TIMESTAMP").WithArgs(float64(7 * 24 * 60 * 60)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := a.purgeExpiredTrash(7 * 24 * time.Hour)
+	if err != nil || n != 3 {
+		t.Errorf("Expected 3 purged notes, but got %d (%v)", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/icza/session"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// recoveryCodeCount is the number of recovery codes handed out at a time.
+	recoveryCodeCount = 10
+
+	// loginChallengeCookie holds the login waiting for the second factor.
+	loginChallengeCookie = "login_challenge"
+	loginChallengeTTL    = 5 * time.Minute
+
+	// totpPendingAttr holds the secret shown during enrollment, until the
+	// user has confirmed it with a code.
+	totpPendingAttr = "totpPendingSecret"
+)
+
+// generateRecoveryCodes returns new random recovery codes, formatted as xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode removes the formatting users may type along with a recovery code.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// replaceRecoveryCodes removes the recovery codes of username and stores new ones.
+func replaceRecoveryCodes(tx *sql.Tx, username string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = $1", username); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash) VALUES ($1, $2)",
+			username, hashAPIToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// totpEnabled reports whether username has two-factor authentication turned on.
+func (a *App) totpEnabled(username string) (bool, error) {
+	var enabled bool
+	err := a.db.QueryRow("SELECT totp_enabled_at IS NOT NULL FROM users WHERE username = $1", username).Scan(&enabled)
+	return enabled, err
+}
+
+// enableTOTP turns on two-factor authentication with a confirmed secret and
+// returns the new recovery codes. step is the time step of the code used to
+// confirm the secret, which cannot be used again.
+func (a *App) enableTOTP(username, secret string, step int64) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = $2, totp_enabled_at = $3, totp_last_step = $4 WHERE username = $1",
+		username, secret, time.Now().UTC(), step)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// disableTOTP turns off two-factor authentication and removes the recovery
+// codes. It returns sql.ErrNoRows when it was not turned on.
+func (a *App) disableTOTP(username string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+		WHERE username = $1 AND totp_enabled_at IS NOT NULL`, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = $1", username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of username.
+func (a *App) regenerateRecoveryCodes(username string) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// checkSecondFactor checks an authenticator code or an unused recovery code
+// of username. Both can only be used once.
+func (a *App) checkSecondFactor(username, code string) (bool, error) {
+	var secret sql.NullString
+	var lastStep int64
+	err := a.db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE username = $1", username).
+		Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := verifyTOTP(secret.String, code, time.Now(), lastStep); ok {
+		// Recording the step in the same statement refuses a code used twice concurrently
+		result, err := a.db.Exec("UPDATE users SET totp_last_step = $2 WHERE username = $1 AND totp_last_step < $2", username, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+
+	result, err := a.db.Exec(`
+		UPDATE recovery_codes SET used_at = $3
+		WHERE username = $1 AND code_hash = $2 AND used_at IS NULL`,
+		username, hashAPIToken(normalizeRecoveryCode(code)), time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if n == 1 {
+		log.Printf("User %s used a recovery code", username)
+	}
+	return n == 1, err
+}
+
+// unusedRecoveryCodes returns how many recovery codes username has left.
+func (a *App) unusedRecoveryCodes(username string) (int, error) {
+	var n int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = $1 AND used_at IS NULL", username).Scan(&n)
+	return n, err
+}
+
+// createLoginChallenge records that username entered the right password and
+// still has to give the second factor. It returns the token for the cookie.
+func (a *App) createLoginChallenge(username string) (string, error) {
+	token, err := generateResetToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	if _, err := a.db.Exec("DELETE FROM login_challenges WHERE expires_at <= $1", now); err != nil {
+		return "", err
+	}
+	_, err = a.db.Exec("INSERT INTO login_challenges (token_hash, username, expires_at) VALUES ($1, $2, $3)",
+		hashAPIToken(token), username, now.Add(loginChallengeTTL))
+	return token, err
+}
+
+// loginChallengeUser returns the username of the login waiting for the
+// second factor, or sql.ErrNoRows when there is none or it expired.
+func (a *App) loginChallengeUser(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		return "", sql.ErrNoRows
+	}
+
+	var username string
+	err = a.db.QueryRow("SELECT username FROM login_challenges WHERE token_hash = $1 AND expires_at > $2",
+		hashAPIToken(cookie.Value), time.Now().UTC()).Scan(&username)
+	return username, err
+}
+
+// setLoginChallengeCookie sets, or with an empty token removes, the login challenge cookie.
+func (a *App) setLoginChallengeCookie(w http.ResponseWriter, token string) {
+	cookie := &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.config != nil && a.config.Server.TLS.Enabled(),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// loginTwoFactorHandler asks for the second factor after the password and
+// creates the session once it is correct.
+func (a *App) loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	redirectToLogin := func(message string) {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: message,
+			Path:  "/",
+		})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+
+	username, err := a.loginChallengeUser(r)
+	if err == sql.ErrNoRows {
+		a.setLoginChallengeCookie(w, "")
+		redirectToLogin("Your login has expired. Please log in again.")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check for a message cookie
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/login/2fa"})
+	}
+
+	if r.Method != http.MethodPost {
+		tmpl, err := template.ParseFiles("tmpl/login_2fa.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, struct{ Message string }{Message: message}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Wrong codes count towards the lockout like wrong passwords
+	ip := clientIP(r)
+	if err := a.checkLoginAllowed(username, ip); err == errLoginLocked {
+		redirectToLogin(msgLockedOut)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := a.checkSecondFactor(username, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := a.recordLoginFailure(username, ip); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:  "message",
+			Value: "The code is not correct.",
+			Path:  "/login/2fa",
+		})
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	cookie, _ := r.Cookie(loginChallengeCookie)
+	if _, err := a.db.Exec("DELETE FROM login_challenges WHERE token_hash = $1", hashAPIToken(cookie.Value)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.clearLoginFailures(username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setLoginChallengeCookie(w, "")
+
+	// The account may have been disabled since the password was checked
+	if disabled, err := a.userDisabled(username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if disabled {
+		log.Printf("User %s is disabled, login refused", username)
+		redirectToLogin(msgDisabled)
+		return
+	}
+
+	sess := a.newLoginSession(r, username)
+	a.audit(r, AuditEvent{Actor: username, Action: auditLogin, Details: "two-factor"})
+	session.Add(sess, w)
+	http.Redirect(w, r, "/list", http.StatusSeeOther)
+}
+
+// twoFactorPage holds the template data of the two-factor settings page.
+type twoFactorPage struct {
+	Username          string
+	Enabled           bool
+	RecoveryCodesLeft int
+	HasPassword       bool
+	Secret            string
+	URI               string
+	QRCode            template.URL
+	RecoveryCodes     []string
+	Message           string
+	CSRFToken         string
+}
+
+// renderTwoFactorPage shows the two-factor settings. While two-factor
+// authentication is off, it shows a new secret to enroll.
+func (a *App) renderTwoFactorPage(w http.ResponseWriter, r *http.Request, data twoFactorPage) {
+	username := currentUsername(r)
+	data.Username = username
+	data.CSRFToken = csrfToken(r)
+
+	enabled, err := a.totpEnabled(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Enabled = enabled
+
+	if enabled {
+		if data.RecoveryCodesLeft, err = a.unusedRecoveryCodes(username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = a.db.QueryRow("SELECT password <> '' FROM users WHERE username = $1", username).Scan(&data.HasPassword)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if sess := session.Get(r); sess != nil {
+		secret, _ := sess.Attr(totpPendingAttr).(string)
+		if secret == "" {
+			if secret, err = generateTOTPSecret(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			sess.SetAttr(totpPendingAttr, secret)
+		}
+
+		data.Secret = secret
+		data.URI = totpURI(username, secret)
+		png, err := qrcode.Encode(data.URI, qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	tmpl, err := template.ParseFiles("tmpl/twofactor.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// redirectTwoFactor goes back to the two-factor settings page with a message.
+func redirectTwoFactor(w http.ResponseWriter, r *http.Request, message string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  "message",
+		Value: message,
+		Path:  "/account/2fa",
+	})
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+}
+
+// twoFactorHandler shows the two-factor settings page.
+func (a *App) twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var message string
+	if cookie, err := r.Cookie("message"); err == nil {
+		message = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "message", MaxAge: -1, Path: "/account/2fa"})
+	}
+
+	a.renderTwoFactorPage(w, r, twoFactorPage{Message: message})
+}
+
+// enableTwoFactorHandler turns on two-factor authentication once the user
+// has entered a code for the secret shown to them, and shows the recovery codes.
+func (a *App) enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	sess := session.Get(r)
+	var secret string
+	if sess != nil {
+		secret, _ = sess.Attr(totpPendingAttr).(string)
+	}
+	if secret == "" {
+		redirectTwoFactor(w, r, "Please scan the code again.")
+		return
+	}
+
+	step, ok := verifyTOTP(secret, r.FormValue("code"), time.Now(), 0)
+	if !ok {
+		redirectTwoFactor(w, r, "The code is not correct. Check the time on your device and try again.")
+		return
+	}
+
+	codes, err := a.enableTOTP(username, secret, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.SetAttr(totpPendingAttr, nil)
+
+	log.Printf("User %s turned on two-factor authentication", username)
+	a.renderTwoFactorPage(w, r, twoFactorPage{
+		Message:       "Two-factor authentication is on. Keep these recovery codes somewhere safe, they are only shown once.",
+		RecoveryCodes: codes,
+	})
+}
+
+// disableTwoFactorHandler turns off two-factor authentication after checking
+// the password and a code.
+func (a *App) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	// Users who log in with single sign-on or LDAP have no local password,
+	// and confirm with the code alone
+	var hash string
+	err := a.db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&hash)
+	if err == sql.ErrNoRows || (err == nil && hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.FormValue("current_password"))) != nil) {
+		redirectTwoFactor(w, r, "The current password is not correct.")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := a.checkSecondFactor(username, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		redirectTwoFactor(w, r, "The code is not correct.")
+		return
+	}
+
+	if err := a.disableTOTP(username); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s turned off two-factor authentication", username)
+	redirectTwoFactor(w, r, "Two-factor authentication is off.")
+}
+
+// regenerateRecoveryCodesHandler replaces the recovery codes after checking
+// a code, and shows the new ones.
+func (a *App) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	username := currentUsername(r)
+
+	ok, err := a.checkSecondFactor(username, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		redirectTwoFactor(w, r, "The code is not correct.")
+		return
+	}
+
+	codes, err := a.regenerateRecoveryCodes(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s created new recovery codes", username)
+	a.renderTwoFactorPage(w, r, twoFactorPage{
+		Message:       "Your old recovery codes no longer work. Keep these somewhere safe, they are only shown once.",
+		RecoveryCodes: codes,
+	})
+}
+
+// apiResetTwoFactorHandler turns off two-factor authentication for a user
+// who lost their device and recovery codes.
+func (a *App) apiResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	err := a.disableTOTP(username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Two-factor authentication is not turned on for this user")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Administrator %s reset two-factor authentication of %s", currentUsername(r), username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/icza/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes, but got %d", recoveryCodeCount, len(codes))
+	}
+	if len(codes[0]) != 11 || codes[0][5] != '-' {
+		t.Errorf("Unexpected code format %q", codes[0])
+	}
+	if normalizeRecoveryCode(" "+strings.ToUpper(codes[0])+" ") != strings.Replace(codes[0], "-", "", 1) {
+		t.Errorf("Expected typed codes to be normalized")
+	}
+}
+
+func TestLogin_TwoFactor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+	if session.Global == nil {
+		session.Global = session.NewCookieManagerOptions(session.NewInMemStore(), &session.CookieMngrOptions{AllowHTTP: true})
+	}
+
+	// The right password only leads to the second step
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT username, password FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "password"}).AddRow("mydog7", string(hash)))
+	mock.ExpectExec("DELETE FROM login_failures").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+	mock.ExpectExec("DELETE FROM login_challenges WHERE expires_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO login_challenges").WithArgs(sqlmock.AnyArg(), "mydog7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr, _ := postLogin(&a, "mydog7", "admin")
+	if rr.Header().Get("Location") != "/login/2fa" {
+		t.Fatalf("Expected a redirect to the second step, but got %q", rr.Header().Get("Location"))
+	}
+	var challenge *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == loginChallengeCookie {
+			challenge = c
+		}
+		if c.Name == session.Global.(*session.CookieManager).SessIDCookieName() {
+			t.Errorf("Expected no session before the second factor")
+		}
+	}
+	if challenge == nil || !challenge.HttpOnly {
+		t.Fatalf("Expected an HTTP only challenge cookie, but got %v", challenge)
+	}
+
+	// A wrong code counts as a failed login
+	expectChallenge := func() {
+		mock.ExpectQuery("SELECT username FROM login_challenges").WithArgs(hashAPIToken(challenge.Value), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("mydog7"))
+		mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT totp_secret, totp_last_step FROM users").WithArgs("mydog7").
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(rfc6238Secret, 0))
+	}
+	postCode := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login/2fa", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(challenge)
+		rr := httptest.NewRecorder()
+		a.loginTwoFactorHandler(rr, req)
+		return rr
+	}
+
+	expectChallenge()
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_failures").WithArgs(loginFailureUser, "mydog7", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO login_failures").WithArgs(loginFailureIP, "192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	if rr := postCode("000000x"); rr.Header().Get("Location") != "/login/2fa" {
+		t.Errorf("Expected to stay on the second step, but got %q", rr.Header().Get("Location"))
+	}
+
+	// The right code creates the session, unless the account was disabled in the meantime
+	code, _ := totpCode(rfc6238Secret, totpStep(time.Now()))
+	expectCode := func(disabled bool) {
+		expectChallenge()
+		mock.ExpectExec("UPDATE users SET totp_last_step").WithArgs("mydog7", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM login_challenges WHERE token_hash").WithArgs(hashAPIToken(challenge.Value)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM login_failures").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+			WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(disabled))
+	}
+
+	expectCode(true)
+	if rr := postCode(code); rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a disabled user to be sent back to the login page, but got %q", rr.Header().Get("Location"))
+	}
+
+	expectCode(false)
+	expectAudit(mock, "mydog7", auditLogin, 0, "", "two-factor")
+	if rr := postCode(code); rr.Header().Get("Location") != "/list" {
+		t.Errorf("Expected to be logged in, but got %q", rr.Header().Get("Location"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDisableTwoFactorHandler_NoLocalPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	disable := func(password, code string) *httptest.ResponseRecorder {
+		form := url.Values{"current_password": {password}, "code": {code}}
+		req := httptest.NewRequest("POST", "/account/2fa/disable", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		a.disableTwoFactorHandler(rr, loginRequest(req, "jane.doe"))
+		return rr
+	}
+	message := func(rr *httptest.ResponseRecorder) string {
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "message" {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	// Users who sign in with single sign-on confirm with a code alone
+	code, _ := totpCode(rfc6238Secret, totpStep(time.Now()))
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane.doe").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(""))
+	mock.ExpectQuery("SELECT totp_secret, totp_last_step FROM users").WithArgs("jane.doe").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(rfc6238Secret, 0))
+	mock.ExpectExec("UPDATE users SET totp_last_step").WithArgs("jane.doe", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET totp_secret = NULL").WithArgs("jane.doe").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").WithArgs("jane.doe").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+	if rr := disable("", code); message(rr) != "Two-factor authentication is off." {
+		t.Errorf("Expected two-factor authentication to be turned off, but got %q", message(rr))
+	}
+
+	// Users with a password still need it
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs("jane.doe").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(hash)))
+	if rr := disable("", code); message(rr) != "The current password is not correct." {
+		t.Errorf("Expected the password to be required, but got %q", message(rr))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCheckSecondFactor_RecoveryCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := App{db: db}
+
+	mock.ExpectQuery("SELECT totp_secret, totp_last_step FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(rfc6238Secret, 0))
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").
+		WithArgs("mydog7", hashAPIToken("abcdefghij"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ok, err := a.checkSecondFactor("mydog7", "ABCDE-FGHIJ")
+	if err != nil || !ok {
+		t.Errorf("Expected the recovery code to be accepted, but got %v, %v", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIResetTwoFactor(t *testing.T) {
+	a, mock := newAPITestApp(t)
+	a.config = defaultConfig()
+	a.config.Admins = []string{"mydog7"}
+
+	expectActiveUser(mock, "mydog7")
+	mock.ExpectQuery("SELECT disabled_at IS NOT NULL FROM users").WithArgs("mydog7").
+		WillReturnRows(sqlmock.NewRows([]string{"disabled"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET totp_secret = NULL").WithArgs("BIGCAT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").WithArgs("BIGCAT").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+
+	req := loginRequest(httptest.NewRequest("DELETE", "/api/v1/admin/users/BIGCAT/2fa", nil), "mydog7")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, but got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net"
 	"net/http"
 )
@@ -27,27 +26,25 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func GetLocalIP() net.IP {
+// GetLocalIP returns the local IP used for outbound traffic.
+// No packets are sent, but it fails when there is no route to the Internet.
+func GetLocalIP() (net.IP, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer conn.Close()
 
 	localAddress := conn.LocalAddr().(*net.UDPAddr)
-    
-	return localAddress.IP
+
+	return localAddress.IP, nil
 }
 
-//used to auto detect the active local IP address - not used yet
-func GetOutboundIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// GetOutboundIP returns the active local IP address as a string, for display.
+func GetOutboundIP() (string, error) {
+	ip, err := GetLocalIP()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
+	return ip.String(), nil
 }
-
-